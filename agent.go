@@ -2,155 +2,339 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"net"
-	"net/netip"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/cenkalti/backoff/v4"
 	"github.com/costela/wesher/cluster"
-	"github.com/costela/wesher/common"
-	"github.com/costela/wesher/etchosts"
-	"github.com/costela/wesher/wg"
-	"github.com/hashicorp/go-sockaddr"
+	"github.com/costela/wesher/control"
+	"github.com/costela/wesher/eventbus"
+	"github.com/costela/wesher/sdnotify"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 type AgentCmd struct {
-	ClusterKey    key          `env:"WESHER_CLUSTER_KEY" help:"shared key for cluster membership; must be 32 bytes base64 encoded; will be generated if not provided"`
-	Join          []string     `env:"WESHER_JOIN" help:"comma separated list of hostnames or IP addresses to existing cluster members; if not provided, will attempt resuming any known state or otherwise wait for further members."`
-	Init          bool         `env:"WESHER_INIT" help:"whether to explicitly (re)initialize the cluster; any known state from previous runs will be forgotten"`
-	BindAddr      string       `env:"WESHER_BIND_ADDR" help:"IP address to bind to for cluster membership traffic (cannot be used with --bind-iface)"`
-	BindIface     string       `env:"WESHER_BIND_IFACE" help:"Interface to bind to for cluster membership traffic (cannot be used with --bind-addr)"`
-	ClusterPort   int          `env:"WESHER_CLUSTER_PORT" help:"port used for membership gossip traffic (both TCP and UDP); must be the same across cluster" default:"7946"`
-	WireguardPort int          `env:"WESHER_WIREGUARD_PORT" help:"port used for wireguard traffic (UDP); must be the same across cluster" default:"51820"`
-	OverlayNet    netip.Prefix `env:"WESHER_OVERLAY_NET" help:"the network in which to allocate addresses for the overlay mesh network (CIDR format); smaller networks increase the chance of IP collision" default:"10.0.0.0/8"`
-	Interface     string       `env:"WESHER_INTERFACE" help:"name of the wireguard interface to create and manage" default:"wgoverlay"`
-	NoEtcHosts    bool         `env:"WESHER_NO_ETC_HOSTS" help:"disable writing of entries to /etc/hosts"`
-
-	// for easier local testing; will break etchosts entry
-	UseIPAsName bool `name:"ip-as-name" default:"false" hidden:""`
+	networkConfig `embed:""`
+
+	Networks string `env:"WESHER_NETWORKS" type:"existingfile" help:"path to a YAML file listing multiple networks to manage from a single process; each entry accepts the same settings as the command-line flags, which act as defaults"`
+	HTTPAddr string `env:"WESHER_HTTP_ADDR" help:"HOST:PORT on which to serve Prometheus metrics and health checks (/healthz, /readyz) over HTTP; disabled if not set"`
+
+	networks []networkConfig
 }
 
 func (a *AgentCmd) Validate() error {
-	if len(a.ClusterKey.bytes) != 0 && len(a.ClusterKey.bytes) != cluster.KeyLen {
-		return fmt.Errorf("unsupported cluster key length; expected %d, got %d", cluster.KeyLen, len(a.ClusterKey.bytes))
+	if a.Networks == "" {
+		a.networks = []networkConfig{a.networkConfig}
+	} else {
+		networks, err := loadNetworks(a.Networks, a.networkConfig)
+		if err != nil {
+			return err
+		}
+		a.networks = networks
 	}
 
-	if a.OverlayNet.Bits()%8 != 0 {
-		return fmt.Errorf("unsupported overlay network size; net mask must be multiple of 8, got %d", a.OverlayNet.Bits())
+	for i := range a.networks {
+		if a.networks[i].Name == "" {
+			a.networks[i].Name = a.networks[i].Interface
+		}
+		if err := a.networks[i].validate(); err != nil {
+			return fmt.Errorf("network %s: %w", a.networks[i].Name, err)
+		}
 	}
 
-	if a.BindAddr != "" && a.BindIface != "" {
-		return fmt.Errorf("setting both bind address and bind interface is not supported")
-	} else if a.BindIface != "" {
-		// Compute the actual bind address based on the provided interface
-		iface, err := net.InterfaceByName(a.BindIface)
-		if err != nil {
-			return fmt.Errorf("getting interface by name %s: %w", a.BindIface, err)
-		}
-		addrs, err := iface.Addrs()
-		if err != nil {
-			return fmt.Errorf("getting addresses for interface %s: %w", a.BindIface, err)
+	return validateNetworksDistinct(a.networks)
+}
+
+// facilities are shared by all networks managed by the agent.
+type facilities struct {
+	// logger returns the logger for the provided subsystem
+	logger func(subsystem string) *logrus.Entry
+	// events receives the events of all networks
+	events *eventbus.Bus
+
+	mu       sync.Mutex
+	statuses map[string]func() control.NetworkStatus
+	bans     map[string]revokeFunc
+}
+
+// register adds a network to the ones reported by the control API.
+func (f *facilities) register(network string, status func() control.NetworkStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.statuses == nil {
+		f.statuses = make(map[string]func() control.NetworkStatus)
+	}
+	f.statuses[network] = status
+}
+
+// fail reports a network as failed, and stops offering it for bans.
+func (f *facilities) fail(network string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.statuses == nil {
+		f.statuses = make(map[string]func() control.NetworkStatus)
+	}
+	f.statuses[network] = func() control.NetworkStatus {
+		return control.NetworkStatus{Name: network, Error: err.Error()}
+	}
+	delete(f.bans, network)
+}
+
+// revokeFunc applies revocations to a network, returning the ones applied.
+type revokeFunc func(revs []cluster.Revocation) ([]cluster.Revocation, error)
+
+// registerBan adds a network to the ones nodes can be banned from through the control API.
+func (f *facilities) registerBan(network string, ban revokeFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.bans == nil {
+		f.bans = make(map[string]revokeFunc)
+	}
+	f.bans[network] = ban
+}
+
+// ban applies the JSON encoded revocations to the provided network, or to all networks if empty, returning the networks
+// they were applied to. When applying to all networks, failures are only reported if no network accepted them.
+func (f *facilities) ban(network, payload string) ([]string, error) {
+	revs := []cluster.Revocation{}
+	if err := json.Unmarshal([]byte(payload), &revs); err != nil {
+		return nil, fmt.Errorf("decoding revocations: %w", err)
+	}
+	if len(revs) == 0 {
+		return nil, fmt.Errorf("no revocations provided")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if network != "" {
+		ban, ok := f.bans[network]
+		if !ok {
+			return nil, fmt.Errorf("unknown network %s", network)
 		}
-		if len(addrs) > 0 {
-			if addr, ok := addrs[0].(*net.IPNet); ok {
-				a.BindAddr = addr.IP.String()
-			}
+		if _, err := ban(revs); err != nil {
+			return nil, fmt.Errorf("network %s: %w", network, err)
 		}
-	} else if a.BindAddr == "" && a.BindIface == "" {
-		// FIXME: this is a workaround for memberlist refusing to listen on public IPs if BindAddr==0.0.0.0
-		detectedBindAddr, err := sockaddr.GetPublicIP()
-		if err != nil {
-			return err
+		return []string{network}, nil
+	}
+
+	names := make([]string, 0, len(f.bans))
+	for name := range f.bans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	banned := make([]string, 0, len(names))
+	failures := make([]string, 0)
+	for _, name := range names {
+		if _, err := f.bans[name](revs); err != nil {
+			failures = append(failures, fmt.Sprintf("network %s: %s", name, err))
+			continue
 		}
-		// if we cannot find a public IP, let memberlist do its thing
-		if detectedBindAddr != "" {
-			a.BindAddr = detectedBindAddr
-		} else {
-			a.BindAddr = "0.0.0.0"
+		banned = append(banned, name)
+	}
+	if len(banned) == 0 {
+		if len(failures) == 0 {
+			return nil, fmt.Errorf("no networks running")
 		}
+		return nil, fmt.Errorf("%s", strings.Join(failures, "; "))
 	}
+	return banned, nil
+}
 
-	return nil
+// status returns the status of all registered networks.
+func (f *facilities) status() []control.NetworkStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	statuses := make([]control.NetworkStatus, 0, len(f.statuses))
+	for _, status := range f.statuses {
+		statuses = append(statuses, status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
 }
 
 func (a *AgentCmd) Run(cli *cli) error {
-	// Create the wireguard and cluster configuration
-	cluster, err := cluster.New(a.Interface, a.Init, a.ClusterKey.bytes, a.BindAddr, a.ClusterPort, a.UseIPAsName)
-	if err != nil {
-		logrus.WithError(err).Fatal("could not create cluster")
-	}
-	wgstate, localNode, err := wg.New(a.Interface, a.WireguardPort, a.OverlayNet, cluster.LocalName)
-	if err != nil {
-		logrus.WithError(err).Fatal("could not instantiate wireguard controller")
+	ctx, cancelSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancelSignals()
+
+	shared := &facilities{
+		logger: cli.logger,
+		events: &eventbus.Bus{},
 	}
 
-	// Prepare the /etc/hosts writer
-	hostsFile := &etchosts.EtcHosts{
-		Banner: "# ! managed automatically by wesher interface " + a.Interface,
-		Logger: logrus.StandardLogger(),
+	// the control socket is not essential, so failing to provide it should not keep the networks from running
+	controlServer := &control.Server{Events: shared.events, Status: shared.status, Ban: shared.ban, Logger: cli.logger("control")}
+	go func() {
+		if err := controlServer.ListenAndServe(ctx, cli.ControlSocket); err != nil {
+			cli.logger("control").WithError(err).Error("could not serve control socket")
+		}
+	}()
+	if a.HTTPAddr != "" {
+		go func() {
+			if err := controlServer.ListenAndServeHTTP(ctx, a.HTTPAddr); err != nil {
+				cli.logger("control").WithError(err).Error("could not serve HTTP")
+			}
+		}()
 	}
 
-	// Join the cluster
-	cluster.Update(localNode)
+	go notifySystemd(ctx, shared, len(a.networks), cli.logger("control"))
 
-	nodec := cluster.Members() // avoid deadlocks by starting before join
-	if err := backoff.RetryNotify(
-		func() error { return cluster.Join(a.Join) },
-		backoff.NewExponentialBackOff(),
-		func(err error, dur time.Duration) {
-			logrus.WithError(err).Errorf("could not join cluster, retrying in %s", dur)
-		},
-	); err != nil {
-		logrus.WithError(err).Fatal("could not join cluster")
+	return runNetworks(ctx, shared, a.networks, (*networkConfig).run)
+}
+
+// runNetworks runs the provided networks until they all stop. A failing network is reported as not ready, without
+// affecting the others; running only fails - so the process exits - once every network failed.
+func runNetworks(
+	ctx context.Context, shared *facilities, networks []networkConfig,
+	run func(n *networkConfig, ctx context.Context, shared *facilities) error,
+) error {
+	failures := make([]string, len(networks))
+	running := sync.WaitGroup{}
+	for i := range networks {
+		i, network := i, &networks[i]
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			if err := run(network, ctx, shared); err != nil {
+				logrus.WithField("network", network.Name).WithError(err).Error("could not run network")
+				shared.fail(network.Name, err)
+				failures[i] = fmt.Sprintf("network %s: %s", network.Name, err)
+			}
+		}()
 	}
+	running.Wait()
 
-	ctx, cancelSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
-	defer cancelSignals()
+	for _, failure := range failures {
+		if failure == "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("all networks failed: %s", strings.Join(failures, "; "))
+}
+
+// systemdNotifyInterval is how often the status reported to systemd is refreshed.
+const systemdNotifyInterval = time.Second
 
-	// Main loop
-	logrus.Debug("waiting for cluster events")
+// notifySystemd reports readiness to systemd once all networks are set up, and keeps the status shown by systemctl
+// up to date until the context is cancelled.
+// It is a noop if not started by systemd as a notify service.
+func notifySystemd(ctx context.Context, shared *facilities, expected int, log logrus.FieldLogger) {
+	ticker := time.NewTicker(systemdNotifyInterval)
+	defer ticker.Stop()
+
+	ready := false
+	lastStatus := ""
 	for {
 		select {
-		case rawNodes := <-nodec:
-			nodes := make([]common.Node, 0, len(rawNodes))
-			hosts := make(map[string][]string, len(rawNodes))
-			logrus.Info("cluster members:\n")
-			for _, node := range rawNodes {
-				if err := node.DecodeMeta(); err != nil {
-					logrus.Warnf("\t addr: %s, could not decode metadata", node.Addr)
-					continue
-				}
-				logrus.Infof("\taddr: %s, overlay: %s, pubkey: %s", node.Addr, node.OverlayAddr, node.PubKey)
-				nodes = append(nodes, node)
-				hosts[node.OverlayAddr.String()] = []string{node.Name}
-			}
-			if err := wgstate.SetUpInterface(nodes); err != nil {
-				logrus.WithError(err).Error("could not up interface")
-				wgstate.DownInterface() // nolint: errcheck // opportunistic
-			}
-			if !a.NoEtcHosts {
-				if err := hostsFile.WriteEntries(hosts); err != nil {
-					logrus.WithError(err).Error("could not write hosts entries")
-				}
-			}
+		case <-ticker.C:
 		case <-ctx.Done():
-			cancelSignals()
-			logrus.Info("terminating...")
-			cluster.Leave()
-			if !a.NoEtcHosts {
-				if err := hostsFile.WriteEntries(map[string][]string{}); err != nil {
-					logrus.WithError(err).Error("could not remove stale hosts entries")
-				}
-			}
-			if err := wgstate.DownInterface(); err != nil {
-				logrus.WithError(err).Error("could not down interface")
-			}
-			os.Exit(0)
+			sdnotify.Notify(sdnotify.Stopping, sdnotify.Status("terminating")) // nolint: errcheck // best effort
+			return
+		}
+
+		status, allReady := summarizeStatus(shared.status(), expected)
+		states := []string{}
+		if allReady && !ready {
+			states = append(states, sdnotify.Ready)
+		}
+		if status != lastStatus {
+			states = append(states, sdnotify.Status(status))
 		}
+		if len(states) == 0 {
+			continue
+		}
+		sent, err := sdnotify.Notify(states...)
+		if err != nil {
+			log.WithError(err).Warn("could not notify systemd")
+			continue
+		}
+		if !sent {
+			return // not running under systemd
+		}
+		ready = ready || allReady
+		lastStatus = status
 	}
 }
+
+// summarizeStatus returns a short description of the networks' status, and whether all expected networks are ready.
+func summarizeStatus(networks []control.NetworkStatus, expected int) (string, bool) {
+	readyCount, members := 0, 0
+	pending := []string{}
+	for _, n := range networks {
+		members += n.Members
+		if ok, reasons := n.Ready(); ok {
+			readyCount++
+		} else {
+			pending = append(pending, fmt.Sprintf("%s: %s", n.Name, strings.Join(reasons, ", ")))
+		}
+	}
+	status := fmt.Sprintf("%d/%d networks ready, %d members", readyCount, expected, members)
+	if len(pending) > 0 {
+		status += "; " + strings.Join(pending, "; ")
+	}
+	return status, readyCount == expected
+}
+
+// loadNetworks reads the networks file, using the provided config as default for settings not explicitly set.
+func loadNetworks(path string, defaults networkConfig) ([]networkConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading networks file: %w", err)
+	}
+
+	raw := []yaml.Node{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("parsing networks file: %w", err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("networks file %s does not define any network", path)
+	}
+
+	networks := make([]networkConfig, len(raw))
+	for i := range raw {
+		networks[i] = defaults
+		// avoid sharing the defaults' labels between networks
+		networks[i].Labels = make(map[string]string, len(defaults.Labels))
+		for k, v := range defaults.Labels {
+			networks[i].Labels[k] = v
+		}
+		if err := raw[i].Decode(&networks[i]); err != nil {
+			return nil, fmt.Errorf("parsing network %d in networks file: %w", i, err)
+		}
+	}
+	return networks, nil
+}
+
+// validateNetworksDistinct ensures networks managed by the same process do not step on each other's toes.
+func validateNetworksDistinct(networks []networkConfig) error {
+	names := make(map[string]struct{}, len(networks))
+	interfaces := make(map[string]struct{}, len(networks))
+	wireguardPorts := make(map[int]struct{}, len(networks))
+	clusterAddrs := make(map[string]struct{}, len(networks))
+	for _, n := range networks {
+		if _, ok := names[n.Name]; ok {
+			return fmt.Errorf("network name %s used more than once", n.Name)
+		}
+		names[n.Name] = struct{}{}
+		if _, ok := interfaces[n.Interface]; ok {
+			return fmt.Errorf("network %s: interface %s used more than once", n.Name, n.Interface)
+		}
+		interfaces[n.Interface] = struct{}{}
+		if _, ok := wireguardPorts[n.WireguardPort]; ok {
+			return fmt.Errorf("network %s: wireguard port %d used more than once", n.Name, n.WireguardPort)
+		}
+		wireguardPorts[n.WireguardPort] = struct{}{}
+		clusterAddr := fmt.Sprintf("%s:%d", n.BindAddr, n.ClusterPort)
+		if _, ok := clusterAddrs[clusterAddr]; ok {
+			return fmt.Errorf("network %s: cluster address %s used more than once", n.Name, clusterAddr)
+		}
+		clusterAddrs[clusterAddr] = struct{}{}
+	}
+	return nil
+}
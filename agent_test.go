@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/control"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_loadNetworks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "networks.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- name: first
+  interface: wg1
+  wireguard-port: 51821
+  overlay-net: 10.10.0.0/16
+  labels: {zone: a}
+  handshake-timeout: 5m
+- interface: wg2
+  cluster-key: ILICZ3yBMCGAWNIq5Pn0bewBVimW3Q2yRVJ/Be+b1Uc=
+`), 0o600))
+
+	defaults := networkConfig{
+		Interface:        "wgoverlay",
+		WireguardPort:    51820,
+		ClusterPort:      7946,
+		OverlayNet:       netip.MustParsePrefix("10.0.0.0/8"),
+		Labels:           map[string]string{"role": "db"},
+		HandshakeTimeout: 3 * time.Minute,
+	}
+
+	networks, err := loadNetworks(path, defaults)
+	require.NoError(t, err)
+	require.Len(t, networks, 2)
+
+	assert.Equal(t, "first", networks[0].Name)
+	assert.Equal(t, "wg1", networks[0].Interface)
+	assert.Equal(t, 51821, networks[0].WireguardPort)
+	assert.Equal(t, 7946, networks[0].ClusterPort)
+	assert.Equal(t, netip.MustParsePrefix("10.10.0.0/16"), networks[0].OverlayNet)
+	assert.Equal(t, map[string]string{"role": "db", "zone": "a"}, networks[0].Labels)
+	assert.Equal(t, 5*time.Minute, networks[0].HandshakeTimeout)
+
+	assert.Equal(t, "wg2", networks[1].Interface)
+	assert.Equal(t, 51820, networks[1].WireguardPort)
+	assert.Len(t, networks[1].ClusterKey.bytes, 32)
+	assert.Equal(t, map[string]string{"role": "db"}, networks[1].Labels)
+	assert.Equal(t, map[string]string{"role": "db"}, defaults.Labels, "defaults should not be modified")
+}
+
+func Test_validateNetworksDistinct(t *testing.T) {
+	base := networkConfig{Name: "a", Interface: "wg1", WireguardPort: 51820, BindAddr: "192.0.2.1", ClusterPort: 7946}
+
+	tests := []struct {
+		name    string
+		modify  func(n *networkConfig)
+		wantErr bool
+	}{
+		{"distinct", func(n *networkConfig) {}, false},
+		{"same name", func(n *networkConfig) { n.Name = "a" }, true},
+		{"same interface", func(n *networkConfig) { n.Interface = "wg1" }, true},
+		{"same wireguard port", func(n *networkConfig) { n.WireguardPort = 51820 }, true},
+		{"same cluster address", func(n *networkConfig) { n.ClusterPort = 7946 }, true},
+		{"same cluster port on other address", func(n *networkConfig) { n.ClusterPort, n.BindAddr = 7946, "192.0.2.2" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := networkConfig{Name: "b", Interface: "wg2", WireguardPort: 51821, BindAddr: "192.0.2.1", ClusterPort: 7947}
+			tt.modify(&other)
+			err := validateNetworksDistinct([]networkConfig{base, other})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_summarizeStatus(t *testing.T) {
+	ready := control.NetworkStatus{Name: "a", Members: 2, Joined: true, InterfaceUp: true, HostsWritten: true}
+	joining := control.NetworkStatus{Name: "b", Members: 1}
+
+	status, ok := summarizeStatus([]control.NetworkStatus{ready}, 2)
+	assert.False(t, ok, "networks not yet registered should not be ready")
+	assert.Equal(t, "1/2 networks ready, 2 members", status)
+
+	status, ok = summarizeStatus([]control.NetworkStatus{ready, joining}, 2)
+	assert.False(t, ok)
+	assert.Equal(t, "1/2 networks ready, 3 members; b: cluster not joined, interface not configured, hosts entries not written", status)
+
+	joining.Joined, joining.InterfaceUp, joining.HostsWritten = true, true, true
+	status, ok = summarizeStatus([]control.NetworkStatus{ready, joining}, 2)
+	assert.True(t, ok)
+	assert.Equal(t, "2/2 networks ready, 3 members", status)
+}
+
+func Test_runNetworks(t *testing.T) {
+	networks := []networkConfig{{Name: "broken"}, {Name: "working"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	shared := &facilities{}
+	shared.registerBan("broken", func(revs []cluster.Revocation) ([]cluster.Revocation, error) { return revs, nil })
+	failed := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- runNetworks(ctx, shared, networks, func(n *networkConfig, ctx context.Context, shared *facilities) error {
+			if n.Name == "broken" {
+				defer close(failed)
+				return fmt.Errorf("no wireguard")
+			}
+			<-ctx.Done()
+			return nil
+		})
+	}()
+
+	<-failed
+	select {
+	case err := <-done:
+		t.Fatalf("one failing network should not stop the others: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Eventually(t, func() bool {
+		statuses := shared.status()
+		return len(statuses) == 1 && statuses[0].Error == "no wireguard"
+	}, time.Second, 10*time.Millisecond, "failed network should be reported")
+	ready, reasons := shared.status()[0].Ready()
+	assert.False(t, ready)
+	assert.Equal(t, []string{"failed: no wireguard"}, reasons)
+	_, err := shared.ban("broken", `[{"target":"bad"}]`)
+	assert.Error(t, err, "failed networks should not accept bans")
+
+	cancel()
+	assert.NoError(t, <-done, "running should not fail while some network ran")
+
+	err = runNetworks(context.Background(), &facilities{}, networks, func(n *networkConfig, ctx context.Context, shared *facilities) error {
+		return fmt.Errorf("no wireguard")
+	})
+	assert.EqualError(t, err, "all networks failed: network broken: no wireguard; network working: no wireguard")
+}
+
+func Test_facilities_ban(t *testing.T) {
+	shared := &facilities{}
+	revocations := func(target string) string {
+		return fmt.Sprintf(`[{"target":%q}]`, target)
+	}
+	_, err := shared.ban("", revocations("bad"))
+	assert.Error(t, err, "banning without networks should fail")
+
+	banned := map[string][]string{}
+	shared.registerBan("b", func(revs []cluster.Revocation) ([]cluster.Revocation, error) {
+		banned["b"] = append(banned["b"], revs[0].Target)
+		return revs, nil
+	})
+	shared.registerBan("a", func(revs []cluster.Revocation) ([]cluster.Revocation, error) {
+		if revs[0].Target == "known" {
+			return nil, fmt.Errorf("%s is already banned", revs[0].Target)
+		}
+		banned["a"] = append(banned["a"], revs[0].Target)
+		return revs, nil
+	})
+
+	_, err = shared.ban("", "bad")
+	assert.Error(t, err, "invalid revocations should be rejected")
+	_, err = shared.ban("", "[]")
+	assert.Error(t, err, "empty revocations should be rejected")
+
+	networks, err := shared.ban("", revocations("bad"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, networks)
+
+	networks, err = shared.ban("", revocations("known"))
+	require.NoError(t, err, "failures should be tolerated while banning from some network")
+	assert.Equal(t, []string{"b"}, networks)
+
+	_, err = shared.ban("a", revocations("known"))
+	assert.Error(t, err)
+	_, err = shared.ban("c", revocations("bad"))
+	assert.Error(t, err, "unknown networks should be rejected")
+
+	networks, err = shared.ban("a", revocations("worse"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, networks)
+	assert.Equal(t, map[string][]string{"a": {"bad", "worse"}, "b": {"bad", "known"}}, banned)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/control"
+)
+
+type BanCmd struct {
+	Targets []string      `arg:"" help:"names, wireguard public keys or cluster addresses of the nodes to ban"`
+	Key     string        `required:"" type:"existingfile" env:"WESHER_BAN_KEY" help:"path to the private ban key signing the ban (see ban-key command)"`
+	Expires time.Duration `help:"time after which the ban ends by itself; if not set, the ban lasts until lifted with the unban command"`
+	Network string        `help:"network to ban the nodes from; defaults to all networks of the agent"`
+}
+
+func (b *BanCmd) Run(cli *cli) error {
+	now := time.Now().UTC()
+	expires := time.Time{}
+	if b.Expires > 0 {
+		expires = now.Add(b.Expires)
+	}
+	return revoke(cli, b.Key, b.Network, b.Targets, func(target string) cluster.Revocation {
+		return cluster.Revocation{Target: target, Time: now, Expires: expires}
+	})
+}
+
+type UnbanCmd struct {
+	Targets []string `arg:"" help:"names, wireguard public keys or cluster addresses of the nodes to lift the bans of"`
+	Key     string   `required:"" type:"existingfile" env:"WESHER_BAN_KEY" help:"path to the private ban key signing the lifting (see ban-key command)"`
+	Network string   `help:"network to lift the bans in; defaults to all networks of the agent"`
+}
+
+func (u *UnbanCmd) Run(cli *cli) error {
+	now := time.Now().UTC()
+	return revoke(cli, u.Key, u.Network, u.Targets, func(target string) cluster.Revocation {
+		return cluster.Revocation{Target: target, Time: now, Lifted: true}
+	})
+}
+
+// revoke signs the revocations of the provided targets and sends them to the running agent.
+func revoke(cli *cli, keyPath, network string, targets []string, revocation func(target string) cluster.Revocation) error {
+	key, err := cluster.LoadBanKey(keyPath)
+	if err != nil {
+		return err
+	}
+	revs := make([]cluster.Revocation, 0, len(targets))
+	for _, target := range targets {
+		revs = append(revs, revocation(target).Sign(key))
+	}
+	payload, err := json.Marshal(revs)
+	if err != nil {
+		return fmt.Errorf("encoding revocations: %w", err)
+	}
+
+	form := url.Values{"revocations": {string(payload)}}
+	if network != "" {
+		form.Set("network", network)
+	}
+	resp, err := control.Client(cli.ControlSocket).PostForm("http://wesher/ban", form)
+	if err != nil {
+		return fmt.Errorf("could not contact agent: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body) // nolint: errcheck // best effort
+		return fmt.Errorf("could not update bans of %s: %s", strings.Join(targets, ", "), strings.TrimSpace(string(msg)))
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+type BanKeyCmd struct {
+	Path string `arg:"" type:"path" help:"path to write the new private ban key to; must not exist"`
+}
+
+func (b *BanKeyCmd) Run() error {
+	key, err := cluster.GenerateBanKey()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating ban key: %w", err)
+	}
+	if _, err := f.Write(cluster.EncodeBanKey(key)); err != nil {
+		f.Close() // nolint: errcheck
+		return fmt.Errorf("writing ban key: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing ban key: %w", err)
+	}
+
+	pub, _ := cluster.BanKey(key.Public().(ed25519.PublicKey)).MarshalText() // nolint: errcheck // cannot fail
+	fmt.Printf("%s\n", pub)
+	return nil
+}
@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+)
+
+var _ memberlist.AliveDelegate = (*delegateNode)(nil)
+
+// NotifyAlive implements the memberlist.AliveDelegate interface.
+// Nodes which are not admitted are kept out of the cluster.
+func (n *delegateNode) NotifyAlive(peer *memberlist.Node) error {
+	if peer.Name == n.cluster.LocalName {
+		return nil
+	}
+	node := common.Node{Name: peer.Name, Addr: peer.Addr, Meta: peer.Meta}
+	err := n.cluster.admit(&node)
+	n.cluster.trackRejected(node, err)
+	return err
+}
+
+// admit decides whether the provided node may join the cluster.
+func (c *Cluster) admit(node *common.Node) error {
+	if err := node.DecodeMeta(); err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+	if rev, ok := c.Banned(node); ok {
+		return fmt.Errorf("banned by %s at %s", rev.Issuer, rev.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// trackRejected logs and reports rejected nodes, once per node and reason, since memberlist will keep asking about them
+// for every gossip message mentioning them.
+func (c *Cluster) trackRejected(node common.Node, err error) {
+	c.mu.Lock()
+	if err == nil {
+		delete(c.rejected, node.Name)
+		c.mu.Unlock()
+		return
+	}
+	if c.rejected == nil {
+		c.rejected = make(map[string]string)
+	}
+	known := c.rejected[node.Name] == err.Error()
+	c.rejected[node.Name] = err.Error()
+	c.mu.Unlock()
+
+	if known {
+		return
+	}
+	c.log.WithFields(node.LogFields()).WithError(err).Warn("node rejected")
+	if c.onReject != nil {
+		c.onReject(node, err)
+	}
+}
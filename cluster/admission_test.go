@@ -0,0 +1,39 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_delegateNode_NotifyAlive(t *testing.T) {
+	rejected := make([]string, 0)
+	c := &Cluster{
+		LocalName: "local",
+		log:       logrus.StandardLogger(),
+		state:     &state{},
+		onReject:  func(node common.Node, reason error) { rejected = append(rejected, node.Name) },
+	}
+	d := &delegateNode{&common.Node{}, c}
+
+	valid := common.Node{Name: "valid"}
+	meta, err := valid.EncodeMeta(512)
+	require.NoError(t, err)
+
+	assert.NoError(t, d.NotifyAlive(&memberlist.Node{Name: "local"}))
+	assert.NoError(t, d.NotifyAlive(&memberlist.Node{Name: "valid", Addr: net.ParseIP("192.0.2.1"), Meta: meta}))
+
+	invalid := &memberlist.Node{Name: "invalid", Addr: net.ParseIP("192.0.2.2"), Meta: []byte("garbage")}
+	assert.Error(t, d.NotifyAlive(invalid))
+	assert.Error(t, d.NotifyAlive(invalid))
+	assert.Equal(t, []string{"invalid"}, rejected, "rejections should only be reported once")
+
+	invalid.Meta = meta
+	assert.NoError(t, d.NotifyAlive(invalid))
+	assert.NotContains(t, c.rejected, "invalid")
+}
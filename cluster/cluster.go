@@ -1,13 +1,20 @@
 package cluster
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	stdlog "log"
+	"net"
+	"net/netip"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/discovery"
 	"github.com/hashicorp/memberlist"
 	"github.com/mattn/go-isatty"
 	"github.com/sirupsen/logrus"
@@ -16,38 +23,134 @@ import (
 // KeyLen is the fixed length of cluster keys, must be checked by callers
 const KeyLen = 32
 
+// seedQueryTimeout limits how long we wait for seed providers on each join attempt
+const seedQueryTimeout = 10 * time.Second
+
 // Cluster represents a running cluster configuration
 type Cluster struct {
-	name      string
+	statePath string
+	log       logrus.FieldLogger
 	ml        *memberlist.Memberlist
 	mlConfig  *memberlist.Config
 	localNode *common.Node
 	LocalName string
 	state     *state
-	events    chan memberlist.NodeEvent
+	// pending holds the latest memberlist event of each node, not yet reconciled; it is guarded by pendingMu instead of
+	// mu, so memberlist is never blocked by slower operations
+	pendingMu     sync.Mutex
+	pending       map[string]memberlist.NodeEvent
+	pendingSignal chan struct{}
+	debounce      time.Duration
+	// mu guards changes to the local node after it has been handed to memberlist, as well as state shared with
+	// background tasks
+	mu            sync.Mutex
+	advertiseAddr netip.Addr
+	seeds         discovery.Provider
+	lost          map[string]lostNode
+	partitioned   bool
+	rejected      map[string]string
+	// configuredNAT is set if the local node was explicitly configured as being behind NAT, disabling its detection
+	configuredNAT     bool
+	endpointReports   map[string]endpointReport
+	endpointCandidate endpointReport
+	broadcasts        *memberlist.TransmitLimitedQueue
+	onReject          func(common.Node, error)
+	onBanned          func(Revocation)
+	compactMeta       bool
+	banKeys           []BanKey
+	stateMaxAge       time.Duration
+	healInterval      time.Duration
+	healTimeout       time.Duration
+	healStarted       sync.Once
+	stopHealing       context.CancelFunc
+}
+
+// Config holds the settings used to create a Cluster.
+type Config struct {
+	// Name identifies the cluster locally, e.g. for persisting its state.
+	Name string
+	// StateDir is the directory in which the state is persisted; defaults to DefaultStateDir.
+	StateDir string
+	// Init forgets any known state from previous runs.
+	Init bool
+	// ClusterKey is the shared key for cluster membership; if empty, it is loaded from the state or generated.
+	ClusterKey []byte
+	// BindAddr and BindPort are used to listen for membership gossip traffic.
+	BindAddr string
+	BindPort int
+	// AdvertiseAddr and AdvertisePort are announced to other nodes, if they differ from BindAddr and BindPort (e.g.
+	// behind port-forwarding).
+	AdvertiseAddr string
+	AdvertisePort int
+	// HealInterval is the interval between attempts to re-join missing nodes; healing is disabled if zero.
+	HealInterval time.Duration
+	// HealTimeout is the time after which failed nodes are forgotten; defaults to DefaultHealTimeout.
+	HealTimeout time.Duration
+	// StateMaxAge is the time after which nodes no longer seen are removed from the persisted state; they are kept
+	// indefinitely if zero.
+	StateMaxAge time.Duration
+	// OnReject is called for nodes not admitted to the cluster, once per node and reason.
+	OnReject func(node common.Node, reason error)
+	// CompactMeta gossips the local node metadata in the compact encoding, which leaves more room for labels but cannot
+	// be decoded by older versions.
+	CompactMeta bool
+	// BanKeys are the public keys trusted to sign revocations; revocations are ignored if empty.
+	BanKeys []BanKey
+	// OnBanned is called when a revocation banning the local node is received; the node should then leave the cluster.
+	OnBanned func(rev Revocation)
+	// Logger is used for cluster events; defaults to the standard logrus logger.
+	Logger logrus.FieldLogger
+	// MemberlistLogger is used for the output of the underlying memberlist library; defaults to Logger.
+	MemberlistLogger logrus.FieldLogger
+	// EventDebounce is the time to wait for further membership events before reconciling them; defaults to
+	// DefaultEventDebounce.
+	EventDebounce time.Duration
+	// NodeName is the name of the local node; defaults to the hostname.
+	NodeName string
+	// UseIPAsName uses the bind address as node name instead of the hostname; only intended for local testing.
+	UseIPAsName bool
 }
 
 // New is used to create a new Cluster instance
 // The returned instance is ready to be updated with the local node settings then joined
-func New(name string, init bool, clusterKey []byte, bindAddr string, bindPort int, useIPAsName bool) (*Cluster, error) {
+func New(config Config) (*Cluster, error) {
+	log := config.Logger
+	if log == nil {
+		log = logrus.StandardLogger()
+	}
+	mlLog := config.MemberlistLogger
+	if mlLog == nil {
+		mlLog = log
+	}
+
+	statePath := statePath(config.StateDir, config.Name)
 	state := &state{}
-	if !init {
-		loadState(state, name)
+	if !config.Init {
+		if err := loadState(state, statePath, log); err != nil {
+			return nil, fmt.Errorf("loading state: %w", err)
+		}
 	}
 
-	clusterKey, err := computeClusterKey(state, clusterKey)
+	clusterKey, err := computeClusterKey(state, config.ClusterKey)
 	if err != nil {
 		return nil, fmt.Errorf("computing cluster key: %w", err)
 	}
 
 	mlConfig := memberlist.DefaultWANConfig()
-	mlConfig.LogOutput = logrus.StandardLogger().WriterLevel(logrus.DebugLevel)
+	mlConfig.Logger = stdlog.New(memberlistLogWriter{mlLog}, "", 0)
 	mlConfig.SecretKey = clusterKey
-	mlConfig.BindAddr = bindAddr
-	mlConfig.BindPort = bindPort
-	mlConfig.AdvertisePort = bindPort
-	if useIPAsName && bindAddr != "0.0.0.0" {
-		mlConfig.Name = bindAddr
+	mlConfig.BindAddr = config.BindAddr
+	mlConfig.BindPort = config.BindPort
+	mlConfig.AdvertiseAddr = config.AdvertiseAddr
+	mlConfig.AdvertisePort = config.BindPort
+	if config.AdvertisePort != 0 {
+		mlConfig.AdvertisePort = config.AdvertisePort
+	}
+	if config.NodeName != "" {
+		mlConfig.Name = config.NodeName
+	}
+	if config.UseIPAsName && config.BindAddr != "0.0.0.0" {
+		mlConfig.Name = config.BindAddr
 	}
 
 	ml, err := memberlist.Create(mlConfig)
@@ -56,34 +159,90 @@ func New(name string, init bool, clusterKey []byte, bindAddr string, bindPort in
 	}
 
 	cluster := Cluster{
-		name:      name,
+		statePath: statePath,
+		log:       log,
 		ml:        ml,
 		mlConfig:  mlConfig,
 		LocalName: ml.LocalNode().Name,
-		// The big channel buffer is a work-around for https://github.com/hashicorp/memberlist/issues/23
-		// More than this many simultaneous events will deadlock cluster.members()
-		events: make(chan memberlist.NodeEvent, 100),
-		state:  state,
+		state:     state,
+
+		pending:       make(map[string]memberlist.NodeEvent),
+		pendingSignal: make(chan struct{}, 1),
+		debounce:      config.EventDebounce,
+
+		onReject:     config.OnReject,
+		onBanned:     config.OnBanned,
+		compactMeta:  config.CompactMeta,
+		banKeys:      config.BanKeys,
+		stateMaxAge:  config.StateMaxAge,
+		healInterval: config.HealInterval,
+		healTimeout:  config.HealTimeout,
+		stopHealing:  func() {},
+	}
+	cluster.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       ml.NumMembers,
+		RetransmitMult: mlConfig.RetransmitMult,
+	}
+	if cluster.debounce == 0 {
+		cluster.debounce = DefaultEventDebounce
+	}
+	if cluster.healTimeout == 0 {
+		cluster.healTimeout = DefaultHealTimeout
 	}
+	if addr, ok := netip.AddrFromSlice(ml.LocalNode().Addr); ok {
+		cluster.advertiseAddr = addr.Unmap()
+	}
+	cluster.loadRevocations(time.Now())
 
 	return &cluster, nil
 }
 
+// loadRevocations drops the persisted revocations which are expired or no longer signed by a trusted ban key, and
+// schedules the re-evaluation of the members once the remaining bans expire.
+func (c *Cluster) loadRevocations(now time.Time) {
+	revs := make([]Revocation, 0, len(c.state.Revocations))
+	for _, rev := range c.state.Revocations {
+		if err := rev.verify(c.banKeys); err != nil {
+			c.log.WithError(err).Info("forgetting revocation")
+			continue
+		}
+		if !rev.Expires.IsZero() && rev.Active(now) {
+			time.AfterFunc(time.Until(rev.Expires), c.signalPending)
+		}
+		revs = append(revs, rev)
+	}
+	c.state.Revocations = revs
+	c.state.pruneRevocations(now)
+}
+
 // Name provides the current cluster name
 func (c *Cluster) Name() string {
 	return c.localNode.Name
 }
 
-// Join tries to join the cluster by contacting provided addresses
-// Provided addresses are passed as is, if no address is provided, known
+// Join tries to join the cluster by contacting addresses from the provided seeds
+// Addresses are passed as is, if no address is provided, known
 // cluster nodes are contacted instead.
 // Joining fail if none of the provided addresses or none of the known
 // nodes can be joined.
-func (c *Cluster) Join(addrs []string) error {
+// Seeds are re-queried on every call, so Join can simply be retried.
+// Once joined, missing nodes are periodically re-joined - and as soon as watchable seeds change - if healing is
+// enabled.
+func (c *Cluster) Join(seeds discovery.Provider) error {
+	c.mu.Lock()
+	c.seeds = seeds
+	c.mu.Unlock()
+
+	addrs, err := c.seedAddrs()
+	if err != nil {
+		return err
+	}
 	if len(addrs) == 0 {
-		for _, n := range c.state.Nodes {
-			addrs = append(addrs, n.Addr.String())
+		c.mu.Lock()
+		for i := range c.state.Nodes {
+			addrs = append(addrs, c.state.Nodes[i].JoinAddr())
 		}
+		c.mu.Unlock()
 	}
 
 	if _, err := c.ml.Join(addrs); err != nil {
@@ -92,68 +251,115 @@ func (c *Cluster) Join(addrs []string) error {
 		return fmt.Errorf("could not join to any of the provided addresses")
 	}
 
+	if c.healInterval > 0 {
+		c.healStarted.Do(func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			c.stopHealing = cancel
+			// seeds which can be watched - e.g. seed files - are re-joined as soon as they change
+			var seedsChanged <-chan struct{}
+			if w, ok := seeds.(discovery.Watcher); ok {
+				seedsChanged = w.Watch(ctx)
+			}
+			go c.heal(ctx, seedsChanged)
+		})
+	}
+
 	return nil
 }
 
+// seedAddrs queries the seeds for addresses to join, excluding our own address.
+func (c *Cluster) seedAddrs() ([]string, error) {
+	c.mu.Lock()
+	seeds := c.seeds
+	c.mu.Unlock()
+	if seeds == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), seedQueryTimeout)
+	defer cancel()
+	addrs, err := seeds.Addrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("querying seeds: %w", err)
+	}
+
+	// dynamic seeds will usually include ourselves
+	local := c.ml.LocalNode()
+	localAddrs := map[string]struct{}{
+		local.Addr.String(): {},
+		net.JoinHostPort(local.Addr.String(), strconv.Itoa(int(local.Port))): {},
+	}
+	seedAddrs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if _, ok := localAddrs[addr]; !ok {
+			seedAddrs = append(seedAddrs, addr)
+		}
+	}
+	return seedAddrs, nil
+}
+
 // Leave saves the current state before leaving, then leaves the cluster
 func (c *Cluster) Leave() {
-	c.state.save(c.name) // nolint: errcheck // opportunistic
+	c.stopHealing()
+	c.state.save(c.statePath, c.log) // nolint: errcheck // opportunistic
 	c.ml.Leave(10 * time.Second)
 	c.ml.Shutdown() // nolint: errcheck
 }
 
+// KnownNodes returns the nodes known from the last run or seen since, including the ones which are not currently
+// members but have not yet expired.
+// This can be used to configure peers before the cluster is joined.
+func (c *Cluster) KnownNodes() []common.Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := make([]common.Node, 0, len(c.state.Nodes))
+	for _, n := range c.state.Nodes {
+		if c.stateMaxAge > 0 && time.Since(n.LastSeen) > c.stateMaxAge {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// NumMembers returns the number of current cluster members, excluding the local node.
+func (c *Cluster) NumMembers() int {
+	return c.ml.NumMembers() - 1
+}
+
+// ClusterKey returns the shared key for cluster membership, as provided, loaded from the state or generated.
+func (c *Cluster) ClusterKey() []byte {
+	return append([]byte(nil), c.mlConfig.SecretKey...)
+}
+
+// WireguardKey returns the wireguard private key persisted from the last run, if any.
+func (c *Cluster) WireguardKey() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.WireguardKey
+}
+
+// SetWireguardKey persists the local wireguard private key, to be reused on the next run.
+func (c *Cluster) SetWireguardKey(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.WireguardKey = key
+}
+
 // Update gossips the local node configuration, propagating any change
 func (c *Cluster) Update(localNode *common.Node) {
+	localNode.Incarnation = uint64(time.Now().UnixNano())
 	c.localNode = localNode
+	c.configuredNAT = localNode.BehindNAT
 	// wrap in a delegateNode instance for memberlist.Delegate implementation
-	delegate := &delegateNode{c.localNode}
+	delegate := &delegateNode{c.localNode, c}
 	c.mlConfig.Conflict = delegate
 	c.mlConfig.Delegate = delegate
-	c.mlConfig.Events = &memberlist.ChannelEventDelegate{Ch: c.events}
+	c.mlConfig.Alive = delegate
+	c.mlConfig.Events = delegate
 	c.ml.UpdateNode(1 * time.Second) // nolint: errcheck // we currently do not update after creation
 }
 
-// Members provides a channel notifying of cluster changes
-// Everytime a change happens inside the cluster (except for local changes),
-// the updated list of cluster nodes is pushed to the channel.
-func (c *Cluster) Members() <-chan []common.Node {
-	changes := make(chan []common.Node)
-
-	go func() {
-		for event := range c.events {
-			if event.Node.Name == c.LocalName {
-				// ignore events about ourselves
-				continue
-			}
-			switch event.Event {
-			case memberlist.NodeJoin:
-				logrus.Infof("node %s joined", event.Node)
-			case memberlist.NodeUpdate:
-				logrus.Infof("node %s updated", event.Node)
-			case memberlist.NodeLeave:
-				logrus.Infof("node %s left", event.Node)
-			}
-
-			nodes := make([]common.Node, 0, c.ml.NumMembers())
-			for _, n := range c.ml.Members() {
-				if n.Name == c.LocalName {
-					continue
-				}
-				nodes = append(nodes, common.Node{
-					Name: n.Name,
-					Addr: n.Addr,
-					Meta: n.Meta,
-				})
-			}
-			c.state.Nodes = nodes
-			changes <- nodes
-			c.state.save(c.name) // nolint: errcheck // opportunistic
-		}
-	}()
-
-	return changes
-}
-
 func computeClusterKey(state *state, clusterKey []byte) ([]byte, error) {
 	if len(clusterKey) == 0 {
 		clusterKey = state.ClusterKey
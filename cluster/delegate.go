@@ -1,30 +1,39 @@
 package cluster
 
 import (
+	"encoding/json"
+
 	"github.com/costela/wesher/common"
 	"github.com/hashicorp/memberlist"
-	"github.com/sirupsen/logrus"
 )
 
 // DelegateNode implements the memberlist.Delegate interface.
 type delegateNode struct {
 	*common.Node
+	cluster *Cluster
 }
 
 var _ memberlist.Delegate = (*delegateNode)(nil)
 
 // NotifyConflict implements the memberlist.Delegate interface.
 func (n *delegateNode) NotifyConflict(node, other *memberlist.Node) {
-	logrus.Errorf("node name conflict detected: %s", other.Name)
+	n.cluster.log.WithField("node", other.Name).WithField("addr", other.Addr.String()).Error("node name conflict detected")
 }
 
 // NodeMeta implements the memberlist.Delegate interface.
 // Metadata is provided by the local node settings, encoding is handled
-// by the node implementation directly
+// by the node implementation directly; the compact encoding is only used if enabled, since older versions cannot
+// decode it.
 func (n *delegateNode) NodeMeta(limit int) []byte {
-	encoded, err := n.EncodeMeta(limit)
+	n.cluster.mu.Lock()
+	defer n.cluster.mu.Unlock()
+	encode := n.EncodeMeta
+	if n.cluster.compactMeta {
+		encode = n.EncodeCompactMeta
+	}
+	encoded, err := encode(limit)
 	if err != nil {
-		logrus.Errorf("failed to encode local node: %s", err)
+		n.cluster.log.WithError(err).Error("failed to encode local node")
 		return nil
 	}
 
@@ -32,13 +41,36 @@ func (n *delegateNode) NodeMeta(limit int) []byte {
 }
 
 // NotifyMsg implements the memberlist.Delegate interface
-func (n *delegateNode) NotifyMsg([]byte) {}
+func (n *delegateNode) NotifyMsg(msg []byte) {
+	if err := n.cluster.handleMessage(msg); err != nil {
+		n.cluster.log.WithError(err).Warn("could not handle message")
+	}
+}
 
-// GetBroadcasts implements the memberlist.Delegate interface
-func (n *delegateNode) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+// GetBroadcasts implements the memberlist.Delegate interface.
+// Broadcasts are queued messages gossiped to all nodes, e.g. revocations.
+func (n *delegateNode) GetBroadcasts(overhead, limit int) [][]byte {
+	return n.cluster.broadcasts.GetBroadcasts(overhead, limit)
+}
 
-// LocalState implements the memberlist.Delegate interface
-func (n *delegateNode) LocalState(join bool) []byte { return nil }
+// LocalState implements the memberlist.Delegate interface.
+// The revocations are exchanged on every push/pull sync, so nodes missing their broadcast - e.g. while offline or not
+// yet joined - still learn about them.
+func (n *delegateNode) LocalState(join bool) []byte {
+	payload, err := json.Marshal(n.cluster.Revocations())
+	if err != nil {
+		n.cluster.log.WithError(err).Error("failed to encode revocations")
+		return nil
+	}
+	return payload
+}
 
-// MergeRemoteState implements the memberlist.Delegate interface
-func (n *delegateNode) MergeRemoteState(buf []byte, join bool) {}
+// MergeRemoteState implements the memberlist.Delegate interface.
+func (n *delegateNode) MergeRemoteState(buf []byte, join bool) {
+	if len(buf) == 0 {
+		return
+	}
+	if err := n.cluster.mergeRevocations(buf); err != nil {
+		n.cluster.log.WithError(err).Warn("could not merge remote state")
+	}
+}
@@ -0,0 +1,36 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/netip"
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_delegateNode_NodeMeta(t *testing.T) {
+	local := &common.Node{Name: "local"}
+	local.OverlayAddr = netip.MustParseAddr("10.0.0.1")
+	local.Labels = map[string]string{"role": "db"}
+	c := &Cluster{log: logrus.StandardLogger()}
+	d := &delegateNode{local, c}
+
+	// older versions only decode gob, so it is gossiped unless the compact encoding is enabled
+	meta := d.NodeMeta(memberlist.MetaMaxSize)
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(meta)).Decode(&struct{}{}))
+	decoded := common.Node{Meta: meta}
+	require.NoError(t, decoded.DecodeMeta())
+	assert.Equal(t, local.Labels, decoded.Labels)
+
+	c.compactMeta = true
+	compact := d.NodeMeta(memberlist.MetaMaxSize)
+	assert.Less(t, len(compact), len(meta))
+	decoded = common.Node{Meta: compact}
+	require.NoError(t, decoded.DecodeMeta())
+	assert.Equal(t, local.Labels, decoded.Labels)
+}
@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+)
+
+// DefaultEventDebounce is the default time to wait for further membership events before reconciling them.
+const DefaultEventDebounce = 200 * time.Millisecond
+
+// maxDebounceFactor limits how long reconciliation may be postponed by a continuous stream of events, as a multiple of
+// the debounce time.
+const maxDebounceFactor = 10
+
+var _ memberlist.EventDelegate = (*delegateNode)(nil)
+
+// NotifyJoin implements the memberlist.EventDelegate interface.
+func (n *delegateNode) NotifyJoin(node *memberlist.Node) {
+	n.cluster.queueEvent(memberlist.NodeJoin, node)
+}
+
+// NotifyLeave implements the memberlist.EventDelegate interface.
+func (n *delegateNode) NotifyLeave(node *memberlist.Node) {
+	n.cluster.queueEvent(memberlist.NodeLeave, node)
+}
+
+// NotifyUpdate implements the memberlist.EventDelegate interface.
+func (n *delegateNode) NotifyUpdate(node *memberlist.Node) {
+	n.cluster.queueEvent(memberlist.NodeUpdate, node)
+}
+
+// queueEvent records an event for the next reconciliation.
+// It is called from memberlist's goroutines and must therefore never block; events are coalesced per node, so the
+// pending events are bounded by the cluster size.
+func (c *Cluster) queueEvent(t memberlist.NodeEventType, node *memberlist.Node) {
+	if node.Name == c.LocalName {
+		// ignore events about ourselves
+		return
+	}
+	nodeCopy := *node // memberlist may change the node after we return
+	c.pendingMu.Lock()
+	c.pending[node.Name] = memberlist.NodeEvent{Event: t, Node: &nodeCopy}
+	c.pendingMu.Unlock()
+
+	c.signalPending()
+}
+
+// signalPending triggers a reconciliation, unless one is already pending.
+func (c *Cluster) signalPending() {
+	select {
+	case c.pendingSignal <- struct{}{}:
+	default:
+		// a reconciliation is already pending
+	}
+}
+
+// takePending returns and clears the pending events.
+func (c *Cluster) takePending() map[string]memberlist.NodeEvent {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	events := c.pending
+	c.pending = make(map[string]memberlist.NodeEvent, len(events))
+	return events
+}
+
+// Members provides a channel notifying of cluster changes
+// Everytime changes happen inside the cluster (except for local changes),
+// the updated list of cluster nodes is pushed to the channel.
+// Bursts of changes are coalesced into a single update, sent once no further change happened for the debounce time.
+func (c *Cluster) Members() <-chan []common.Node {
+	changes := make(chan []common.Node)
+
+	go func() {
+		for range c.pendingSignal {
+			c.waitForQuiet()
+			changes <- c.reconcile(c.takePending())
+		}
+	}()
+
+	return changes
+}
+
+// waitForQuiet waits until no event was queued for the debounce time, but at most maxDebounceFactor times as long.
+func (c *Cluster) waitForQuiet() {
+	timer := time.NewTimer(c.debounce)
+	defer timer.Stop()
+	deadline := time.NewTimer(maxDebounceFactor * c.debounce)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-c.pendingSignal:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(c.debounce)
+		case <-timer.C:
+			return
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+// reconcile processes the provided events and persists the resulting state, returning the current members.
+func (c *Cluster) reconcile(events map[string]memberlist.NodeEvent) []common.Node {
+	forget := make([]string, 0)
+	for _, event := range events {
+		c.trackLost(event)
+		eventNode := common.Node{Name: event.Node.Name, Addr: event.Node.Addr, Meta: event.Node.Meta}
+		eventNode.DecodeMeta() // nolint: errcheck // only used for logging
+		log := c.log.WithFields(eventNode.LogFields())
+		switch event.Event {
+		case memberlist.NodeJoin:
+			log.Info("node joined")
+		case memberlist.NodeUpdate:
+			log.Info("node updated")
+		case memberlist.NodeLeave:
+			log.Info("node left")
+			if event.Node.State == memberlist.StateLeft {
+				forget = append(forget, event.Node.Name)
+			}
+		}
+	}
+
+	members := c.ml.Members()
+	nodes := make([]common.Node, 0, len(members))
+	for _, n := range members {
+		if n.Name == c.LocalName {
+			continue
+		}
+		node := common.Node{
+			Name: n.Name,
+			Addr: n.Addr,
+			Port: n.Port,
+			Meta: n.Meta,
+		}
+		// decoded metadata is persisted, to allow configuring peers before the cluster is joined
+		if err := node.DecodeMeta(); err != nil {
+			c.log.WithError(err).WithField("node", n.Name).Debug("could not decode node metadata")
+		}
+		// banned nodes may remain members until they fail, but are no longer considered
+		if _, ok := c.Banned(&node); ok {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range forget {
+		c.state.forgetNode(name)
+	}
+	c.state.updateNodes(nodes, time.Now(), c.stateMaxAge, c.log)
+	c.state.save(c.statePath, c.log) // nolint: errcheck // opportunistic
+	return nodes
+}
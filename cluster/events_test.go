@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCluster(t *testing.T, debounce time.Duration) *Cluster {
+	t.Helper()
+	logger, _ := test.NewNullLogger()
+	c, err := New(Config{
+		Name:          "test",
+		StateDir:      t.TempDir(),
+		ClusterKey:    make([]byte, KeyLen),
+		BindAddr:      "127.0.0.1",
+		EventDebounce: debounce,
+		UseIPAsName:   true,
+		Logger:        logger,
+	})
+	require.NoError(t, err)
+	c.Update(&common.Node{})
+	t.Cleanup(func() { c.ml.Shutdown() }) // nolint: errcheck
+	return c
+}
+
+func Test_Cluster_Members_stress(t *testing.T) {
+	const nodes = 500
+	c := newTestCluster(t, 50*time.Millisecond)
+	events := c.mlConfig.Events
+
+	// simulate a burst of joins - followed by some nodes failing - from several memberlist goroutines, without anyone
+	// consuming the changes yet
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < nodes; i += 10 {
+				node := &memberlist.Node{Name: fmt.Sprintf("node%d", i), Addr: net.IPv4(192, 0, 2, byte(i)), Port: 7946}
+				events.NotifyJoin(node)
+				if i%100 == 0 {
+					node.State = memberlist.StateDead
+					events.NotifyLeave(node)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Less(t, time.Since(start), time.Second, "memberlist must never be blocked by event handling")
+
+	members := c.Members()
+	select {
+	case <-members:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconciliation after burst of events")
+	}
+
+	select {
+	case <-members:
+		t.Fatal("burst of events should be coalesced into a single reconciliation")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Len(t, c.lost, nodes/100, "failed nodes should be tracked despite coalescing")
+}
+
+func Test_Cluster_Members_continuousEvents(t *testing.T) {
+	c := newTestCluster(t, 20*time.Millisecond)
+	members := c.Members()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.mlConfig.Events.NotifyUpdate(&memberlist.Node{Name: fmt.Sprintf("node%d", i%10)})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// a continuous stream of events must not postpone reconciliation indefinitely
+	select {
+	case <-members:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconciliation starved by continuous events")
+	}
+}
+
+func Test_Cluster_queueEvent_ignoresLocal(t *testing.T) {
+	c := newTestCluster(t, time.Millisecond)
+
+	c.queueEvent(memberlist.NodeUpdate, &memberlist.Node{Name: c.LocalName})
+
+	assert.Empty(t, c.takePending())
+}
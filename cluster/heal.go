@@ -0,0 +1,195 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultHealInterval is the default interval between attempts to re-join missing nodes.
+const DefaultHealInterval = time.Minute
+
+// DefaultHealTimeout is the default time after which failed nodes are forgotten, if they could not be re-joined.
+const DefaultHealTimeout = 24 * time.Hour
+
+// partitionShare is the share of the cluster which must have failed - and could not be re-joined - for the cluster to
+// be considered partitioned; single failed nodes are more likely crashed or decommissioned than cut off.
+const partitionShare = 0.5
+
+// lookupTimeout limits how long resolving a seed address may take, when checking whether it is a member.
+const lookupTimeout = 5 * time.Second
+
+// lostNode is a node which failed - as opposed to leaving intentionally - and which we will try to re-join.
+type lostNode struct {
+	addr  string
+	since time.Time
+}
+
+// Partitioned returns whether the cluster is currently partitioned, i.e.: at least partitionShare of the nodes failed
+// without intentionally leaving and could not be re-joined.
+func (c *Cluster) Partitioned() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.partitioned
+}
+
+// trackLost keeps track of failed nodes, so they can later be re-joined.
+func (c *Cluster) trackLost(event memberlist.NodeEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lost == nil {
+		c.lost = make(map[string]lostNode)
+	}
+	switch {
+	case event.Event == memberlist.NodeLeave && event.Node.State == memberlist.StateDead:
+		addr := net.JoinHostPort(event.Node.Addr.String(), strconv.Itoa(int(event.Node.Port)))
+		c.log.WithFields(logrus.Fields{"node": event.Node.Name, "addr": addr}).Warn("node failed; will try to re-join it")
+		c.lost[event.Node.Name] = lostNode{
+			addr:  addr,
+			since: time.Now(),
+		}
+	default:
+		// either back or intentionally gone
+		delete(c.lost, event.Node.Name)
+	}
+}
+
+// heal periodically tries to re-join known nodes which are not currently members, to recover from partitions lasting
+// longer than memberlist's reaping of dead nodes. Nodes are also re-joined as soon as the seeds signal a change.
+func (c *Cluster) heal(ctx context.Context, seedsChanged <-chan struct{}) {
+	ticker := time.NewTicker(c.healInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.healOnce(ctx)
+		case <-seedsChanged:
+			c.log.Debug("seeds changed")
+			c.healOnce(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Cluster) healOnce(ctx context.Context) {
+	seedAddrs, err := c.seedAddrs()
+	if err != nil {
+		c.log.WithError(err).Warn("could not query seeds")
+	}
+	addrs := c.healCandidates(ctx, c.ml.Members(), seedAddrs)
+	if len(addrs) > 0 {
+		c.log.WithField("addrs", addrs).Debug("trying to re-join missing nodes")
+		if n, err := c.ml.Join(addrs); err != nil && n == 0 {
+			c.log.WithError(err).Debug("could not re-join missing nodes")
+		}
+	}
+	c.updatePartitioned()
+}
+
+// healCandidates returns the addresses of nodes that should be members, but currently are not: failed nodes, nodes
+// from the last known state and nodes from the seeds.
+func (c *Cluster) healCandidates(ctx context.Context, members []*memberlist.Node, seedAddrs []string) []string {
+	memberNames := make(map[string]struct{}, len(members))
+	memberAddrs := make(map[string]struct{}, len(members))
+	for _, m := range members {
+		memberNames[m.Name] = struct{}{}
+		memberAddrs[m.Addr.String()] = struct{}{}
+		memberAddrs[net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port)))] = struct{}{}
+	}
+
+	// resolve seeds before locking, since it may involve DNS queries
+	candidates := make(map[string]struct{})
+	for _, addr := range seedAddrs {
+		if !joinAddrIsMember(ctx, addr, memberAddrs) {
+			candidates[addr] = struct{}{}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, lost := range c.lost {
+		if time.Since(lost.since) > c.healTimeout {
+			c.log.WithField("node", name).Info("giving up re-joining node")
+			delete(c.lost, name)
+			continue
+		}
+		if _, ok := memberNames[name]; !ok {
+			candidates[lost.addr] = struct{}{}
+		}
+	}
+	for i := range c.state.Nodes {
+		n := &c.state.Nodes[i]
+		if _, ok := memberNames[n.Name]; !ok && n.Addr != nil {
+			candidates[n.JoinAddr()] = struct{}{}
+		}
+	}
+
+	addrs := make([]string, 0, len(candidates))
+	for addr := range candidates {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// updatePartitioned recomputes the partitioned signal, logging transitions.
+func (c *Cluster) updatePartitioned() {
+	members := make(map[string]struct{})
+	for _, m := range c.ml.Members() {
+		members[m.Name] = struct{}{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	missing := make([]string, 0)
+	for name := range c.lost {
+		if _, ok := members[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	partitioned := isPartitioned(len(missing), len(members))
+	if partitioned && !c.partitioned {
+		c.log.WithField("missing", missing).Warn("cluster partitioned; could not re-join failed nodes")
+	} else if !partitioned && c.partitioned {
+		c.log.Info("cluster partition healed")
+	}
+	c.partitioned = partitioned
+}
+
+// isPartitioned returns whether the provided number of missing nodes makes up at least partitionShare of the cluster,
+// including the current members.
+func isPartitioned(missing, members int) bool {
+	return missing > 0 && float64(missing) >= partitionShare*float64(missing+members)
+}
+
+// joinAddrIsMember returns whether the provided join address - which may be a hostname, with or without port -
+// resolves to the address of a current member.
+func joinAddrIsMember(ctx context.Context, addr string, memberAddrs map[string]struct{}) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		key := ip
+		if port != "" {
+			key = net.JoinHostPort(ip, port)
+		}
+		if _, ok := memberAddrs[key]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/discovery"
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Cluster_trackLost(t *testing.T) {
+	c := &Cluster{log: logrus.StandardLogger()}
+	node := &memberlist.Node{Name: "failed", Addr: net.ParseIP("192.0.2.1"), Port: 7946, State: memberlist.StateDead}
+
+	c.trackLost(memberlist.NodeEvent{Event: memberlist.NodeLeave, Node: node})
+	assert.Contains(t, c.lost, "failed")
+	assert.Equal(t, "192.0.2.1:7946", c.lost["failed"].addr)
+
+	c.trackLost(memberlist.NodeEvent{Event: memberlist.NodeJoin, Node: node})
+	assert.NotContains(t, c.lost, "failed", "re-joined node should no longer be lost")
+
+	left := &memberlist.Node{Name: "left", Addr: net.ParseIP("192.0.2.2"), State: memberlist.StateLeft}
+	c.trackLost(memberlist.NodeEvent{Event: memberlist.NodeLeave, Node: left})
+	assert.NotContains(t, c.lost, "left", "intentionally left node should not be re-joined")
+}
+
+func Test_Cluster_healCandidates(t *testing.T) {
+	c := &Cluster{
+		log:         logrus.StandardLogger(),
+		healTimeout: time.Hour,
+		lost: map[string]lostNode{
+			"lost":    {addr: "192.0.2.10:7946", since: time.Now()},
+			"back":    {addr: "192.0.2.11:7946", since: time.Now()},
+			"expired": {addr: "192.0.2.12:7946", since: time.Now().Add(-2 * time.Hour)},
+		},
+		state: &state{Nodes: []common.Node{
+			{Name: "known", Addr: net.ParseIP("192.0.2.20")},
+			{Name: "known-port", Addr: net.ParseIP("192.0.2.21"), Port: 7947},
+			{Name: "member", Addr: net.ParseIP("192.0.2.1")},
+		}},
+	}
+	members := []*memberlist.Node{
+		{Name: "member", Addr: net.ParseIP("192.0.2.1"), Port: 7946},
+		{Name: "other-member", Addr: net.ParseIP("192.0.2.2"), Port: 7946},
+		{Name: "back", Addr: net.ParseIP("192.0.2.11"), Port: 7946},
+	}
+
+	got := c.healCandidates(context.Background(), members, []string{"192.0.2.1", "192.0.2.2:7946", "192.0.2.3"})
+	sort.Strings(got)
+
+	assert.Equal(t, []string{"192.0.2.10:7946", "192.0.2.20", "192.0.2.21:7947", "192.0.2.3"}, got)
+	assert.NotContains(t, c.lost, "expired", "expired lost nodes should be forgotten")
+}
+
+func Test_Cluster_heal_seedsChanged(t *testing.T) {
+	seeds := filepath.Join(t.TempDir(), "seeds")
+	require.NoError(t, os.WriteFile(seeds, []byte("# no seeds yet\n"), 0o600))
+
+	c := newTestCluster(t, 0)
+	c.healInterval = time.Hour // only the seeds changing should trigger re-joining
+	t.Cleanup(c.stopHealing)
+	require.NoError(t, c.Join(&discovery.File{Path: seeds, PollInterval: 10 * time.Millisecond}))
+
+	logger, _ := test.NewNullLogger()
+	other, err := New(Config{
+		Name:       "other",
+		StateDir:   t.TempDir(),
+		ClusterKey: make([]byte, KeyLen),
+		BindAddr:   "127.0.0.1",
+		NodeName:   "other",
+		Logger:     logger,
+	})
+	require.NoError(t, err)
+	other.Update(&common.Node{})
+	t.Cleanup(func() { other.ml.Shutdown() }) // nolint: errcheck
+
+	addr := fmt.Sprintf("127.0.0.1:%d", other.ml.LocalNode().Port)
+	require.NoError(t, os.WriteFile(seeds, []byte(addr+"\n"), 0o600))
+
+	assert.Eventually(t, func() bool { return c.ml.NumMembers() == 2 }, 5*time.Second, 10*time.Millisecond,
+		"new seeds should be joined without waiting for the heal interval")
+}
+
+func Test_isPartitioned(t *testing.T) {
+	assert.False(t, isPartitioned(0, 5))
+	assert.False(t, isPartitioned(1, 5), "a single failed node should not be considered a partition")
+	assert.False(t, isPartitioned(2, 3))
+	assert.True(t, isPartitioned(3, 3))
+	assert.True(t, isPartitioned(1, 1), "losing the only peer is indistinguishable from a partition")
+}
@@ -0,0 +1,40 @@
+package cluster
+
+import (
+	"bytes"
+
+	"github.com/sirupsen/logrus"
+)
+
+// memberlistLevels maps the level prefixes used by memberlist to logrus levels.
+var memberlistLevels = []struct {
+	prefix []byte
+	level  logrus.Level
+}{
+	{[]byte("[DEBUG] "), logrus.DebugLevel},
+	{[]byte("[INFO] "), logrus.InfoLevel},
+	{[]byte("[WARN] "), logrus.WarnLevel},
+	{[]byte("[ERR] "), logrus.ErrorLevel},
+	{[]byte("[ERROR] "), logrus.ErrorLevel},
+}
+
+// memberlistLogWriter forwards memberlist's log output to logrus, preserving the level of each line.
+// Lines without a known level prefix are logged at debug level.
+type memberlistLogWriter struct {
+	log logrus.FieldLogger
+}
+
+func (w memberlistLogWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimSpace(p)
+	level := logrus.DebugLevel
+	for _, l := range memberlistLevels {
+		if bytes.HasPrefix(line, l.prefix) {
+			level = l.level
+			line = line[len(l.prefix):]
+			break
+		}
+	}
+	line = bytes.TrimPrefix(line, []byte("memberlist: "))
+	w.log.WithField("subsystem", "memberlist").Log(level, string(line))
+	return len(p), nil
+}
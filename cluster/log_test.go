@@ -0,0 +1,38 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_memberlistLogWriter(t *testing.T) {
+	tests := []struct {
+		line  string
+		level logrus.Level
+		msg   string
+	}{
+		{"[DEBUG] memberlist: Stream connection from=127.0.0.1:1234\n", logrus.DebugLevel, "Stream connection from=127.0.0.1:1234"},
+		{"[INFO] memberlist: Suspect node has failed, no acks received\n", logrus.InfoLevel, "Suspect node has failed, no acks received"},
+		{"[WARN] memberlist: Refuting a suspect message\n", logrus.WarnLevel, "Refuting a suspect message"},
+		{"[ERR] memberlist: Failed to send ping\n", logrus.ErrorLevel, "Failed to send ping"},
+		{"unprefixed\n", logrus.DebugLevel, "unprefixed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			logger.SetLevel(logrus.DebugLevel)
+
+			n, err := memberlistLogWriter{logger}.Write([]byte(tt.line))
+
+			assert.NoError(t, err)
+			assert.Equal(t, len(tt.line), n)
+			if assert.Len(t, hook.AllEntries(), 1) {
+				assert.Equal(t, tt.level, hook.LastEntry().Level)
+				assert.Equal(t, tt.msg, hook.LastEntry().Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// messageType identifies the payload of messages exchanged directly between nodes, outside of the memberlist node
+// metadata.
+type messageType byte
+
+const (
+	// messageObservedEndpoint carries the wireguard endpoint under which the sender sees the receiver.
+	messageObservedEndpoint messageType = iota + 1
+	// messageRevocations carries revocations banning nodes from the cluster, gossiped to all nodes.
+	messageRevocations
+)
+
+func encodeMessage(t messageType, payload []byte) []byte {
+	return append([]byte{byte(t)}, payload...)
+}
+
+func decodeMessage(msg []byte) (messageType, []byte, error) {
+	if len(msg) < 1 {
+		return 0, nil, fmt.Errorf("empty message")
+	}
+	return messageType(msg[0]), msg[1:], nil
+}
+
+// handleMessage processes messages received from other nodes.
+func (c *Cluster) handleMessage(msg []byte) error {
+	t, payload, err := decodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	switch t {
+	case messageObservedEndpoint:
+		observed := observedEndpoint{}
+		if err := json.Unmarshal(payload, &observed); err != nil {
+			return fmt.Errorf("decoding observed endpoint: %w", err)
+		}
+		if c.setPublicEndpoint(observed.Reporter, observed.Endpoint, time.Now()) {
+			go c.ml.UpdateNode(1 * time.Second) // nolint: errcheck // will be retried on next report
+		}
+	case messageRevocations:
+		return c.mergeRevocations(payload)
+	default:
+		return fmt.Errorf("unknown message type %d", t)
+	}
+	return nil
+}
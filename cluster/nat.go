@@ -0,0 +1,117 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	// endpointReportMaxAge is how long reports of our public endpoint are taken into account; peers report it every
+	// peer check while their tunnel to us is up.
+	endpointReportMaxAge = 2 * time.Minute
+	// endpointSettleTime is how long a majority of peers must report a new public endpoint before it replaces the
+	// current one, so peers seeing us under different addresses - e.g. over the LAN and the WAN - do not cause flapping.
+	endpointSettleTime = 2 * time.Minute
+)
+
+// observedEndpoint is the payload of messageObservedEndpoint.
+type observedEndpoint struct {
+	Reporter string         `json:"reporter"`
+	Endpoint netip.AddrPort `json:"endpoint"`
+}
+
+// endpointReport is a public endpoint, as reported by a peer or as candidate to replace the current one.
+type endpointReport struct {
+	endpoint netip.AddrPort
+	time     time.Time
+}
+
+// ReportEndpoint tells the named node under which wireguard endpoint we see it.
+// This enables nodes behind NAT to learn their public endpoint and propagate it to the rest of the cluster.
+func (c *Cluster) ReportEndpoint(name string, endpoint netip.AddrPort) error {
+	payload, err := json.Marshal(observedEndpoint{Reporter: c.LocalName, Endpoint: endpoint})
+	if err != nil {
+		return fmt.Errorf("encoding endpoint: %w", err)
+	}
+	for _, n := range c.ml.Members() {
+		if n.Name == name {
+			return c.ml.SendBestEffort(n, encodeMessage(messageObservedEndpoint, payload))
+		}
+	}
+	return fmt.Errorf("unknown node %s", name)
+}
+
+// BehindNAT returns whether the local node was flagged - or detected - as being behind NAT.
+func (c *Cluster) BehindNAT() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.localNode.BehindNAT
+}
+
+// setPublicEndpoint records the public endpoint reported by a peer, returning whether the local node metadata changed
+// and should be propagated.
+// The public endpoint is only set to the endpoint reported by a majority of the peers, and only changed once the
+// majority has agreed for endpointSettleTime. Unless configured explicitly, we are assumed to be behind NAT as long as
+// the public endpoint differs from the address we advertise.
+func (c *Cluster) setPublicEndpoint(reporter string, endpoint netip.AddrPort, now time.Time) bool {
+	endpoint = netip.AddrPortFrom(endpoint.Addr().Unmap(), endpoint.Port())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.localNode == nil {
+		return false
+	}
+	if c.endpointReports == nil {
+		c.endpointReports = make(map[string]endpointReport)
+	}
+	c.endpointReports[reporter] = endpointReport{endpoint: endpoint, time: now}
+
+	majority, ok := c.majorityEndpoint(now)
+	if !ok || majority == c.localNode.PublicEndpoint {
+		c.endpointCandidate = endpointReport{}
+		return false
+	}
+	if c.localNode.PublicEndpoint.IsValid() {
+		if c.endpointCandidate.endpoint != majority {
+			c.endpointCandidate = endpointReport{endpoint: majority, time: now}
+			return false
+		}
+		if now.Sub(c.endpointCandidate.time) < endpointSettleTime {
+			return false
+		}
+	}
+	c.endpointCandidate = endpointReport{}
+
+	c.log.WithField("endpoint", majority.String()).Info("public endpoint reported by peers")
+	c.localNode.PublicEndpoint = majority
+	c.localNode.Incarnation++
+	behindNAT := c.configuredNAT || majority.Addr() != c.advertiseAddr
+	if behindNAT != c.localNode.BehindNAT {
+		c.log.WithField("advertise_addr", c.advertiseAddr.String()).WithField("behind_nat", behindNAT).Info("public endpoint changed NAT detection")
+		c.localNode.BehindNAT = behindNAT
+	}
+	return true
+}
+
+// majorityEndpoint returns the public endpoint reported by more than half of the peers recently reporting one.
+func (c *Cluster) majorityEndpoint(now time.Time) (netip.AddrPort, bool) {
+	counts := make(map[netip.AddrPort]int)
+	total := 0
+	for reporter, report := range c.endpointReports {
+		if now.Sub(report.time) > endpointReportMaxAge {
+			delete(c.endpointReports, reporter)
+			continue
+		}
+		counts[report.endpoint]++
+		total++
+	}
+	for endpoint, count := range counts {
+		if count*2 > total {
+			return endpoint, true
+		}
+	}
+	return netip.AddrPort{}, false
+}
@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Cluster_setPublicEndpoint(t *testing.T) {
+	c := &Cluster{
+		log:           logrus.StandardLogger(),
+		localNode:     &common.Node{},
+		advertiseAddr: netip.MustParseAddr("192.0.2.1"),
+	}
+	now := time.Now()
+	direct := netip.MustParseAddrPort("192.0.2.1:51820")
+	public := netip.MustParseAddrPort("198.51.100.7:1234")
+
+	assert.True(t, c.setPublicEndpoint("a", direct, now), "first majority endpoint should be adopted right away")
+	assert.False(t, c.BehindNAT(), "same address as advertised should not be considered NAT")
+	assert.False(t, c.setPublicEndpoint("a", direct, now), "unchanged endpoint should not trigger update")
+
+	assert.False(t, c.setPublicEndpoint("b", netip.MustParseAddrPort("[::ffff:198.51.100.7]:1234"), now), "split view should not trigger update")
+	assert.False(t, c.setPublicEndpoint("c", public, now), "new majority should wait to settle")
+	assert.False(t, c.setPublicEndpoint("c", public, now.Add(endpointSettleTime/2)))
+	assert.Equal(t, direct, c.localNode.PublicEndpoint)
+
+	assert.True(t, c.setPublicEndpoint("c", public, now.Add(endpointSettleTime)))
+	assert.True(t, c.BehindNAT())
+	assert.Equal(t, public, c.localNode.PublicEndpoint)
+
+	// reports of "b" and "c" expire, so "a" alone is the majority again
+	later := now.Add(endpointSettleTime + endpointReportMaxAge + time.Second)
+	assert.False(t, c.setPublicEndpoint("a", direct, later))
+	assert.True(t, c.setPublicEndpoint("a", direct, later.Add(endpointSettleTime)))
+	assert.False(t, c.BehindNAT(), "NAT detection should be cleared once seen under the advertised address again")
+}
+
+func Test_Cluster_setPublicEndpoint_configuredNAT(t *testing.T) {
+	localNode := &common.Node{}
+	localNode.BehindNAT = true
+	c := &Cluster{
+		log:           logrus.StandardLogger(),
+		localNode:     localNode,
+		advertiseAddr: netip.MustParseAddr("192.0.2.1"),
+		configuredNAT: true,
+	}
+
+	assert.True(t, c.setPublicEndpoint("a", netip.MustParseAddrPort("192.0.2.1:51820"), time.Now()))
+	assert.True(t, c.BehindNAT(), "explicitly configured NAT should not be cleared")
+}
+
+func Test_message_encode_decode(t *testing.T) {
+	msg := encodeMessage(messageObservedEndpoint, []byte("payload"))
+
+	msgType, payload, err := decodeMessage(msg)
+	require.NoError(t, err)
+	assert.Equal(t, messageObservedEndpoint, msgType)
+	assert.Equal(t, []byte("payload"), payload)
+
+	_, _, err = decodeMessage(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,289 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+)
+
+// revocationContext prefixes the signed data of revocations, so their signatures cannot be mistaken for others.
+const revocationContext = "wesher revocation v2"
+
+// BanKey is the public part of an operator key trusted to sign revocations.
+// Nodes only know the public keys, so - unlike the cluster key - a compromised node cannot issue bans.
+type BanKey ed25519.PublicKey
+
+var (
+	_ encoding.TextMarshaler   = BanKey(nil)
+	_ encoding.TextUnmarshaler = (*BanKey)(nil)
+)
+
+// MarshalText encodes the key in base64.
+func (k BanKey) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString(k)), nil
+}
+
+// UnmarshalText decodes a base64 encoded ed25519 public key.
+func (k *BanKey) UnmarshalText(in []byte) error {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(in)))
+	if err != nil {
+		return fmt.Errorf("decoding ban key: %w", err)
+	}
+	if len(decoded) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid ban key length %d; expected %d", len(decoded), ed25519.PublicKeySize)
+	}
+	*k = decoded
+	return nil
+}
+
+func (k BanKey) String() string {
+	return base64.StdEncoding.EncodeToString(k)
+}
+
+// GenerateBanKey returns a new private key for signing revocations.
+func GenerateBanKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating ban key: %w", err)
+	}
+	return key, nil
+}
+
+// EncodeBanKey encodes a private key for signing revocations, as read by LoadBanKey.
+func EncodeBanKey(key ed25519.PrivateKey) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(key.Seed()) + "\n")
+}
+
+// LoadBanKey reads a private key for signing revocations from the provided file.
+func LoadBanKey(path string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading ban key: %w", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid ban key in %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Revocation bans a node - by name, wireguard public key or cluster address - from the cluster, or lifts an earlier
+// ban. Revocations are gossiped to all nodes and persisted, so banned nodes are refused even after restarts; the latest
+// revocation of each target replaces earlier ones.
+type Revocation struct {
+	// Target is the name, wireguard public key or cluster address of the banned node.
+	Target string `json:"target"`
+	// Time is when the revocation was issued.
+	Time time.Time `json:"time"`
+	// Expires is when the ban ends by itself; bans without expiry last until lifted.
+	Expires time.Time `json:"expires"`
+	// Lifted marks revocations lifting earlier bans of the target.
+	Lifted bool `json:"lifted,omitempty"`
+	// Issuer is the public key of the ban key the revocation is signed with.
+	Issuer    BanKey `json:"issuer"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign returns the revocation signed with the provided ban key.
+func (r Revocation) Sign(key ed25519.PrivateKey) Revocation {
+	r.Issuer = BanKey(key.Public().(ed25519.PublicKey))
+	r.Signature = ed25519.Sign(key, r.signedData())
+	return r
+}
+
+func (r Revocation) signedData() []byte {
+	buf := bytes.NewBufferString(revocationContext)
+	for _, field := range [][]byte{[]byte(r.Target), r.Issuer} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field))) // nolint: errcheck // buffers do not fail
+		buf.Write(field)
+	}
+	expires := int64(0)
+	if !r.Expires.IsZero() {
+		expires = r.Expires.UnixNano()
+	}
+	binary.Write(buf, binary.BigEndian, r.Time.UnixNano()) // nolint: errcheck
+	binary.Write(buf, binary.BigEndian, expires)           // nolint: errcheck
+	binary.Write(buf, binary.BigEndian, r.Lifted)          // nolint: errcheck
+	return buf.Bytes()
+}
+
+// verify checks the revocation is signed by one of the trusted ban keys.
+func (r Revocation) verify(trusted []BanKey) error {
+	for _, key := range trusted {
+		if !bytes.Equal(key, r.Issuer) {
+			continue
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key), r.signedData(), r.Signature) {
+			return fmt.Errorf("invalid signature on revocation of %s", r.Target)
+		}
+		return nil
+	}
+	return fmt.Errorf("revocation of %s signed by untrusted key %s", r.Target, r.Issuer)
+}
+
+// Active returns whether the revocation currently bans its target.
+func (r Revocation) Active(now time.Time) bool {
+	return !r.Lifted && (r.Expires.IsZero() || now.Before(r.Expires))
+}
+
+// Matches returns whether the revocation targets the provided node.
+func (r Revocation) Matches(node *common.Node) bool {
+	return r.Target == node.Name ||
+		(node.PubKey != "" && r.Target == node.PubKey) ||
+		(node.Addr != nil && r.Target == node.Addr.String())
+}
+
+// Revoke records revocations issued by an operator, and gossips them to all nodes. It returns the revocations which
+// were applied, i.e.: not replaced by later revocations of the same targets.
+// The local node cannot be banned from itself; it is banned through other nodes instead.
+func (c *Cluster) Revoke(revs []Revocation) ([]Revocation, error) {
+	c.mu.Lock()
+	local := c.localNode
+	c.mu.Unlock()
+	for _, rev := range revs {
+		if err := rev.verify(c.banKeys); err != nil {
+			return nil, err
+		}
+		if !rev.Lifted && (rev.Target == c.LocalName || (local != nil && rev.Matches(local))) {
+			return nil, fmt.Errorf("cannot ban the local node")
+		}
+	}
+	added := c.addRevocations(revs, time.Now())
+	if len(added) == 0 {
+		return nil, fmt.Errorf("revocations already applied or replaced by later ones")
+	}
+	return added, nil
+}
+
+// Revocations returns the revocations known to the local node, including lifted and expired bans.
+func (c *Cluster) Revocations() []Revocation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Revocation(nil), c.state.Revocations...)
+}
+
+// Banned returns the revocation currently banning the provided node, if any.
+func (c *Cluster) Banned(node *common.Node) (Revocation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, rev := range c.state.Revocations {
+		if rev.Active(now) && rev.Matches(node) {
+			return rev, true
+		}
+	}
+	return Revocation{}, false
+}
+
+// addRevocations records the provided - already verified - revocations, replacing earlier revocations of the same
+// targets, and returns the ones which were applied.
+// Applied revocations are persisted and gossiped further, and the cluster members are re-evaluated.
+func (c *Cluster) addRevocations(revs []Revocation, now time.Time) []Revocation {
+	c.mu.Lock()
+	added := make([]Revocation, 0)
+	for _, rev := range revs {
+		if !rev.Lifted && !rev.Active(now) {
+			continue // expired
+		}
+		i := c.state.revocation(rev.Target)
+		if i >= 0 && !rev.Time.After(c.state.Revocations[i].Time) {
+			continue
+		}
+		if i >= 0 {
+			c.state.Revocations[i] = rev
+		} else {
+			c.state.Revocations = append(c.state.Revocations, rev)
+		}
+		if rev.Active(now) {
+			c.state.forgetBanned(rev)
+		}
+		added = append(added, rev)
+	}
+	c.state.pruneRevocations(now)
+	if len(added) > 0 {
+		c.state.save(c.statePath, c.log) // nolint: errcheck // opportunistic
+	}
+	local := c.localNode
+	c.mu.Unlock()
+
+	for _, rev := range added {
+		log := c.log.WithField("target", rev.Target).WithField("issuer", rev.Issuer.String())
+		switch {
+		case rev.Lifted:
+			log.Warn("node ban lifted")
+		case local != nil && rev.Matches(local):
+			log.Error("local node banned from cluster")
+			if c.onBanned != nil {
+				c.onBanned(rev)
+			}
+		default:
+			log.WithField("expires", rev.Expires).Warn("node banned from cluster")
+		}
+		if !rev.Expires.IsZero() {
+			// re-evaluate the members once the ban ends
+			time.AfterFunc(time.Until(rev.Expires), c.signalPending)
+		}
+		if c.broadcasts != nil {
+			c.broadcasts.QueueBroadcast(revocationBroadcast{rev})
+		}
+	}
+	if len(added) > 0 {
+		c.signalPending()
+	}
+	return added
+}
+
+// mergeRevocations verifies and records revocations received from other nodes.
+func (c *Cluster) mergeRevocations(payload []byte) error {
+	revs := []Revocation{}
+	if err := json.Unmarshal(payload, &revs); err != nil {
+		return fmt.Errorf("decoding revocations: %w", err)
+	}
+	valid := make([]Revocation, 0, len(revs))
+	for _, rev := range revs {
+		if err := rev.verify(c.banKeys); err != nil {
+			c.log.WithError(err).Debug("ignoring revocation")
+			continue
+		}
+		valid = append(valid, rev)
+	}
+	c.addRevocations(valid, time.Now())
+	return nil
+}
+
+// revocationBroadcast gossips a single revocation.
+type revocationBroadcast struct {
+	rev Revocation
+}
+
+var _ memberlist.NamedBroadcast = revocationBroadcast{}
+
+// Invalidates implements the memberlist.Broadcast interface.
+func (b revocationBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+// Name implements the memberlist.NamedBroadcast interface; revocations of the same target replace each other.
+func (b revocationBroadcast) Name() string {
+	return "revocation:" + b.rev.Target
+}
+
+// Message implements the memberlist.Broadcast interface.
+func (b revocationBroadcast) Message() []byte {
+	payload, _ := json.Marshal([]Revocation{b.rev}) // nolint: errcheck // plain struct
+	return encodeMessage(messageRevocations, payload)
+}
+
+// Finished implements the memberlist.Broadcast interface.
+func (b revocationBroadcast) Finished() {}
@@ -0,0 +1,235 @@
+package cluster
+
+import (
+	"crypto/ed25519"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRevocationTestCluster(t *testing.T, name string, banKeys ...BanKey) *Cluster {
+	return &Cluster{
+		statePath:     filepath.Join(t.TempDir(), "state.json"),
+		log:           logrus.StandardLogger(),
+		LocalName:     name,
+		localNode:     &common.Node{Name: name},
+		state:         &state{ClusterKey: []byte("key")},
+		banKeys:       banKeys,
+		pendingSignal: make(chan struct{}, 1),
+		broadcasts: &memberlist.TransmitLimitedQueue{
+			NumNodes:       func() int { return 3 },
+			RetransmitMult: 1,
+		},
+	}
+}
+
+func newBanKey(t *testing.T) (ed25519.PrivateKey, BanKey) {
+	key, err := GenerateBanKey()
+	require.NoError(t, err)
+	return key, BanKey(key.Public().(ed25519.PublicKey))
+}
+
+func ban(key ed25519.PrivateKey, target string) Revocation {
+	return Revocation{Target: target, Time: time.Now().UTC()}.Sign(key)
+}
+
+func Test_BanKey_encoding(t *testing.T) {
+	key, pub := newBanKey(t)
+
+	path := filepath.Join(t.TempDir(), "ban.key")
+	require.NoError(t, os.WriteFile(path, EncodeBanKey(key), 0o600))
+	loaded, err := LoadBanKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+
+	text, err := pub.MarshalText()
+	require.NoError(t, err)
+	decoded := BanKey{}
+	require.NoError(t, decoded.UnmarshalText(text))
+	assert.Equal(t, pub, decoded)
+	assert.Error(t, decoded.UnmarshalText([]byte("c2hvcnQ=")), "keys of the wrong length should be refused")
+}
+
+func Test_Revocation_verify(t *testing.T) {
+	key, pub := newBanKey(t)
+	_, other := newBanKey(t)
+	rev := ban(key, "bad")
+	assert.NoError(t, rev.verify([]BanKey{other, pub}))
+	assert.Error(t, rev.verify([]BanKey{other}), "revocations signed by untrusted keys should be refused")
+	assert.Error(t, rev.verify(nil), "revocations should be refused without trusted keys")
+
+	tampered := rev
+	tampered.Target = "good"
+	assert.Error(t, tampered.verify([]BanKey{pub}), "changing the target should invalidate the signature")
+	tampered = rev
+	tampered.Lifted = true
+	assert.Error(t, tampered.verify([]BanKey{pub}), "lifting should invalidate the signature")
+	tampered = rev
+	tampered.Expires = time.Now().Add(time.Hour)
+	assert.Error(t, tampered.verify([]BanKey{pub}), "changing the expiry should invalidate the signature")
+}
+
+func Test_Revocation_Matches(t *testing.T) {
+	node := &common.Node{Name: "bad", Addr: net.ParseIP("192.0.2.1")}
+	node.PubKey = "cHVia2V5"
+	for _, target := range []string{"bad", "cHVia2V5", "192.0.2.1"} {
+		assert.True(t, Revocation{Target: target}.Matches(node), target)
+	}
+	assert.False(t, Revocation{Target: "good"}.Matches(node))
+}
+
+func Test_Cluster_Revoke(t *testing.T) {
+	key, pub := newBanKey(t)
+	c := newRevocationTestCluster(t, "local", pub)
+	c.state.Nodes = []common.Node{{Name: "bad"}, {Name: "good"}}
+
+	_, err := c.Revoke([]Revocation{ban(key, "local")})
+	assert.Error(t, err, "the local node should not be bannable")
+	untrusted, _ := newBanKey(t)
+	_, err = c.Revoke([]Revocation{ban(untrusted, "bad")})
+	assert.Error(t, err, "untrusted revocations should be refused")
+
+	rev := ban(key, "bad")
+	added, err := c.Revoke([]Revocation{rev})
+	require.NoError(t, err)
+	assert.Equal(t, []Revocation{rev}, added)
+	_, err = c.Revoke([]Revocation{rev})
+	assert.Error(t, err, "banning twice should fail")
+
+	assert.Equal(t, []Revocation{rev}, c.Revocations())
+	assert.Equal(t, []common.Node{{Name: "good"}}, c.state.Nodes, "banned nodes should be forgotten")
+	assert.Equal(t, 1, c.broadcasts.NumQueued(), "revocations should be gossiped")
+	assert.Len(t, c.pendingSignal, 1, "members should be re-evaluated")
+
+	loaded := &state{}
+	require.NoError(t, loadState(loaded, c.statePath, c.log))
+	assert.Equal(t, []Revocation{rev}, loaded.Revocations, "revocations should be persisted")
+}
+
+func Test_Cluster_Revoke_lift(t *testing.T) {
+	key, pub := newBanKey(t)
+	c := newRevocationTestCluster(t, "local", pub)
+	node := &common.Node{Name: "bad"}
+
+	rev := ban(key, "bad")
+	_, err := c.Revoke([]Revocation{rev})
+	require.NoError(t, err)
+	_, banned := c.Banned(node)
+	assert.True(t, banned)
+
+	lift := Revocation{Target: "bad", Time: rev.Time.Add(time.Second), Lifted: true}.Sign(key)
+	_, err = c.Revoke([]Revocation{lift})
+	require.NoError(t, err)
+	_, banned = c.Banned(node)
+	assert.False(t, banned, "lifted bans should no longer apply")
+
+	c.addRevocations([]Revocation{rev}, time.Now())
+	_, banned = c.Banned(node)
+	assert.False(t, banned, "older bans should not replace the lifting")
+	assert.Equal(t, []Revocation{lift}, c.Revocations(), "the lifting should be kept")
+}
+
+func Test_Cluster_Revoke_expiry(t *testing.T) {
+	key, pub := newBanKey(t)
+	c := newRevocationTestCluster(t, "local", pub)
+	node := &common.Node{Name: "bad"}
+
+	now := time.Now()
+	rev := Revocation{Target: "bad", Time: now, Expires: now.Add(time.Hour)}.Sign(key)
+	c.addRevocations([]Revocation{rev}, now)
+	_, banned := c.Banned(node)
+	assert.True(t, banned)
+
+	expired := Revocation{Target: "gone", Time: now, Expires: now.Add(-time.Second)}.Sign(key)
+	c.addRevocations([]Revocation{expired}, now)
+	assert.Equal(t, []Revocation{rev}, c.Revocations(), "expired bans should be ignored")
+
+	c.loadRevocations(now.Add(2 * time.Hour))
+	assert.Empty(t, c.Revocations(), "expired bans should be forgotten")
+}
+
+func Test_Cluster_loadRevocations_untrusted(t *testing.T) {
+	key, pub := newBanKey(t)
+	c := newRevocationTestCluster(t, "local")
+	c.state.Revocations = []Revocation{ban(key, "bad")}
+
+	c.loadRevocations(time.Now())
+	assert.Empty(t, c.Revocations(), "bans signed by keys no longer trusted should be forgotten")
+
+	c = newRevocationTestCluster(t, "local", pub)
+	c.state.Revocations = []Revocation{ban(key, "bad")}
+	c.loadRevocations(time.Now())
+	assert.Len(t, c.Revocations(), 1)
+}
+
+func Test_Cluster_addRevocations_local(t *testing.T) {
+	key, pub := newBanKey(t)
+	c := newRevocationTestCluster(t, "local", pub)
+	banned := []Revocation{}
+	c.onBanned = func(rev Revocation) { banned = append(banned, rev) }
+
+	c.addRevocations([]Revocation{ban(key, "other")}, time.Now())
+	assert.Empty(t, banned)
+	rev := ban(key, "local")
+	c.addRevocations([]Revocation{rev}, time.Now())
+	assert.Equal(t, []Revocation{rev}, banned, "bans of the local node should be reported")
+}
+
+func Test_Cluster_admit_banned(t *testing.T) {
+	key, pub := newBanKey(t)
+	c := newRevocationTestCluster(t, "local", pub)
+	node := common.Node{Name: "bad", Addr: net.ParseIP("192.0.2.1")}
+	node.PubKey = "cHVia2V5"
+	meta, err := node.EncodeMeta(512)
+	require.NoError(t, err)
+
+	assert.NoError(t, c.admit(&common.Node{Name: "bad", Meta: meta}))
+	_, err = c.Revoke([]Revocation{ban(key, "bad")})
+	require.NoError(t, err)
+	assert.Error(t, c.admit(&common.Node{Name: "bad", Meta: meta}), "banned names should be refused")
+
+	c = newRevocationTestCluster(t, "local", pub)
+	_, err = c.Revoke([]Revocation{ban(key, "cHVia2V5")})
+	require.NoError(t, err)
+	assert.Error(t, c.admit(&common.Node{Name: "renamed", Meta: meta}), "banned public keys should be refused")
+
+	c = newRevocationTestCluster(t, "local", pub)
+	_, err = c.Revoke([]Revocation{ban(key, "192.0.2.1")})
+	require.NoError(t, err)
+	assert.Error(t, c.admit(&common.Node{Name: "renamed", Addr: net.ParseIP("192.0.2.1")}), "banned addresses should be refused")
+}
+
+func Test_Cluster_mergeRevocations(t *testing.T) {
+	key, pub := newBanKey(t)
+	issuer := newRevocationTestCluster(t, "issuer", pub)
+	_, err := issuer.Revoke([]Revocation{ban(key, "bad")})
+	require.NoError(t, err)
+	remote := (&delegateNode{issuer.localNode, issuer}).LocalState(false)
+
+	c := newRevocationTestCluster(t, "local", pub)
+	(&delegateNode{c.localNode, c}).MergeRemoteState(remote, false)
+	assert.Equal(t, issuer.Revocations(), c.Revocations())
+	assert.Equal(t, 1, c.broadcasts.NumQueued(), "new revocations should be gossiped further")
+
+	(&delegateNode{c.localNode, c}).MergeRemoteState(remote, false)
+	assert.Len(t, c.Revocations(), 1, "known revocations should be ignored")
+
+	_, otherKey := newBanKey(t)
+	other := newRevocationTestCluster(t, "other", otherKey)
+	(&delegateNode{other.localNode, other}).MergeRemoteState(remote, false)
+	assert.Empty(t, other.Revocations(), "revocations signed by untrusted keys should be ignored")
+
+	broadcasts := issuer.broadcasts.GetBroadcasts(0, 1400)
+	require.Len(t, broadcasts, 1)
+	gossiped := newRevocationTestCluster(t, "gossiped", pub)
+	require.NoError(t, gossiped.handleMessage(broadcasts[0]))
+	assert.Equal(t, issuer.Revocations(), gossiped.Revocations())
+}
@@ -3,61 +3,266 @@ package cluster
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/costela/wesher/common"
 	"github.com/sirupsen/logrus"
 )
 
+// stateVersion is the current version of the state file schema.
+// It must be increased - and a corresponding migration added - whenever the schema changes in an incompatible way.
+const stateVersion = 1
+
 // State keeps track of information needed to rejoin the cluster
 type state struct {
+	// Version is the schema version of the state; state files written before versioning was introduced have version 0
+	Version    int
 	ClusterKey []byte
-	Nodes      []common.Node
+	// WireguardKey is the local node's wireguard private key, reused across restarts so peers configured from their
+	// own state can immediately resume traffic
+	WireguardKey string `json:",omitempty"`
+	Nodes        []common.Node
+	// Revocations are the latest bans - or lifted bans - of each target; expired bans are forgotten, lifted ones are kept
+	// so nodes which missed the lifting cannot gossip the ban back
+	Revocations []Revocation `json:",omitempty"`
+}
+
+// migrations upgrade the state from the version matching their index to the next one.
+// They are applied in order when loading an older state.
+var migrations = []func(*state, logrus.FieldLogger) error{
+	// 0 -> 1: nodes only had their raw metadata persisted
+	func(s *state, log logrus.FieldLogger) error {
+		now := time.Now()
+		for i := range s.Nodes {
+			if err := s.Nodes[i].DecodeMeta(); err != nil {
+				log.WithError(err).WithField("node", s.Nodes[i].Name).Warn("could not decode metadata of known node")
+			}
+			// avoid expiring all nodes on first start
+			s.Nodes[i].LastSeen = now
+		}
+		return nil
+	},
 }
 
-var statePathTemplate = "/var/lib/wesher/%s.json"
+// DefaultStateDir is the default directory in which the state is persisted.
+const DefaultStateDir = "/var/lib/wesher"
+
+// deprecatedStateFile is the name of the state file used before 0.3, when only a single cluster was supported.
+const deprecatedStateFile = "state.json"
+
+// statePath returns the path of the state file for the provided cluster.
+func statePath(stateDir string, clusterName string) string {
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+	return filepath.Join(stateDir, clusterName+".json")
+}
 
-const deprecatedStatePath = "/var/lib/wesher/state.json"
+// backupSuffix is appended to the state path to keep the previously saved state.
+const backupSuffix = ".bak"
 
-func (s *state) save(clusterName string) error {
-	statePath := fmt.Sprintf(statePathTemplate, clusterName)
-	if err := os.MkdirAll(path.Dir(statePath), 0700); err != nil {
+// save atomically writes the state, keeping the previous one as backup.
+// The state is first written to a temporary file, which then replaces the current one, so a crash cannot leave a
+// truncated state behind.
+func (s *state) save(statePath string, log logrus.FieldLogger) error {
+	dir := filepath.Dir(statePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return err
 	}
 
+	s.Version = stateVersion
 	stateOut, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(statePath, stateOut, 0600)
+	tmp, err := os.CreateTemp(dir, filepath.Base(statePath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck // already renamed on success
+	if _, err := tmp.Write(stateOut); err != nil {
+		tmp.Close() // nolint: errcheck
+		return fmt.Errorf("writing state: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close() // nolint: errcheck
+		return fmt.Errorf("syncing state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing state: %w", err)
+	}
+
+	if err := backupState(statePath); err != nil {
+		log.WithError(err).Warn("could not backup state")
+	}
+	if err := os.Rename(tmp.Name(), statePath); err != nil {
+		return fmt.Errorf("replacing state: %w", err)
+	}
+
+	return syncDir(dir)
 }
 
-func loadState(cs *state, clusterName string) {
-	statePath := fmt.Sprintf(statePathTemplate, clusterName)
-	content, err := ioutil.ReadFile(statePath)
+// backupState keeps a copy of the current state, so it can be restored if the current one is corrupted.
+// A hard link is used, so the current state remains in place until atomically replaced.
+func backupState(statePath string) error {
+	backupPath := statePath + backupSuffix
+	if err := os.Remove(backupPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(statePath, backupPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// syncDir ensures a rename inside the directory is persisted.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing state directory: %w", err)
+	}
+	return nil
+}
+
+// loadState loads the state, falling back to the backup if the current state is corrupted.
+// A missing state is not an error, but a corrupted one is, since silently starting over would generate a new cluster
+// key.
+func loadState(cs *state, statePath string, log logrus.FieldLogger) error {
+	err := loadStateFile(cs, statePath, log)
+	if os.IsNotExist(err) {
 		// try the deprecated pre 0.3 state path, it will later
 		// be saved to the proper path
+		err = loadStateFile(cs, filepath.Join(filepath.Dir(statePath), deprecatedStateFile), log)
 		if os.IsNotExist(err) {
-			content, err = ioutil.ReadFile(deprecatedStatePath)
+			// the state may have been lost while being replaced
+			err = loadStateFile(cs, statePath+backupSuffix, log)
+			if os.IsNotExist(err) {
+				return nil
+			}
+		}
+	} else if err != nil {
+		backupPath := statePath + backupSuffix
+		if backupErr := loadStateFile(cs, backupPath, log); backupErr == nil {
+			log.WithError(err).WithField("backup", backupPath).Warn("could not load state, using backup")
+			return nil
 		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w; remove it or use --init to start a new cluster", err)
+	}
+	return nil
+}
 
-		if err != nil {
-			if !os.IsNotExist(err) {
-				logrus.Warnf("could not open state in %s: %s", statePath, err)
-			}
-			return
+// loadStateFile loads and migrates the state in the provided path, returning an error satisfying os.IsNotExist if it
+// does not exist.
+func loadStateFile(cs *state, path string, log logrus.FieldLogger) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return err
 		}
+		return fmt.Errorf("could not open state in %s: %w", path, err)
 	}
 
 	// avoid partially unmarshalled content by using a temp var
 	csTmp := &state{}
 	if err := json.Unmarshal(content, csTmp); err != nil {
-		logrus.Warnf("could not decode state: %s", err)
-	} else {
-		*cs = *csTmp
+		return fmt.Errorf("corrupt state in %s: %w", path, err)
+	}
+	if len(csTmp.ClusterKey) == 0 {
+		return fmt.Errorf("corrupt state in %s: missing cluster key", path)
+	}
+	if err := csTmp.migrate(log); err != nil {
+		return fmt.Errorf("migrating state in %s: %w", path, err)
+	}
+	*cs = *csTmp
+	return nil
+}
+
+// migrate upgrades the state to the current version.
+func (s *state) migrate(log logrus.FieldLogger) error {
+	if s.Version > stateVersion {
+		return fmt.Errorf("state version %d is newer than supported version %d", s.Version, stateVersion)
+	}
+	for ; s.Version < stateVersion; s.Version++ {
+		log.Infof("migrating state from version %d to %d", s.Version, s.Version+1)
+		if err := migrations[s.Version](s, log); err != nil {
+			return fmt.Errorf("migrating from version %d: %w", s.Version, err)
+		}
+	}
+	return nil
+}
+
+// updateNodes records the provided members as last seen at the provided time.
+// Known nodes which are not currently members are kept until they have not been seen for longer than maxAge, so they
+// can be re-joined.
+func (s *state) updateNodes(members []common.Node, now time.Time, maxAge time.Duration, log logrus.FieldLogger) {
+	nodes := make([]common.Node, 0, len(members))
+	current := make(map[string]struct{}, len(members))
+	for _, n := range members {
+		n.LastSeen = now
+		nodes = append(nodes, n)
+		current[n.Name] = struct{}{}
+	}
+	for _, n := range s.Nodes {
+		if _, ok := current[n.Name]; ok {
+			continue
+		}
+		if maxAge > 0 && now.Sub(n.LastSeen) > maxAge {
+			log.WithField("node", n.Name).WithField("last_seen", n.LastSeen).Debug("forgetting node")
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	s.Nodes = nodes
+}
+
+// revocation returns the index of the revocation of the provided target, or -1 if there is none.
+func (s *state) revocation(target string) int {
+	for i := range s.Revocations {
+		if s.Revocations[i].Target == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// pruneRevocations forgets expired bans.
+func (s *state) pruneRevocations(now time.Time) {
+	revs := make([]Revocation, 0, len(s.Revocations))
+	for _, rev := range s.Revocations {
+		if rev.Lifted || rev.Active(now) {
+			revs = append(revs, rev)
+		}
+	}
+	s.Revocations = revs
+}
+
+// forgetBanned removes the nodes banned by the provided revocation from the known nodes.
+func (s *state) forgetBanned(rev Revocation) {
+	nodes := make([]common.Node, 0, len(s.Nodes))
+	for i := range s.Nodes {
+		if !rev.Matches(&s.Nodes[i]) {
+			nodes = append(nodes, s.Nodes[i])
+		}
+	}
+	s.Nodes = nodes
+}
+
+// forgetNode removes a node from the known nodes, e.g. after it intentionally left.
+func (s *state) forgetNode(name string) {
+	nodes := make([]common.Node, 0, len(s.Nodes))
+	for _, n := range s.Nodes {
+		if n.Name != name {
+			nodes = append(nodes, n)
+		}
 	}
+	s.Nodes = nodes
 }
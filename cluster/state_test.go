@@ -1,15 +1,21 @@
 package cluster
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_state_save_soad(t *testing.T) {
-	statePathTemplate = "/tmp/%s.json"
+	statePath := statePath(t.TempDir(), "test")
 	key := "abcdefghijklmnopqrstuvwxyzABCDEF"
 	node := common.Node{
 		Name: "node",
@@ -23,13 +29,147 @@ func Test_state_save_soad(t *testing.T) {
 		},
 	}
 
-	if err := cluster.state.save("test"); err != nil {
+	if err := cluster.state.save(statePath, logrus.StandardLogger()); err != nil {
 		t.Error(err)
 	}
 	loaded := &state{}
-	loadState(loaded, "test")
+	if err := loadState(loaded, statePath, logrus.StandardLogger()); err != nil {
+		t.Fatal(err)
+	}
 
 	if !reflect.DeepEqual(cluster.state, loaded) {
-		t.Errorf("cluster state save then reload mistmatch: %s / %s", cluster.state, loaded)
+		t.Errorf("cluster state save then reload mistmatch: %v / %v", cluster.state, loaded)
+	}
+}
+
+func Test_state_updateNodes(t *testing.T) {
+	now := time.Now()
+	s := &state{
+		Nodes: []common.Node{
+			{Name: "recent", LastSeen: now.Add(-time.Hour)},
+			{Name: "expired", LastSeen: now.Add(-48 * time.Hour)},
+			{Name: "member", LastSeen: now.Add(-48 * time.Hour)},
+		},
+	}
+
+	s.updateNodes([]common.Node{{Name: "member"}, {Name: "new"}}, now, 24*time.Hour, logrus.StandardLogger())
+
+	lastSeen := make(map[string]time.Time, len(s.Nodes))
+	for _, n := range s.Nodes {
+		lastSeen[n.Name] = n.LastSeen
+	}
+	want := map[string]time.Time{
+		"member": now,
+		"new":    now,
+		"recent": now.Add(-time.Hour),
 	}
+	if !reflect.DeepEqual(lastSeen, want) {
+		t.Errorf("updateNodes() = %v, want %v", lastSeen, want)
+	}
+}
+
+func Test_state_updateNodes_noMaxAge(t *testing.T) {
+	now := time.Now()
+	s := &state{Nodes: []common.Node{{Name: "old", LastSeen: now.Add(-365 * 24 * time.Hour)}}}
+
+	s.updateNodes(nil, now, 0, logrus.StandardLogger())
+
+	if len(s.Nodes) != 1 {
+		t.Errorf("updateNodes() without max age forgot nodes: %v", s.Nodes)
+	}
+}
+
+func Test_state_forgetNode(t *testing.T) {
+	s := &state{Nodes: []common.Node{{Name: "a"}, {Name: "b"}}}
+
+	s.forgetNode("a")
+
+	if len(s.Nodes) != 1 || s.Nodes[0].Name != "b" {
+		t.Errorf("forgetNode() = %v, want only node b", s.Nodes)
+	}
+}
+
+func Test_state_save_atomic(t *testing.T) {
+	dir := t.TempDir()
+	statePath := statePath(dir, "test")
+	first := &state{ClusterKey: []byte("first")}
+	second := &state{ClusterKey: []byte("second")}
+
+	require.NoError(t, first.save(statePath, logrus.StandardLogger()))
+	require.NoError(t, second.save(statePath, logrus.StandardLogger()))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.ElementsMatch(t, []string{"test.json", "test.json.bak"}, names, "no temporary files should be left behind")
+
+	backup := &state{}
+	require.NoError(t, loadStateFile(backup, statePath+backupSuffix, logrus.StandardLogger()))
+	require.Equal(t, first.ClusterKey, backup.ClusterKey)
+}
+
+func Test_loadState_corrupt(t *testing.T) {
+	dir := t.TempDir()
+	statePath := statePath(dir, "test")
+	require.NoError(t, os.WriteFile(statePath, []byte(`{"ClusterKey": "`), 0600))
+
+	err := loadState(&state{}, statePath, logrus.StandardLogger())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "corrupt state")
+}
+
+func Test_loadState_corruptWithBackup(t *testing.T) {
+	dir := t.TempDir()
+	statePath := statePath(dir, "test")
+	require.NoError(t, (&state{ClusterKey: []byte("first")}).save(statePath, logrus.StandardLogger()))
+	require.NoError(t, (&state{ClusterKey: []byte("second")}).save(statePath, logrus.StandardLogger()))
+	require.NoError(t, os.WriteFile(statePath, nil, 0600))
+
+	loaded := &state{}
+	require.NoError(t, loadState(loaded, statePath, logrus.StandardLogger()))
+	require.Equal(t, []byte("first"), loaded.ClusterKey)
+}
+
+func Test_loadState_missing(t *testing.T) {
+	statePath := statePath(t.TempDir(), "test")
+
+	loaded := &state{}
+	require.NoError(t, loadState(loaded, statePath, logrus.StandardLogger()))
+	require.Equal(t, &state{}, loaded)
+}
+
+func Test_loadState_newerVersion(t *testing.T) {
+	dir := t.TempDir()
+	statePath := statePath(dir, "test")
+	content := fmt.Sprintf(`{"Version": %d, "ClusterKey": "YWJj"}`, stateVersion+1)
+	require.NoError(t, os.WriteFile(statePath, []byte(content), 0600))
+
+	require.Error(t, loadState(&state{}, statePath, logrus.StandardLogger()))
+}
+
+func Test_loadState_migrateUnversioned(t *testing.T) {
+	dir := t.TempDir()
+	statePath := statePath(dir, "test")
+	node := common.Node{Name: "node", Addr: net.ParseIP("10.0.0.2")}
+	node.PubKey = "pubkey"
+	meta, err := node.EncodeMeta(512)
+	require.NoError(t, err)
+	legacy, err := json.Marshal(map[string]interface{}{
+		"ClusterKey": []byte("key"),
+		"Nodes": []map[string]interface{}{
+			{"Name": "node", "Addr": "10.0.0.2", "Meta": meta},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(statePath, legacy, 0600))
+
+	loaded := &state{}
+	require.NoError(t, loadState(loaded, statePath, logrus.StandardLogger()))
+	require.Equal(t, stateVersion, loaded.Version)
+	require.Len(t, loaded.Nodes, 1)
+	require.Equal(t, "pubkey", loaded.Nodes[0].PubKey)
+	require.False(t, loaded.Nodes[0].LastSeen.IsZero(), "migrated nodes should not expire right away")
 }
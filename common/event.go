@@ -0,0 +1,97 @@
+package common
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// EventType describes the kind of change to a cluster member.
+type EventType string
+
+const (
+	// EventJoin signals a node joined the cluster.
+	EventJoin EventType = "join"
+	// EventLeave signals a node left or failed.
+	EventLeave EventType = "leave"
+	// EventUpdate signals a node changed its address or metadata.
+	EventUpdate EventType = "update"
+	// EventHandshakeFailed signals a peer is configured but no wireguard handshake could be completed with it.
+	EventHandshakeFailed EventType = "failed-handshake"
+	// EventAdmissionRejected signals a node was not admitted to the cluster.
+	EventAdmissionRejected EventType = "admission-rejected"
+)
+
+// Event describes a change to a cluster member, in a form suitable for consumers outside of wesher.
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Network string    `json:"network"`
+	Node    string    `json:"node"`
+	// NodeInfo holds the current node details; for leave events, the last known ones.
+	NodeInfo
+	// Previous holds the node details before an update.
+	Previous *NodeInfo `json:"previous,omitempty"`
+	// Reason optionally explains the event, e.g. why a node was rejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+// NodeInfo holds the node details provided in events.
+type NodeInfo struct {
+	Addr    string            `json:"addr"`
+	Overlay string            `json:"overlay,omitempty"`
+	PubKey  string            `json:"pubkey,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// NewEvent returns an event of the provided type about the provided node.
+func NewEvent(t EventType, network string, node Node) Event {
+	return Event{
+		Type:     t,
+		Time:     time.Now(),
+		Network:  network,
+		Node:     node.Name,
+		NodeInfo: newNodeInfo(node),
+	}
+}
+
+func newNodeInfo(node Node) NodeInfo {
+	info := NodeInfo{
+		Addr:   node.Addr.String(),
+		PubKey: node.PubKey,
+		Labels: node.Labels,
+	}
+	if node.OverlayAddr.IsValid() {
+		info.Overlay = node.OverlayAddr.String()
+	}
+	return info
+}
+
+// DiffNodes returns the events turning the previous list of nodes into the current one, sorted by node name.
+func DiffNodes(network string, previous, current []Node) []Event {
+	before := make(map[string]Node, len(previous))
+	for _, n := range previous {
+		before[n.Name] = n
+	}
+
+	events := make([]Event, 0)
+	for _, n := range current {
+		old, ok := before[n.Name]
+		delete(before, n.Name)
+		switch {
+		case !ok:
+			events = append(events, NewEvent(EventJoin, network, n))
+		case !old.Addr.Equal(n.Addr) || !bytes.Equal(old.Meta, n.Meta):
+			event := NewEvent(EventUpdate, network, n)
+			previous := newNodeInfo(old)
+			event.Previous = &previous
+			events = append(events, event)
+		}
+	}
+	for _, n := range before {
+		events = append(events, NewEvent(EventLeave, network, n))
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Node < events[j].Node })
+	return events
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DiffNodes(t *testing.T) {
+	previous := []Node{
+		{Name: "same", Addr: net.ParseIP("192.0.2.1"), Meta: []byte{1}},
+		{Name: "moved", Addr: net.ParseIP("192.0.2.2"), Meta: []byte{1}},
+		{Name: "changed", Addr: net.ParseIP("192.0.2.3"), Meta: []byte{1}},
+		{Name: "gone", Addr: net.ParseIP("192.0.2.4"), Meta: []byte{1}},
+	}
+	current := []Node{
+		{Name: "same", Addr: net.ParseIP("192.0.2.1"), Meta: []byte{1}},
+		{Name: "moved", Addr: net.ParseIP("192.0.2.20"), Meta: []byte{1}},
+		{Name: "changed", Addr: net.ParseIP("192.0.2.3"), Meta: []byte{2}},
+		{Name: "new", Addr: net.ParseIP("192.0.2.5"), Meta: []byte{1}},
+	}
+
+	events := DiffNodes("net", previous, current)
+
+	got := make(map[string]EventType, len(events))
+	for _, e := range events {
+		assert.Equal(t, "net", e.Network)
+		got[e.Node] = e.Type
+	}
+	assert.Equal(t, map[string]EventType{
+		"moved":   EventUpdate,
+		"changed": EventUpdate,
+		"gone":    EventLeave,
+		"new":     EventJoin,
+	}, got)
+	assert.Equal(t, "192.0.2.20", events[2].Addr, "events should carry the current node details")
+	if assert.NotNil(t, events[2].Previous) {
+		assert.Equal(t, "192.0.2.2", events[2].Previous.Addr, "update events should carry the previous node details")
+	}
+	assert.Nil(t, events[3].Previous)
+}
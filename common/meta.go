@@ -0,0 +1,223 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// metaVersion prefixes the compact metadata encoding. Gob-encoded metadata - sent by older versions - never starts with
+// a zero byte, since gob messages are prefixed with their non-zero length.
+var metaVersion = []byte{0, 1}
+
+const (
+	metaRelay byte = 1 << iota
+	metaBehindNAT
+	metaPresharedKeys
+)
+
+var errShortMeta = errors.New("truncated metadata")
+
+// encode writes the metadata in a compact binary format; unlike gob, it carries no type descriptions, so the few
+// hundred bytes memberlist allows for metadata are left for the actual values.
+func (m *nodeMeta) encode() []byte {
+	buf := bytes.NewBuffer(append([]byte(nil), metaVersion...))
+	writeAddr(buf, m.OverlayAddr)
+	writeString(buf, m.PubKey)
+
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // deterministic, so unchanged metadata is not seen as an update
+	writeUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		writeString(buf, k)
+		writeString(buf, m.Labels[k])
+	}
+
+	var flags byte
+	if m.Relay {
+		flags |= metaRelay
+	}
+	if m.BehindNAT {
+		flags |= metaBehindNAT
+	}
+	if m.PresharedKeys {
+		flags |= metaPresharedKeys
+	}
+	buf.WriteByte(flags)
+	writeAddr(buf, m.PublicEndpoint.Addr())
+	binary.Write(buf, binary.BigEndian, m.PublicEndpoint.Port()) // nolint: errcheck // buffers do not fail
+	writeUvarint(buf, uint64(m.WireguardPort))
+	writeString(buf, m.Endpoint)
+	// fixed size, so the metadata size does not depend on when it was last updated
+	binary.Write(buf, binary.BigEndian, m.Incarnation) // nolint: errcheck
+
+	writeUvarint(buf, uint64(len(m.Routes)))
+	for _, route := range m.Routes {
+		writeAddr(buf, route.Addr())
+		buf.WriteByte(byte(route.Bits()))
+	}
+	return buf.Bytes()
+}
+
+// decodeMeta decodes metadata in either the compact or the legacy gob encoding.
+func decodeMeta(data []byte) (nodeMeta, error) {
+	m := nodeMeta{}
+	if !bytes.HasPrefix(data, metaVersion[:1]) {
+		err := gob.NewDecoder(bytes.NewReader(data)).Decode(&m)
+		return m, err
+	}
+	if len(data) < len(metaVersion) {
+		return m, errShortMeta
+	}
+	if !bytes.HasPrefix(data, metaVersion) {
+		return m, fmt.Errorf("unsupported metadata version %d", data[1])
+	}
+	r := &metaReader{data: data[len(metaVersion):]}
+
+	m.OverlayAddr = r.addr()
+	m.PubKey = r.string()
+	if n := r.count(); n > 0 {
+		m.Labels = make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			k := r.string()
+			m.Labels[k] = r.string()
+		}
+	}
+
+	flags := r.byte()
+	m.Relay = flags&metaRelay != 0
+	m.BehindNAT = flags&metaBehindNAT != 0
+	m.PresharedKeys = flags&metaPresharedKeys != 0
+	if addr := r.addr(); addr.IsValid() {
+		m.PublicEndpoint = netip.AddrPortFrom(addr, r.uint16())
+	} else {
+		r.uint16()
+	}
+	m.WireguardPort = int(r.uvarint())
+	m.Endpoint = r.string()
+	m.Incarnation = r.uint64()
+	if n := r.count(); n > 0 {
+		m.Routes = make([]netip.Prefix, 0, n)
+		for i := 0; i < n; i++ {
+			addr := r.addr()
+			bits := int(r.byte())
+			if r.err == nil {
+				route, err := addr.Prefix(bits)
+				if err != nil {
+					return nodeMeta{}, fmt.Errorf("invalid route: %w", err)
+				}
+				m.Routes = append(m.Routes, route)
+			}
+		}
+	}
+	if r.err != nil {
+		return nodeMeta{}, r.err
+	}
+	return m, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func writeAddr(buf *bytes.Buffer, addr netip.Addr) {
+	if !addr.IsValid() {
+		buf.WriteByte(0)
+		return
+	}
+	raw := addr.AsSlice()
+	buf.WriteByte(byte(len(raw)))
+	buf.Write(raw)
+}
+
+// metaReader reads compact metadata, keeping the first error so decoding can be checked once at the end.
+type metaReader struct {
+	data []byte
+	err  error
+}
+
+func (r *metaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errShortMeta
+		return nil
+	}
+	out := r.data[:n]
+	r.data = r.data[n:]
+	return out
+}
+
+func (r *metaReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *metaReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *metaReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *metaReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errShortMeta
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads the number of entries of a list, bounded by the remaining data so bogus counts cannot allocate much.
+func (r *metaReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.err = errShortMeta
+		return 0
+	}
+	return int(n)
+}
+
+func (r *metaReader) string() string {
+	return string(r.next(r.count()))
+}
+
+func (r *metaReader) addr() netip.Addr {
+	raw := r.next(int(r.byte()))
+	if len(raw) == 0 {
+		return netip.Addr{}
+	}
+	addr, ok := netip.AddrFromSlice(raw)
+	if !ok {
+		r.err = fmt.Errorf("invalid address length %d", len(raw))
+	}
+	return addr
+}
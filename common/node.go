@@ -6,19 +6,44 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // nodeMeta holds metadata sent over the cluster
 type nodeMeta struct {
 	OverlayAddr netip.Addr
 	PubKey      string
+	Labels      map[string]string
+	Relay       bool
+	// BehindNAT signals the node cannot be reached directly; peers should keep the connection alive
+	BehindNAT bool
+	// PublicEndpoint is the wireguard endpoint under which other nodes see this node
+	PublicEndpoint netip.AddrPort
+	// WireguardPort is the port the node's wireguard interface listens on
+	WireguardPort int
+	// Endpoint is an optional host:port under which the node's wireguard interface can be reached, overriding both the
+	// node address and WireguardPort (e.g. behind port-forwarding)
+	Endpoint string
+	// Incarnation increases every time the node changes its metadata
+	Incarnation uint64
+	// Routes are additional networks reachable through the node, e.g. its Kubernetes pod CIDRs
+	Routes []netip.Prefix
+	// PresharedKeys signals the node uses per-pair preshared keys with peers also setting it
+	PresharedKeys bool
 }
 
 // Node holds the memberlist node structure
 type Node struct {
 	Name string
 	Addr net.IP
+	// Port is the port the node gossips on; unset for nodes persisted by older versions
+	Port uint16 `json:",omitempty"`
 	Meta []byte
+	// LastSeen is the last time the node was seen as a cluster member
+	LastSeen time.Time `json:",omitempty"`
 	nodeMeta
 }
 
@@ -26,24 +51,71 @@ func (n *Node) String() string {
 	return n.Addr.String()
 }
 
+// JoinAddr returns the address under which the node can be joined, including its gossip port if known.
+func (n *Node) JoinAddr() string {
+	if n.Port == 0 {
+		return n.Addr.String()
+	}
+	return net.JoinHostPort(n.Addr.String(), strconv.Itoa(int(n.Port)))
+}
+
+// LogFields returns structured fields identifying the node, for logging.
+func (n *Node) LogFields() logrus.Fields {
+	fields := logrus.Fields{
+		"node": n.Name,
+		"addr": n.Addr.String(),
+	}
+	if n.OverlayAddr.IsValid() {
+		fields["overlay"] = n.OverlayAddr.String()
+	}
+	if n.PubKey != "" {
+		fields["pubkey"] = n.PubKey
+	}
+	return fields
+}
+
 // EncodeMeta encodes the node metadata to bytes, in a deterministic reversible way.
+// The gob encoding is understood by all versions; see EncodeCompactMeta.
 func (n *Node) EncodeMeta(limit int) ([]byte, error) {
 	buf := &bytes.Buffer{}
 	if err := gob.NewEncoder(buf).Encode(n.nodeMeta); err != nil {
 		return nil, fmt.Errorf("encoding local state: %w", err)
 	}
 	if buf.Len() > limit {
-		return nil, fmt.Errorf("could not fit node metadata into %d bytes", limit)
+		return nil, fmt.Errorf("could not fit node metadata into %d bytes (%d bytes needed)", limit, buf.Len())
 	}
 	return buf.Bytes(), nil
 }
 
+// EncodeCompactMeta encodes the node metadata like EncodeMeta, but in a compact format leaving more room for labels.
+// Versions predating it cannot decode it, so it should only be used once all nodes are upgraded.
+func (n *Node) EncodeCompactMeta(limit int) ([]byte, error) {
+	encoded := n.nodeMeta.encode()
+	if len(encoded) > limit {
+		return nil, fmt.Errorf("could not fit node metadata into %d bytes (%d bytes needed)", limit, len(encoded))
+	}
+	return encoded, nil
+}
+
+// ValidateMeta checks the node metadata fits into limit bytes in the gob or compact encoding, including the fields
+// which are only set at runtime, like the public endpoint discovered behind NAT.
+func (n *Node) ValidateMeta(limit int, compact bool) error {
+	worst := *n
+	worst.PublicEndpoint = netip.AddrPortFrom(netip.IPv6Unspecified(), 65535)
+	if compact {
+		_, err := worst.EncodeCompactMeta(limit)
+		return err
+	}
+	_, err := worst.EncodeMeta(limit)
+	return err
+}
+
 // DecodeMeta decodes the node Meta field into its individual metadata fields.
 func (n *Node) DecodeMeta() error {
 	// TODO: we blindly trust the info we get from the peers; We should be more defensive to limit the damage a leaked
 	// PSK can cause.
-	nm := nodeMeta{}
-	if err := gob.NewDecoder(bytes.NewReader(n.Meta)).Decode(&nm); err != nil {
+	nm, err := decodeMeta(n.Meta)
+	if err != nil {
 		return fmt.Errorf("decoding node meta: %w", err)
 	}
 	n.nodeMeta = nm
@@ -1,10 +1,16 @@
 package common
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
 	"net/netip"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,7 +33,76 @@ func Test_Node_Encode_Decode(t *testing.T) {
 		require.NoError(t, err)
 
 		if !reflect.DeepEqual(node.nodeMeta, new.nodeMeta) {
-			t.Errorf("node encoding then decoding mismatch: %s / %s", node.nodeMeta, new.nodeMeta)
+			t.Errorf("node encoding then decoding mismatch: %v / %v", node.nodeMeta, new.nodeMeta)
 		}
 	}
 }
+
+func Test_Node_Encode_Decode_AllFields(t *testing.T) {
+	node := Node{nodeMeta: realisticMeta(5)}
+	node.Relay = true
+	node.PresharedKeys = true
+	node.Routes = []netip.Prefix{netip.MustParsePrefix("10.244.1.0/24"), netip.MustParsePrefix("fd00:244:1::/64")}
+
+	encoded, err := node.EncodeCompactMeta(512)
+	require.NoError(t, err)
+	decoded := Node{Meta: encoded}
+	require.NoError(t, decoded.DecodeMeta())
+	require.Equal(t, node.nodeMeta, decoded.nodeMeta)
+
+	again, err := decoded.EncodeCompactMeta(512)
+	require.NoError(t, err)
+	require.Equal(t, encoded, again, "encoding should be deterministic")
+
+	for i := range encoded {
+		truncated := Node{Meta: encoded[:i]}
+		require.Error(t, truncated.DecodeMeta(), "truncated at %d bytes", i)
+	}
+}
+
+func Test_Node_DecodeMeta_Gob(t *testing.T) {
+	meta := nodeMeta{OverlayAddr: netip.MustParseAddr("10.0.0.1"), PubKey: "key", Labels: map[string]string{"a": "b"}}
+	buf := &bytes.Buffer{}
+	require.NoError(t, gob.NewEncoder(buf).Encode(meta))
+
+	node := Node{Meta: buf.Bytes()}
+	require.NoError(t, node.DecodeMeta())
+	require.Equal(t, meta, node.nodeMeta)
+
+	// nodes gossip gob by default, so older versions can still decode it
+	node = Node{nodeMeta: realisticMeta(2)}
+	encoded, err := node.EncodeMeta(memberlist.MetaMaxSize)
+	require.NoError(t, err)
+	decoded := nodeMeta{}
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(encoded)).Decode(&decoded))
+	require.Equal(t, node.nodeMeta, decoded)
+}
+
+func Test_Node_ValidateMeta(t *testing.T) {
+	node := Node{nodeMeta: realisticMeta(10)}
+	require.NoError(t, node.ValidateMeta(memberlist.MetaMaxSize, true), "a node with 10 labels should fit")
+	require.Error(t, node.ValidateMeta(memberlist.MetaMaxSize, false), "gob should leave less room for labels")
+
+	node = Node{nodeMeta: realisticMeta(2)}
+	require.NoError(t, node.ValidateMeta(memberlist.MetaMaxSize, false))
+
+	node.Labels["description"] = strings.Repeat("x", 500)
+	require.Error(t, node.ValidateMeta(memberlist.MetaMaxSize, true))
+}
+
+func realisticMeta(labels int) nodeMeta {
+	meta := nodeMeta{
+		OverlayAddr:    netip.MustParseAddr("10.10.12.34"),
+		PubKey:         "hN0vlZ3pUtR4SqS8ADwjw/d9gGbBXjOhVB53Z3pBF0o=",
+		BehindNAT:      true,
+		PublicEndpoint: netip.MustParseAddrPort("[2001:db8::1234]:51820"),
+		WireguardPort:  51820,
+		Endpoint:       "gateway-01.example.com:51820",
+		Incarnation:    uint64(time.Now().UnixNano()),
+		Labels:         make(map[string]string, labels),
+	}
+	for i := 0; i < labels; i++ {
+		meta.Labels[fmt.Sprintf("example.com/label-%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+	return meta
+}
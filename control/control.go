@@ -0,0 +1,343 @@
+// Package control exposes a running agent over HTTP on a local unix socket.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/costela/wesher/eventbus"
+	"github.com/costela/wesher/health"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSocket is the default path of the control socket.
+const DefaultSocket = "/run/wesher/wesher.sock"
+
+// NetworkStatus is the status of a single network managed by the agent.
+type NetworkStatus struct {
+	Name        string              `json:"name"`
+	Interface   string              `json:"interface"`
+	Node        string              `json:"node"`
+	Overlay     string              `json:"overlay"`
+	Members     int                 `json:"members"`
+	Partitioned bool                `json:"partitioned"`
+	BehindNAT   bool                `json:"behind_nat"`
+	Peers       []health.PeerHealth `json:"peers"`
+	// Joined is whether the cluster was joined.
+	Joined bool `json:"joined"`
+	// InterfaceUp is whether the wireguard interface was last configured successfully.
+	InterfaceUp bool `json:"interface_up"`
+	// HostsWritten is whether the hosts entries were last written successfully, or hosts management is disabled.
+	HostsWritten bool `json:"hosts_written"`
+	// Hosts are the current hosts entries, mapping overlay addresses to names.
+	Hosts map[string][]string `json:"hosts,omitempty"`
+	// Error is why the network stopped running, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Ready returns whether the network is fully set up, along with the reasons if not.
+func (n NetworkStatus) Ready() (bool, []string) {
+	reasons := []string{}
+	if n.Error != "" {
+		return false, []string{"failed: " + n.Error}
+	}
+	if !n.Joined {
+		reasons = append(reasons, "cluster not joined")
+	}
+	if !n.InterfaceUp {
+		reasons = append(reasons, "interface not configured")
+	}
+	if !n.HostsWritten {
+		reasons = append(reasons, "hosts entries not written")
+	}
+	return len(reasons) == 0, reasons
+}
+
+// Server serves the control API.
+type Server struct {
+	// Events is the bus streamed to clients of the events endpoint.
+	Events *eventbus.Bus
+	// Status returns the status of all networks.
+	Status func() []NetworkStatus
+	// Ban applies the provided JSON list of signed revocations - banning nodes or lifting bans - to the provided
+	// network, or all networks if empty, returning the networks they were applied to.
+	Ban func(network, revocations string) ([]string, error)
+	// Logger is used to log errors; defaults to the standard logrus logger.
+	Logger logrus.FieldLogger
+}
+
+// Handler returns the HTTP handler for the control API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/hosts", s.handleHosts)
+	mux.HandleFunc("/ban", s.handleBan)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	return mux
+}
+
+// HTTPHandler returns the HTTP handler for the subset of the API safe to expose over the network: metrics and health
+// checks.
+func (s *Server) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	return mux
+}
+
+// ListenAndServe serves the control API on the provided unix socket until the context is cancelled.
+// The socket is only accessible by the current user: it is bound in a private directory and only moved into place once
+// its permissions are restricted.
+func (s *Server) ListenAndServe(ctx context.Context, path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("creating socket directory: %w", err)
+	}
+	// stale sockets from previous runs are replaced, but never other files or sockets still in use
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("listening on control socket: %s exists and is not a socket", path)
+		}
+		if socketInUse(path) {
+			return fmt.Errorf("listening on control socket: %s already in use, is another agent running?", path)
+		}
+	}
+	tmpDir, err := os.MkdirTemp(dir, ".wesher-control-")
+	if err != nil {
+		return fmt.Errorf("creating socket directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint: errcheck // best effort
+	tmpPath := filepath.Join(tmpDir, "control.sock")
+	l, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return fmt.Errorf("listening on control socket: %w", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false) // the socket is moved; removed below instead
+	if err := os.Chmod(tmpPath, 0o600); err != nil {
+		l.Close() // nolint: errcheck
+		return fmt.Errorf("restricting control socket permissions: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		l.Close() // nolint: errcheck
+		return fmt.Errorf("moving control socket into place: %w", err)
+	}
+	os.Remove(tmpDir)     // nolint: errcheck // best effort
+	defer os.Remove(path) // nolint: errcheck // best effort
+	return serve(ctx, l, s.Handler())
+}
+
+// socketInUse returns whether something answers on the provided unix socket.
+func socketInUse(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close() // nolint: errcheck
+	return true
+}
+
+// ListenAndServeHTTP serves the network-safe subset of the API on the provided TCP address until the context is
+// cancelled.
+func (s *Server) ListenAndServeHTTP(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for HTTP: %w", err)
+	}
+	return serve(ctx, l, s.HTTPHandler())
+}
+
+func serve(ctx context.Context, l net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx) // nolint: errcheck // best effort
+	}()
+	if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// handleEvents writes events as newline-delimited JSON: the recent history and - if the follow parameter is set - all
+// further events, until the client disconnects.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	if !follow {
+		for _, e := range s.Events.Recent() {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	sub := s.Events.Subscribe(0, true)
+	defer sub.Close()
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush() // send headers right away
+	}
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				if err := sub.Err(); err != nil {
+					s.logger().WithError(err).Warn("closing event stream")
+				}
+				return
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.status()) // nolint: errcheck // client gone
+}
+
+// handleHosts writes the current hosts entries of all networks in hosts(5) format.
+func (s *Server) handleHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b := &strings.Builder{}
+	for _, n := range s.status() {
+		fmt.Fprintf(b, "# wesher network %s\n", n.Name)
+		addrs := make([]string, 0, len(n.Hosts))
+		for addr := range n.Hosts {
+			addrs = append(addrs, addr)
+		}
+		sort.Slice(addrs, func(i, j int) bool {
+			return strings.Join(n.Hosts[addrs[i]], " ") < strings.Join(n.Hosts[addrs[j]], " ")
+		})
+		for _, addr := range addrs {
+			fmt.Fprintf(b, "%s\t%s\n", addr, strings.Join(n.Hosts[addr], " "))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, b.String()) // nolint: errcheck // client gone
+}
+
+// handleBan applies the signed revocations provided in the revocations parameter to the network provided in the network
+// parameter, or to all networks.
+func (s *Server) handleBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Ban == nil {
+		http.Error(w, "banning not supported", http.StatusNotImplemented)
+		return
+	}
+	revocations := r.FormValue("revocations")
+	if revocations == "" {
+		http.Error(w, "missing revocations", http.StatusBadRequest)
+		return
+	}
+	networks, err := s.Ban(r.FormValue("network"), revocations)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := &strings.Builder{}
+	for _, network := range networks {
+		fmt.Fprintf(b, "updated bans of network %s\n", network)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, b.String()) // nolint: errcheck // client gone
+}
+
+// handleHealthz reports the agent as alive as long as it serves requests.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n") // nolint: errcheck // client gone
+}
+
+// handleReadyz reports the agent as ready once all its networks are fully set up.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	networks := s.status()
+	ready := len(networks) > 0
+	b := &strings.Builder{}
+	if len(networks) == 0 {
+		b.WriteString("no networks running\n")
+	}
+	for _, n := range networks {
+		ok, reasons := n.Ready()
+		if ok {
+			fmt.Fprintf(b, "%s: ready\n", n.Name)
+			continue
+		}
+		ready = false
+		fmt.Fprintf(b, "%s: %s\n", n.Name, strings.Join(reasons, ", "))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	io.WriteString(w, b.String()) // nolint: errcheck // client gone
+}
+
+func (s *Server) status() []NetworkStatus {
+	if s.Status == nil {
+		return []NetworkStatus{}
+	}
+	return s.Status()
+}
+
+func (s *Server) logger() logrus.FieldLogger {
+	if s.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return s.Logger
+}
+
+// Client returns an HTTP client talking to the control socket at the provided path.
+// Requests should use "http://wesher" as base URL.
+func Client(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
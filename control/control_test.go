@@ -0,0 +1,237 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/eventbus"
+	"github.com/costela/wesher/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) (*eventbus.Bus, string) {
+	t.Helper()
+	bus := &eventbus.Bus{}
+	path := filepath.Join(t.TempDir(), "control.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go (&Server{Events: bus}).ListenAndServe(ctx, path) // nolint: errcheck
+	require.Eventually(t, func() bool {
+		resp, err := Client(path).Get("http://wesher/events")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return bus, path
+}
+
+func Test_Server_events(t *testing.T) {
+	bus, path := startServer(t)
+	bus.Publish(common.Event{Type: common.EventJoin, Node: "a"}, common.Event{Type: common.EventLeave, Node: "a"})
+
+	resp, err := Client(path).Get("http://wesher/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"type":"join","time":"0001-01-01T00:00:00Z","network":"","node":"a","addr":""}
+{"type":"leave","time":"0001-01-01T00:00:00Z","network":"","node":"a","addr":""}
+`, string(body))
+}
+
+func Test_Server_events_follow(t *testing.T) {
+	bus, path := startServer(t)
+	bus.Publish(common.Event{Type: common.EventJoin, Node: "a"})
+
+	resp, err := Client(path).Get("http://wesher/events?follow=true")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+
+	next := func() common.Event {
+		require.True(t, lines.Scan())
+		e := common.Event{}
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &e))
+		return e
+	}
+	assert.Equal(t, "a", next().Node, "history should be replayed")
+	bus.Publish(common.Event{Type: common.EventUpdate, Node: "b"})
+	assert.Equal(t, "b", next().Node, "new events should be streamed")
+}
+
+func Test_Server_status(t *testing.T) {
+	server := &Server{Status: func() []NetworkStatus {
+		return []NetworkStatus{{Name: "wgoverlay", Members: 2, Peers: []health.PeerHealth{{Node: "a", Status: health.StatusUp}}}}
+	}}
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	got := []NetworkStatus{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Len(t, got, 1)
+	assert.Equal(t, 2, got[0].Members)
+	assert.Equal(t, health.StatusUp, got[0].Peers[0].Status)
+}
+
+func Test_Server_metrics(t *testing.T) {
+	handshake := time.Unix(1700000000, 0)
+	server := &Server{Status: func() []NetworkStatus {
+		return []NetworkStatus{{Name: "wgoverlay", Members: 2, Peers: []health.PeerHealth{
+			{Node: "a", Status: health.StatusUp, LastHandshake: handshake, RTT: 1500 * time.Microsecond, RxBytes: 10, TxBytes: 20},
+			{Node: "b", Status: health.StatusDown},
+		}}}
+	}}
+	rec := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE wesher_members gauge\nwesher_members{network=\"wgoverlay\"} 2\n")
+	assert.Contains(t, body, "wesher_peer_up{network=\"wgoverlay\",peer=\"a\"} 1\n")
+	assert.Contains(t, body, "wesher_peer_up{network=\"wgoverlay\",peer=\"b\"} 0\n")
+	assert.Contains(t, body, "wesher_peer_last_handshake_seconds{network=\"wgoverlay\",peer=\"a\"} 1.7e+09\n")
+	assert.NotContains(t, body, "wesher_peer_last_handshake_seconds{network=\"wgoverlay\",peer=\"b\"}")
+	assert.Contains(t, body, "wesher_peer_probe_rtt_seconds{network=\"wgoverlay\",peer=\"a\"} 0.0015\n")
+	assert.Contains(t, body, "wesher_peer_receive_bytes_total{network=\"wgoverlay\",peer=\"a\"} 10\n")
+
+	rec = httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "status should not be exposed over the network")
+}
+
+func Test_labels(t *testing.T) {
+	assert.Equal(t, `network="wgoverlay",peer="nœud-1"`, labels("network", "wgoverlay", "peer", "nœud-1"),
+		"non-ASCII characters should be kept as is")
+	assert.Equal(t, "peer=\"a\\\\b\\\"c\\nd\te\"", labels("peer", "a\\b\"c\nd\te"),
+		"only backslashes, double quotes and newlines should be escaped")
+}
+
+func Test_Server_readyz(t *testing.T) {
+	networks := []NetworkStatus{}
+	server := &Server{Status: func() []NetworkStatus { return networks }}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz").Code, "no network should not be ready")
+
+	networks = []NetworkStatus{{Name: "a", Joined: true}}
+	rec := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "a: interface not configured, hosts entries not written\n", rec.Body.String())
+
+	networks[0].InterfaceUp, networks[0].HostsWritten = true, true
+	rec = get("/readyz")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "a: ready\n", rec.Body.String())
+}
+
+func Test_Server_hosts(t *testing.T) {
+	server := &Server{Status: func() []NetworkStatus {
+		return []NetworkStatus{
+			{Name: "a", Hosts: map[string][]string{"10.0.0.3": {"node-b"}, "10.0.0.2": {"node-c"}, "10.0.0.1": {"node-a"}}},
+			{Name: "b"},
+		}
+	}}
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hosts", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "# wesher network a\n10.0.0.1\tnode-a\n10.0.0.3\tnode-b\n10.0.0.2\tnode-c\n# wesher network b\n", rec.Body.String())
+}
+
+func Test_Server_ban(t *testing.T) {
+	banned := map[string]string{}
+	server := &Server{Ban: func(network, revocations string) ([]string, error) {
+		if revocations == "local" {
+			return nil, fmt.Errorf("cannot ban the local node")
+		}
+		banned[revocations] = network
+		return []string{"a", "b"}, nil
+	}}
+	post := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/ban?"+query, nil))
+		return rec
+	}
+
+	rec := post("revocations=bad")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "updated bans of network a\nupdated bans of network b\n", rec.Body.String())
+	assert.Equal(t, map[string]string{"bad": ""}, banned)
+
+	post("revocations=worse&network=a")
+	assert.Equal(t, "a", banned["worse"])
+
+	assert.Equal(t, http.StatusBadRequest, post("").Code)
+	rec = post("revocations=local")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "cannot ban the local node")
+
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ban?revocations=bad", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/ban?revocations=bad", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "banning should not be exposed over the network")
+}
+
+func Test_Server_ListenAndServe_permissions(t *testing.T) {
+	_, path := startServer(t)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "the temporary socket directory should be removed")
+
+	other := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(other, nil, 0o600))
+	assert.Error(t, (&Server{}).ListenAndServe(context.Background(), other), "other files should not be replaced")
+}
+
+func Test_Server_ListenAndServe_existingSocket(t *testing.T) {
+	_, path := startServer(t)
+	err := (&Server{}).ListenAndServe(context.Background(), path)
+	require.Error(t, err, "sockets in use should not be replaced")
+	assert.Contains(t, err.Error(), "already in use")
+	resp, err := Client(path).Get("http://wesher/events")
+	require.NoError(t, err, "the running server should still be reachable")
+	resp.Body.Close()
+
+	stale := filepath.Join(t.TempDir(), "control.sock")
+	l, err := net.Listen("unix", stale)
+	require.NoError(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close()) // leaves the socket file behind, as after a crash
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&Server{Events: &eventbus.Bus{}}).ListenAndServe(ctx, stale) // nolint: errcheck
+	assert.Eventually(t, func() bool {
+		resp, err := Client(stale).Get("http://wesher/events")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "stale sockets should be replaced")
+}
@@ -0,0 +1,118 @@
+package control
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/costela/wesher/health"
+)
+
+// handleMetrics writes the status of all networks in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, s.status()) // nolint: errcheck // client gone
+}
+
+type metric struct {
+	name, help, kind string
+}
+
+var (
+	metricMembers      = metric{"wesher_members", "Number of cluster members, excluding the local node.", "gauge"}
+	metricPartitioned  = metric{"wesher_partitioned", "Whether at least half of the cluster failed and could not be re-joined.", "gauge"}
+	metricBehindNAT    = metric{"wesher_behind_nat", "Whether the local node is behind NAT.", "gauge"}
+	metricPeerUp       = metric{"wesher_peer_up", "Whether the tunnel to the peer is up (1), down (0) or unknown (-1).", "gauge"}
+	metricPeerRelayed  = metric{"wesher_peer_relayed", "Whether traffic to the peer is routed through a relay.", "gauge"}
+	metricHandshake    = metric{"wesher_peer_last_handshake_seconds", "Unix time of the last wireguard handshake with the peer.", "gauge"}
+	metricRTT          = metric{"wesher_peer_probe_rtt_seconds", "Round-trip time of the last successful probe of the peer.", "gauge"}
+	metricReceiveBytes = metric{"wesher_peer_receive_bytes_total", "Bytes received from the peer.", "counter"}
+	metricSendBytes    = metric{"wesher_peer_transmit_bytes_total", "Bytes sent to the peer.", "counter"}
+)
+
+func writeMetrics(w io.Writer, networks []NetworkStatus) error {
+	b := &strings.Builder{}
+	sample := func(m metric, labels string, value float64) {
+		fmt.Fprintf(b, "%s{%s} %s\n", m.name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	header := func(m metric) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	}
+
+	for _, m := range []metric{metricMembers, metricPartitioned, metricBehindNAT} {
+		header(m)
+		for _, n := range networks {
+			labels := labels("network", n.Name)
+			switch m {
+			case metricMembers:
+				sample(m, labels, float64(n.Members))
+			case metricPartitioned:
+				sample(m, labels, boolValue(n.Partitioned))
+			case metricBehindNAT:
+				sample(m, labels, boolValue(n.BehindNAT))
+			}
+		}
+	}
+
+	for _, m := range []metric{metricPeerUp, metricPeerRelayed, metricHandshake, metricRTT, metricReceiveBytes, metricSendBytes} {
+		header(m)
+		for _, n := range networks {
+			for _, p := range n.Peers {
+				labels := labels("network", n.Name, "peer", p.Node)
+				switch m {
+				case metricPeerUp:
+					sample(m, labels, statusValue(p.Status))
+				case metricPeerRelayed:
+					sample(m, labels, boolValue(p.Relayed))
+				case metricHandshake:
+					if !p.LastHandshake.IsZero() {
+						sample(m, labels, float64(p.LastHandshake.UnixNano())/1e9)
+					}
+				case metricRTT:
+					if p.RTT > 0 {
+						sample(m, labels, p.RTT.Seconds())
+					}
+				case metricReceiveBytes:
+					sample(m, labels, float64(p.RxBytes))
+				case metricSendBytes:
+					sample(m, labels, float64(p.TxBytes))
+				}
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labelEscaper escapes label values as required by the Prometheus text format; unlike Go quoting, other characters are
+// left as is, since they are not unescaped by Prometheus.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label pairs, escaping their values.
+func labels(pairs ...string) string {
+	formatted := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		formatted = append(formatted, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return strings.Join(formatted, ",")
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func statusValue(s health.Status) float64 {
+	switch s {
+	case health.StatusUp:
+		return 1
+	case health.StatusDown:
+		return 0
+	}
+	return -1
+}
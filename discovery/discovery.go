@@ -0,0 +1,142 @@
+// Package discovery provides ways of finding seed nodes to join a cluster.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Provider returns addresses of potential cluster members.
+// Addresses are either hostnames or IPs, optionally followed by a port.
+// Providers are queried on every join attempt, so their results may change over time.
+type Provider interface {
+	Addrs(ctx context.Context) ([]string, error)
+}
+
+// Watcher is implemented by providers which can tell when their addresses may have changed, so they can be re-queried
+// without waiting for the next join attempt.
+type Watcher interface {
+	// Watch signals on the returned channel whenever the addresses may have changed, until the context is done.
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// Static is a fixed list of addresses.
+type Static []string
+
+// Addrs implements the Provider interface.
+func (s Static) Addrs(context.Context) ([]string, error) {
+	return s, nil
+}
+
+// Providers combines the addresses of multiple providers.
+// Querying only fails if all providers fail.
+type Providers []Provider
+
+// Addrs implements the Provider interface.
+func (ps Providers) Addrs(ctx context.Context) ([]string, error) {
+	addrs := make([]string, 0)
+	errs := make([]string, 0)
+	for _, p := range ps {
+		pAddrs, err := p.Addrs(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		addrs = append(addrs, pAddrs...)
+	}
+	if len(errs) > 0 && len(errs) == len(ps) {
+		return nil, fmt.Errorf("querying seed providers: %s", strings.Join(errs, "; "))
+	}
+	return addrs, nil
+}
+
+// Watch implements the Watcher interface, signalling changes of any of the providers implementing it.
+func (ps Providers) Watch(ctx context.Context) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	for _, p := range ps {
+		w, ok := p.(Watcher)
+		if !ok {
+			continue
+		}
+		go func(pChanged <-chan struct{}) {
+			for {
+				select {
+				case <-pChanged:
+					signal(changed)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(w.Watch(ctx))
+	}
+	return changed
+}
+
+// signal notifies a buffered channel without blocking; pending signals are coalesced.
+func signal(c chan<- struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Parse creates a provider from a list of specs.
+// Each spec is either a plain address or an URL with one of the following schemes:
+//   - dns+srv://NAME: addresses and ports from the SRV records of NAME
+//   - dns+a://HOST[:PORT]: addresses from the A/AAAA records of HOST
+//   - file:///PATH: addresses from a file, one per line
+//   - http(s)://...: addresses from an endpoint returning a JSON list of strings
+//   - exec:///PATH[?arg=ARG&...]: addresses printed by a command, one per line
+func Parse(specs []string) (Provider, error) {
+	providers := make(Providers, 0, len(specs))
+	static := Static{}
+	for _, spec := range specs {
+		if !strings.Contains(spec, "://") {
+			static = append(static, spec)
+			continue
+		}
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("parsing seed provider %q: %w", spec, err)
+		}
+		p, err := parseURL(u)
+		if err != nil {
+			return nil, fmt.Errorf("seed provider %q: %w", spec, err)
+		}
+		providers = append(providers, p)
+	}
+	if len(static) > 0 {
+		providers = append(providers, static)
+	}
+	return providers, nil
+}
+
+func parseURL(u *url.URL) (Provider, error) {
+	switch u.Scheme {
+	case "dns+srv", "dns+a", "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing host")
+		}
+	case "file", "exec":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing path")
+		}
+	}
+
+	switch u.Scheme {
+	case "dns+srv":
+		return &DNSSRV{Name: u.Host}, nil
+	case "dns+a":
+		return &DNSA{Host: u.Hostname(), Port: u.Port()}, nil
+	case "file":
+		return &File{Path: u.Path}, nil
+	case "http", "https":
+		return &HTTP{URL: u.String()}, nil
+	case "exec":
+		return &Exec{Command: u.Path, Args: u.Query()["arg"]}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+}
@@ -0,0 +1,52 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Parse(t *testing.T) {
+	p, err := Parse([]string{
+		"node1",
+		"dns+srv://_wesher._udp.example.com",
+		"192.0.2.1:7946",
+		"dns+a://seeds.example.com:7947",
+		"file:///etc/wesher/seeds",
+		"https://inventory.example.com/seeds?cluster=a",
+		"exec:///usr/local/bin/seeds?arg=--cluster&arg=a",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, Providers{
+		&DNSSRV{Name: "_wesher._udp.example.com"},
+		&DNSA{Host: "seeds.example.com", Port: "7947"},
+		&File{Path: "/etc/wesher/seeds"},
+		&HTTP{URL: "https://inventory.example.com/seeds?cluster=a"},
+		&Exec{Command: "/usr/local/bin/seeds", Args: []string{"--cluster", "a"}},
+		Static{"node1", "192.0.2.1:7946"},
+	}, p)
+}
+
+func Test_Parse_invalid(t *testing.T) {
+	for _, spec := range []string{"foo://bar", "dns+srv://", "file://", "http://"} {
+		_, err := Parse([]string{spec})
+		assert.Errorf(t, err, "expected error for %q", spec)
+	}
+}
+
+type failingProvider struct{}
+
+func (failingProvider) Addrs(context.Context) ([]string, error) { return nil, errors.New("failed") }
+
+func Test_Providers_Addrs(t *testing.T) {
+	addrs, err := Providers{failingProvider{}, Static{"node1"}}.Addrs(context.Background())
+	require.NoError(t, err, "should not fail if at least one provider succeeds")
+	assert.Equal(t, []string{"node1"}, addrs)
+
+	_, err = Providers{failingProvider{}}.Addrs(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DNSSRV discovers addresses and ports via DNS SRV records, e.g. "_wesher._udp.example.com".
+type DNSSRV struct {
+	Name string
+	// Resolver is used to query DNS; defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+	// Logger is used to report targets which could not be resolved; defaults to the standard logrus logger.
+	Logger logrus.FieldLogger
+}
+
+// Addrs implements the Provider interface.
+// Targets which cannot be resolved - e.g. decommissioned nodes with stale records - are skipped; querying only fails if
+// no target can be resolved.
+func (d *DNSSRV) Addrs(ctx context.Context) ([]string, error) {
+	resolver := resolverOrDefault(d.Resolver)
+	_, srvs, err := resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up SRV records for %s: %w", d.Name, err)
+	}
+	addrs := make([]string, 0, len(srvs))
+	errs := make([]string, 0)
+	for _, srv := range srvs {
+		ips, err := resolver.LookupHost(ctx, srv.Target)
+		if err != nil {
+			d.logger().WithError(err).WithField("target", srv.Target).Debug("skipping unresolvable SRV target")
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	if len(errs) > 0 && len(errs) == len(srvs) {
+		return nil, fmt.Errorf("looking up SRV targets for %s: %s", d.Name, strings.Join(errs, "; "))
+	}
+	return addrs, nil
+}
+
+func (d *DNSSRV) logger() logrus.FieldLogger {
+	if d.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return d.Logger
+}
+
+// DNSA discovers addresses via DNS A/AAAA records.
+type DNSA struct {
+	Host string
+	// Port is optional; if not set, the cluster port is used.
+	Port string
+	// Resolver is used to query DNS; defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+// Addrs implements the Provider interface.
+func (d *DNSA) Addrs(ctx context.Context) ([]string, error) {
+	ips, err := resolverOrDefault(d.Resolver).LookupHost(ctx, d.Host)
+	if err != nil {
+		return nil, fmt.Errorf("looking up %s: %w", d.Host, err)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if d.Port != "" {
+			ip = net.JoinHostPort(ip, d.Port)
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs, nil
+}
+
+func resolverOrDefault(r *net.Resolver) *net.Resolver {
+	if r == nil {
+		return net.DefaultResolver
+	}
+	return r
+}
@@ -0,0 +1,121 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startDNS starts a local DNS stand-in serving the provided records, returning a resolver using it.
+func startDNS(t *testing.T, records []string) *net.Resolver {
+	t.Helper()
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		require.NoError(t, err)
+		rrs = append(rrs, rr)
+	}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for _, q := range req.Question {
+			for _, rr := range rrs {
+				if rr.Header().Name == q.Name && rr.Header().Rrtype == q.Qtype {
+					resp.Answer = append(resp.Answer, rr)
+				}
+			}
+		}
+		if len(resp.Answer) == 0 {
+			resp.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(resp) // nolint: errcheck
+	})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: conn, Handler: mux}
+	go server.ActivateAndServe()            // nolint: errcheck
+	t.Cleanup(func() { server.Shutdown() }) // nolint: errcheck
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func Test_DNSSRV_Addrs(t *testing.T) {
+	resolver := startDNS(t, []string{
+		"_wesher._udp.example.com. 60 IN SRV 10 10 7946 node1.example.com.",
+		"_wesher._udp.example.com. 60 IN SRV 10 10 7947 node2.example.com.",
+		"node1.example.com. 60 IN A 192.0.2.1",
+		"node2.example.com. 60 IN A 192.0.2.2",
+	})
+
+	p := &DNSSRV{Name: "_wesher._udp.example.com", Resolver: resolver}
+	addrs, err := p.Addrs(context.Background())
+	require.NoError(t, err)
+	sort.Strings(addrs)
+
+	assert.Equal(t, []string{"192.0.2.1:7946", "192.0.2.2:7947"}, addrs)
+}
+
+func Test_DNSSRV_Addrs_unresolvableTarget(t *testing.T) {
+	resolver := startDNS(t, []string{
+		"_wesher._udp.example.com. 60 IN SRV 10 10 7946 node1.example.com.",
+		"_wesher._udp.example.com. 60 IN SRV 10 10 7947 gone.example.com.",
+		"_broken._udp.example.com. 60 IN SRV 10 10 7947 gone.example.com.",
+		"node1.example.com. 60 IN A 192.0.2.1",
+	})
+
+	p := &DNSSRV{Name: "_wesher._udp.example.com", Resolver: resolver}
+	addrs, err := p.Addrs(context.Background())
+	require.NoError(t, err, "unresolvable targets should be skipped")
+	assert.Equal(t, []string{"192.0.2.1:7946"}, addrs)
+
+	_, err = (&DNSSRV{Name: "_broken._udp.example.com", Resolver: resolver}).Addrs(context.Background())
+	assert.Error(t, err, "querying should fail if no target can be resolved")
+}
+
+func Test_DNSA_Addrs(t *testing.T) {
+	resolver := startDNS(t, []string{
+		"seeds.example.com. 60 IN A 192.0.2.1",
+		"seeds.example.com. 60 IN A 192.0.2.2",
+	})
+
+	tests := []struct {
+		name string
+		port string
+		want []string
+	}{
+		{"without port", "", []string{"192.0.2.1", "192.0.2.2"}},
+		{"with port", "7947", []string{"192.0.2.1:7947", "192.0.2.2:7947"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &DNSA{Host: "seeds.example.com", Port: tt.port, Resolver: resolver}
+			addrs, err := p.Addrs(context.Background())
+			require.NoError(t, err)
+			sort.Strings(addrs)
+
+			assert.Equal(t, tt.want, addrs)
+		})
+	}
+}
+
+func Test_DNSA_Addrs_unknown(t *testing.T) {
+	resolver := startDNS(t, nil)
+
+	p := &DNSA{Host: "unknown.example.com", Resolver: resolver}
+	_, err := p.Addrs(context.Background())
+	assert.Error(t, err)
+}
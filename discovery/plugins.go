@@ -0,0 +1,143 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultFilePollInterval is how often watched seed files are checked for changes.
+const DefaultFilePollInterval = 5 * time.Second
+
+// File reads addresses from a file, one per line; empty lines and lines starting with "#" are ignored.
+// The file is re-read on every query, and can be watched to be re-queried as soon as it changes.
+type File struct {
+	Path string
+	// PollInterval is how often the file is checked for changes when watched; defaults to DefaultFilePollInterval.
+	PollInterval time.Duration
+}
+
+// Addrs implements the Provider interface.
+func (f *File) Addrs(context.Context) ([]string, error) {
+	content, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading seeds file: %w", err)
+	}
+	return parseAddrList(bytes.NewReader(content))
+}
+
+// Watch implements the Watcher interface by polling the modification time and size of the file, which - unlike
+// inotify - also works for files replaced by renaming, e.g. by configuration management tools.
+func (f *File) Watch(ctx context.Context) <-chan struct{} {
+	interval := f.PollInterval
+	if interval == 0 {
+		interval = DefaultFilePollInterval
+	}
+	changed := make(chan struct{}, 1)
+	last := f.version()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if current := f.version(); current != last {
+					last = current
+					signal(changed)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changed
+}
+
+// fileVersion tells versions of a file apart; missing files have the zero version.
+type fileVersion struct {
+	modTime int64
+	size    int64
+}
+
+func (f *File) version() fileVersion {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime().UnixNano(), size: info.Size()}
+}
+
+// HTTP fetches addresses from an endpoint returning a JSON list of strings.
+type HTTP struct {
+	URL string
+	// Client is used for the requests; defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Addrs implements the Provider interface.
+func (h *HTTP) Addrs(ctx context.Context) ([]string, error) {
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching seeds from %s: %w", h.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("fetching seeds from %s: unexpected status %s", h.URL, resp.Status)
+	}
+	addrs := []string{}
+	if err := json.NewDecoder(resp.Body).Decode(&addrs); err != nil {
+		return nil, fmt.Errorf("decoding seeds from %s: %w", h.URL, err)
+	}
+	return addrs, nil
+}
+
+// Exec runs a command printing addresses to stdout, in the same format as File.
+type Exec struct {
+	Command string
+	Args    []string
+}
+
+// Addrs implements the Provider interface.
+func (e *Exec) Addrs(ctx context.Context) ([]string, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w: %s", e.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	return parseAddrList(bytes.NewReader(out))
+}
+
+func parseAddrList(r io.Reader) ([]string, error) {
+	addrs := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading addresses: %w", err)
+	}
+	return addrs, nil
+}
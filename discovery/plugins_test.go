@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_File_Addrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds")
+	require.NoError(t, os.WriteFile(path, []byte("# seeds\n192.0.2.1\n\n  node2:7947  \n"), 0o600))
+
+	p := &File{Path: path}
+	addrs, err := p.Addrs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1", "node2:7947"}, addrs)
+
+	// changes are picked up on the next query
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.3\n"), 0o600))
+	addrs, err = p.Addrs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.3"}, addrs)
+}
+
+func Test_File_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds")
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.1\n"), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &File{Path: path, PollInterval: 10 * time.Millisecond}
+	changed := Providers{Static{"192.0.2.2"}, p}.Watch(ctx)
+
+	select {
+	case <-changed:
+		t.Fatal("unchanged file should not be signalled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.1\n192.0.2.3\n"), 0o600))
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rewritten file should be signalled")
+	}
+}
+
+func Test_HTTP_Addrs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/seeds":
+			w.Write([]byte(`["192.0.2.1", "node2:7947"]`)) // nolint: errcheck
+		case "/invalid":
+			w.Write([]byte(`{"not": "a list"}`)) // nolint: errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	addrs, err := (&HTTP{URL: server.URL + "/seeds"}).Addrs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1", "node2:7947"}, addrs)
+
+	_, err = (&HTTP{URL: server.URL + "/invalid"}).Addrs(context.Background())
+	assert.Error(t, err)
+
+	_, err = (&HTTP{URL: server.URL + "/missing"}).Addrs(context.Background())
+	assert.Error(t, err)
+}
+
+func Test_Exec_Addrs(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "seeds.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho 192.0.2.1\necho \"$1\"\n"), 0o700))
+
+	addrs, err := (&Exec{Command: script, Args: []string{"node2:7947"}}).Addrs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1", "node2:7947"}, addrs)
+
+	failing := filepath.Join(t.TempDir(), "failing.sh")
+	require.NoError(t, os.WriteFile(failing, []byte("#!/bin/sh\necho oops >&2\nexit 1\n"), 0o700))
+	_, err = (&Exec{Command: failing}).Addrs(context.Background())
+	assert.ErrorContains(t, err, "oops")
+}
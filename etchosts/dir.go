@@ -0,0 +1,94 @@
+package etchosts
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DirHostsFile is the hosts file always kept in a Dir, for bind-mounting as /etc/hosts into containers.
+const DirHostsFile = "hosts"
+
+// defaultDirHosts is the initial content of the hosts file created in a Dir.
+const defaultDirHosts = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+`
+
+// Dir keeps the hosts entries up to date in all hosts files of a directory, e.g. per-container copies of /etc/hosts.
+// Files are updated in place instead of being replaced, so they can be bind-mounted into containers; readers may
+// therefore briefly see a partially written file.
+// A DirHostsFile is created in the directory, if missing.
+type Dir struct {
+	// Path is the directory holding the hosts files.
+	Path string
+	// Banner is the magic comment used to identify managed entries; if not set, will use DefaultBanner.
+	Banner string
+	// Logger is an optional logrus.StdLogger interface, used for debugging.
+	Logger logrus.StdLogger
+}
+
+// WriteEntries writes the hosts entries to all regular files in the directory, ignoring hidden files.
+// Unmanaged lines - e.g. a container's own hostname - are preserved.
+func (d *Dir) WriteEntries(ipsToNames map[string][]string) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if err := os.MkdirAll(d.Path, 0o755); err != nil {
+		return fmt.Errorf("creating hosts directory: %w", err)
+	}
+	hostsPath := filepath.Join(d.Path, DirHostsFile)
+	if _, err := os.Lstat(hostsPath); os.IsNotExist(err) {
+		if err := os.WriteFile(hostsPath, []byte(defaultDirHosts), 0o644); err != nil {
+			return fmt.Errorf("creating %s: %w", hostsPath, err)
+		}
+	}
+
+	entries, err := os.ReadDir(d.Path)
+	if err != nil {
+		return fmt.Errorf("listing hosts directory: %w", err)
+	}
+	eh := &EtcHosts{Banner: d.Banner, Logger: d.Logger}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := eh.rewriteInPlace(filepath.Join(d.Path, entry.Name()), ipsToNames); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteInPlace updates the managed entries of a hosts file without replacing it, keeping its inode.
+func (eh *EtcHosts) rewriteInPlace(path string, ipsToNames map[string][]string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	orig, err := io.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+	updated := &bytes.Buffer{}
+	if err := eh.writeEntries(bytes.NewReader(orig), updated, ipsToNames); err != nil {
+		return err
+	}
+	if bytes.Equal(orig, updated.Bytes()) {
+		return nil
+	}
+
+	if _, err := file.WriteAt(updated.Bytes(), 0); err != nil {
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	if err := file.Truncate(int64(updated.Len())); err != nil {
+		return fmt.Errorf("could not truncate %s: %w", path, err)
+	}
+	return file.Sync()
+}
@@ -0,0 +1,46 @@
+package etchosts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDir_WriteEntries(t *testing.T) {
+	dir := t.TempDir()
+	container := filepath.Join(dir, "container")
+	require.NoError(t, os.WriteFile(container, []byte("127.0.0.1\tlocalhost\n172.17.0.2\tcontainer\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".hidden"), []byte("untouched\n"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "subdir"), 0o755))
+	before, err := os.Stat(container)
+	require.NoError(t, err)
+
+	d := &Dir{Path: dir, Banner: "# test"}
+	entries := map[string][]string{"10.0.0.2": {"peer"}}
+	require.NoError(t, d.WriteEntries(entries))
+	require.NoError(t, d.WriteEntries(entries))
+	assert.Len(t, entries, 1, "provided entries should not be modified")
+
+	content, err := os.ReadFile(container)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1\tlocalhost\n172.17.0.2\tcontainer\n10.0.0.2\tpeer\t# test\n", string(content))
+	after, err := os.Stat(container)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(before, after), "files should be updated in place, to keep bind mounts working")
+
+	content, err = os.ReadFile(filepath.Join(dir, DirHostsFile))
+	require.NoError(t, err)
+	assert.Equal(t, defaultDirHosts+"10.0.0.2\tpeer\t# test\n", string(content), "default hosts file should be created")
+
+	content, err = os.ReadFile(filepath.Join(dir, ".hidden"))
+	require.NoError(t, err)
+	assert.Equal(t, "untouched\n", string(content))
+
+	require.NoError(t, d.WriteEntries(map[string][]string{}))
+	content, err = os.ReadFile(container)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1\tlocalhost\n172.17.0.2\tcontainer\n", string(content), "removed entries should be truncated")
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -18,6 +19,9 @@ const DefaultBanner = "# ! MANAGED AUTOMATICALLY !"
 // DefaultPath is the default path used to write hosts entries
 const DefaultPath = "/etc/hosts"
 
+// writeMu serializes writes, since multiple EtcHosts instances - e.g. with different banners - may share the same file.
+var writeMu sync.Mutex
+
 // EtcHosts contains the options used to write hosts entries.
 // The zero value can be used to write to DefaultPath using DefaultBanner as a marker.
 type EtcHosts struct {
@@ -39,6 +43,9 @@ func (eh *EtcHosts) WriteEntries(ipsToNames map[string][]string) error {
 		hostsPath = DefaultPath
 	}
 
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
 	// We do not want to create the hosts file; if it's not there, we probably have the wrong path.
 	etcHosts, err := os.OpenFile(hostsPath, os.O_RDWR, 0o644)
 	if err != nil {
@@ -76,6 +83,12 @@ func (eh *EtcHosts) writeEntries(orig io.Reader, dest io.Writer, ipsToNames map[
 		banner = DefaultBanner
 	}
 
+	// entries already present are removed while updating them, so work on a copy
+	remaining := make(map[string][]string, len(ipsToNames))
+	for ip, names := range ipsToNames {
+		remaining[ip] = names
+	}
+
 	// go through file and update existing entries/prune nonexistent entries
 	scanner := bufio.NewScanner(orig)
 	for scanner.Scan() {
@@ -86,12 +99,12 @@ func (eh *EtcHosts) writeEntries(orig io.Reader, dest io.Writer, ipsToNames map[
 				continue // remove empty managed line
 			}
 			ip := tokens[0]
-			if names, ok := ipsToNames[ip]; ok {
+			if names, ok := remaining[ip]; ok {
 				err := eh.writeEntryWithBanner(dest, banner, ip, names)
 				if err != nil {
 					return err
 				}
-				delete(ipsToNames, ip) // otherwise we'll append it again below
+				delete(remaining, ip) // otherwise we'll append it again below
 			}
 		} else {
 			// keep original unmanaged line
@@ -103,7 +116,7 @@ func (eh *EtcHosts) writeEntries(orig io.Reader, dest io.Writer, ipsToNames map[
 	}
 
 	// append remaining entries to file
-	for ip, names := range ipsToNames {
+	for ip, names := range remaining {
 		if err := eh.writeEntryWithBanner(dest, banner, ip, names); err != nil {
 			return err
 		}
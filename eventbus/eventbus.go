@@ -0,0 +1,131 @@
+// Package eventbus distributes cluster events to any number of independent subscribers.
+package eventbus
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/costela/wesher/common"
+)
+
+// DefaultHistory is the default number of past events kept for new subscribers.
+const DefaultHistory = 100
+
+// DefaultBuffer is the default number of events buffered per subscriber.
+const DefaultBuffer = 100
+
+// ErrSlowSubscriber is returned by Subscription.Err when a subscription was closed because it did not keep up with
+// the published events.
+var ErrSlowSubscriber = errors.New("subscriber too slow; events were dropped")
+
+// Bus publishes events to its subscribers without ever blocking.
+// Subscribers not keeping up are disconnected instead of silently missing events.
+// The zero value is ready to use.
+type Bus struct {
+	// History is the number of past events kept for new subscribers; defaults to DefaultHistory.
+	History int
+
+	mu      sync.Mutex
+	subs    map[*Subscription]struct{}
+	history []common.Event
+}
+
+// Subscription receives events published after it was created.
+type Subscription struct {
+	// C receives the events; it is closed when the subscription ends.
+	C <-chan common.Event
+
+	c   chan common.Event
+	bus *Bus
+	err error
+}
+
+// Publish sends the provided events to all subscribers.
+// It is safe to call on a nil Bus.
+func (b *Bus) Publish(events ...common.Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	history := b.History
+	if history == 0 {
+		history = DefaultHistory
+	}
+	b.history = append(b.history, events...)
+	if len(b.history) > history {
+		b.history = append([]common.Event(nil), b.history[len(b.history)-history:]...)
+	}
+
+	for sub := range b.subs {
+		for _, e := range events {
+			select {
+			case sub.c <- e:
+			default:
+				b.closeLocked(sub, ErrSlowSubscriber)
+			}
+			if sub.err != nil {
+				break
+			}
+		}
+	}
+}
+
+// Subscribe returns a new subscription buffering up to the provided number of events; if zero, DefaultBuffer is used.
+// If replay is set, the subscription first receives the recent history, as far as it fits into the buffer.
+func (b *Bus) Subscribe(buffer int, replay bool) *Subscription {
+	if buffer == 0 {
+		buffer = DefaultBuffer
+	}
+	c := make(chan common.Event, buffer)
+	sub := &Subscription{C: c, c: c, bus: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if replay {
+		history := b.history
+		if len(history) > buffer {
+			history = history[len(history)-buffer:]
+		}
+		for _, e := range history {
+			c <- e
+		}
+	}
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// Recent returns the recent history of events.
+func (b *Bus) Recent() []common.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]common.Event(nil), b.history...)
+}
+
+// Close ends the subscription, closing its channel.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.closeLocked(s, nil)
+}
+
+// Err returns why the subscription was closed by the bus, if at all.
+// It must only be called after C was closed.
+func (s *Subscription) Err() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.err
+}
+
+func (b *Bus) closeLocked(sub *Subscription, err error) {
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	sub.err = err
+	close(sub.c)
+}
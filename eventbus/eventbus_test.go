@@ -0,0 +1,64 @@
+package eventbus
+
+import (
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Bus_Publish(t *testing.T) {
+	b := &Bus{}
+	sub1 := b.Subscribe(10, false)
+	sub2 := b.Subscribe(10, false)
+
+	b.Publish(common.Event{Node: "a"}, common.Event{Node: "b"})
+
+	for _, sub := range []*Subscription{sub1, sub2} {
+		assert.Equal(t, "a", (<-sub.C).Node)
+		assert.Equal(t, "b", (<-sub.C).Node)
+	}
+}
+
+func Test_Bus_Subscribe_replay(t *testing.T) {
+	b := &Bus{History: 2}
+	b.Publish(common.Event{Node: "a"}, common.Event{Node: "b"}, common.Event{Node: "c"})
+
+	sub := b.Subscribe(10, true)
+	b.Publish(common.Event{Node: "d"})
+
+	received := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		received = append(received, (<-sub.C).Node)
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, received)
+}
+
+func Test_Bus_slowSubscriber(t *testing.T) {
+	b := &Bus{}
+	slow := b.Subscribe(1, false)
+	fast := b.Subscribe(10, false)
+
+	// must not block, even though the slow subscriber is not consuming
+	b.Publish(common.Event{Node: "a"}, common.Event{Node: "b"})
+
+	assert.Equal(t, "a", (<-slow.C).Node)
+	_, ok := <-slow.C
+	assert.False(t, ok, "slow subscriber should be disconnected")
+	assert.ErrorIs(t, slow.Err(), ErrSlowSubscriber)
+
+	assert.Len(t, fast.C, 2, "other subscribers should not be affected")
+}
+
+func Test_Subscription_Close(t *testing.T) {
+	b := &Bus{}
+	sub := b.Subscribe(0, false)
+
+	sub.Close()
+	sub.Close() // must be idempotent
+	b.Publish(common.Event{})
+
+	_, ok := <-sub.C
+	assert.False(t, ok)
+	assert.NoError(t, sub.Err())
+}
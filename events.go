@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/costela/wesher/control"
+)
+
+type EventsCmd struct {
+	Follow bool `short:"f" help:"keep streaming new events until interrupted"`
+}
+
+func (e *EventsCmd) Run(cli *cli) error {
+	url := "http://wesher/events"
+	if e.Follow {
+		url += "?follow=true"
+	}
+	resp, err := control.Client(cli.ControlSocket).Get(url)
+	if err != nil {
+		return fmt.Errorf("could not contact agent: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from agent: %s", resp.Status)
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
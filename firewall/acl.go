@@ -0,0 +1,90 @@
+package firewall
+
+import (
+	"encoding"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/costela/wesher/wg"
+)
+
+// ACL allows nodes matching one selector to reach nodes matching the other selector over the overlay network, on the
+// provided ports.
+// Nodes targeted by any ACL only accept the overlay traffic allowed by ACLs, besides replies, ICMP and health probes.
+type ACL struct {
+	From, To wg.Selector
+	Protocol Protocol
+	Ports    PortRange
+}
+
+var _ encoding.TextUnmarshaler = (*ACL)(nil)
+
+// UnmarshalText parses an ACL in the "FROM:TO:PORT[-PORT][/PROTO]" format; the protocol defaults to TCP.
+func (a *ACL) UnmarshalText(in []byte) error {
+	parts := strings.Split(string(in), ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid ACL %q: expected FROM:TO:PORT[-PORT][/PROTO]", in)
+	}
+	if err := a.From.UnmarshalText([]byte(parts[0])); err != nil {
+		return err
+	}
+	if err := a.To.UnmarshalText([]byte(parts[1])); err != nil {
+		return err
+	}
+	ports, proto, ok := strings.Cut(parts[2], "/")
+	a.Protocol = TCP
+	if ok {
+		a.Protocol = Protocol(strings.ToLower(proto))
+	}
+	if _, err := a.Protocol.number(); err != nil {
+		return fmt.Errorf("invalid ACL %q: %w", in, err)
+	}
+	var err error
+	a.Ports, err = ParsePortRange(ports)
+	if err != nil {
+		return fmt.Errorf("invalid ACL %q: %w", in, err)
+	}
+	return nil
+}
+
+func (a ACL) String() string {
+	return fmt.Sprintf("%s:%s:%s/%s", a.From, a.To, a.Ports, a.Protocol)
+}
+
+// ParsePortRange parses a single port or an inclusive "FROM-TO" range of ports.
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		to = from
+	}
+	fromPort, err := strconv.ParseUint(from, 10, 16)
+	if err != nil || fromPort == 0 {
+		return PortRange{}, fmt.Errorf("invalid port %q", from)
+	}
+	toPort, err := strconv.ParseUint(to, 10, 16)
+	if err != nil || toPort == 0 {
+		return PortRange{}, fmt.Errorf("invalid port %q", to)
+	}
+	if toPort < fromPort {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{From: uint16(fromPort), To: uint16(toPort)}, nil
+}
+
+func (p PortRange) String() string {
+	if p.From == p.To {
+		return strconv.Itoa(int(p.From))
+	}
+	return fmt.Sprintf("%d-%d", p.From, p.To)
+}
+
+// Rule returns the policy rule equivalent to the ACL.
+func (a ACL) Rule() PolicyRule {
+	return PolicyRule{
+		From:     []Target{{selector: a.From}},
+		To:       []Target{{selector: a.To}},
+		Protocol: a.Protocol,
+		Ports:    []PortRange{a.Ports},
+	}
+}
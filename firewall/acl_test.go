@@ -0,0 +1,74 @@
+package firewall
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ACL_UnmarshalText(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "role=web:role=db:5432", want: "role=web:role=db:5432/tcp"},
+		{in: "edge-*:dns:53/UDP", want: "edge-*:dns:53/udp"},
+		{in: "a:b:8000-8080/tcp", want: "a:b:8000-8080/tcp"},
+		{in: "a:b", wantErr: true},
+		{in: "a:b:c:80", wantErr: true},
+		{in: ":b:80", wantErr: true},
+		{in: "a:b:0", wantErr: true},
+		{in: "a:b:70000", wantErr: true},
+		{in: "a:b:90-80", wantErr: true},
+		{in: "a:b:80/sctp", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			acl := ACL{}
+			err := acl.UnmarshalText([]byte(tt.in))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, acl.String())
+		})
+	}
+}
+
+func Test_ACL_Rule(t *testing.T) {
+	parse := func(s string) ACL {
+		acl := ACL{}
+		require.NoError(t, acl.UnmarshalText([]byte(s)))
+		return acl
+	}
+	node := func(name, role, overlay string) common.Node {
+		n := common.Node{Name: name}
+		n.Labels = map[string]string{"role": role}
+		n.OverlayAddr = netip.MustParseAddr(overlay)
+		return n
+	}
+	nodes := []common.Node{
+		node("web2", "web", "10.0.0.3"),
+		node("web1", "web", "10.0.0.2"),
+		node("db", "db", "10.0.0.1"),
+		node("cache", "cache", "10.0.0.4"),
+	}
+	policy := Policy{Rules: []PolicyRule{parse("role=web:role=db:5432").Rule(), parse("role=web:role=cache:6379").Rule()}}
+
+	allows, targeted := policy.Compile(&nodes[2], nodes)
+	assert.True(t, targeted)
+	assert.Equal(t, []Allow{{
+		Sources:  []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32"), netip.MustParsePrefix("10.0.0.3/32")},
+		Protocol: TCP,
+		Ports:    PortRange{From: 5432, To: 5432},
+	}}, allows)
+
+	allows, targeted = policy.Compile(&nodes[0], nodes)
+	assert.False(t, targeted, "nodes not targeted by any ACL should not be filtered")
+	assert.Empty(t, allows)
+}
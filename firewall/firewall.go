@@ -0,0 +1,154 @@
+// Package firewall manages nftables rules restricting the ports used by wesher to cluster members and filtering the
+// traffic nodes may send each other over the overlay network.
+package firewall
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+
+	"github.com/costela/wesher/common"
+	"github.com/google/nftables"
+	"github.com/sirupsen/logrus"
+)
+
+// Protocol is a transport protocol allowed by overlay rules.
+type Protocol string
+
+const (
+	// TCP matches TCP traffic.
+	TCP Protocol = "tcp"
+	// UDP matches UDP traffic.
+	UDP Protocol = "udp"
+	// Any matches traffic of any protocol.
+	Any Protocol = "any"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To uint16
+}
+
+// Allow accepts traffic from the provided sources to the provided ports, over the overlay network.
+// Ports are ignored for the Any protocol.
+type Allow struct {
+	Sources  []netip.Prefix
+	Protocol Protocol
+	Ports    PortRange
+}
+
+// Ruleset is the desired firewall configuration of a network.
+type Ruleset struct {
+	// Interface is the wireguard interface of the network.
+	Interface string
+	// WireguardPort is the port of the wireguard interface (UDP).
+	WireguardPort int
+	// ClusterPort is the port used for membership gossip (TCP and UDP).
+	ClusterPort int
+	// Members are the underlay addresses allowed to reach the wireguard and cluster ports; besides the current members,
+	// they should include nodes which may rejoin, e.g. after failing.
+	Members []netip.Addr
+	// JoinFrom are additional networks allowed to reach the wireguard and cluster ports, e.g. for new nodes to join
+	// through this node, or for nodes behind NAT whose public address is not known yet.
+	JoinFrom []netip.Prefix
+	// FilterOverlay enables filtering of the traffic received over the overlay network: only replies, ICMP, probes on
+	// ProbePort and traffic matching Allow are accepted.
+	FilterOverlay bool
+	// ProbePort is the port of UDP health probes, if any.
+	ProbePort int
+	// Allow are the rules accepting traffic over the overlay network, if filtered.
+	Allow []Allow
+}
+
+// MemberAddrs returns the underlay addresses the provided nodes may send wireguard and cluster traffic from, together
+// with the addresses of the provided observed endpoints, sorted and without duplicates.
+func MemberAddrs(nodes []common.Node, observed ...netip.AddrPort) []netip.Addr {
+	seen := make(map[netip.Addr]struct{}, len(nodes))
+	add := func(addr netip.Addr) {
+		if addr.IsValid() {
+			seen[addr.Unmap()] = struct{}{}
+		}
+	}
+	for _, node := range nodes {
+		if addr, ok := netip.AddrFromSlice(node.Addr); ok {
+			add(addr)
+		}
+		// nodes behind NAT send from their public address
+		add(node.PublicEndpoint.Addr())
+		if host, _, err := net.SplitHostPort(node.Endpoint); err == nil {
+			if addr, err := netip.ParseAddr(host); err == nil {
+				add(addr)
+			}
+		}
+	}
+	for _, endpoint := range observed {
+		add(endpoint.Addr())
+	}
+	addrs := make([]netip.Addr, 0, len(seen))
+	for addr := range seen {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	return addrs
+}
+
+// Firewall applies rulesets to a dedicated nftables table, replacing it atomically on every change.
+type Firewall struct {
+	// Table is the name of the managed table, in the inet family.
+	Table string
+	// Logger is used to log changes; defaults to the standard logrus logger.
+	Logger logrus.FieldLogger
+
+	applied *Ruleset
+	// dial opens the nftables connection; overridden in tests
+	dial func() (*nftables.Conn, error)
+}
+
+// Apply replaces the managed table with the provided ruleset, unless it is unchanged since the last call.
+func (f *Firewall) Apply(r Ruleset) error {
+	if f.applied != nil && reflect.DeepEqual(*f.applied, r) {
+		return nil
+	}
+	conn, err := f.conn()
+	if err != nil {
+		return err
+	}
+	if err := build(conn, f.Table, r); err != nil {
+		return err
+	}
+	f.applied = &r
+	f.logger().WithField("members", len(r.Members)).Debug("firewall rules updated")
+	return nil
+}
+
+// Remove deletes the managed table, if it was applied.
+func (f *Firewall) Remove() error {
+	if f.applied == nil {
+		return nil
+	}
+	conn, err := f.conn()
+	if err != nil {
+		return err
+	}
+	conn.DelTable(&nftables.Table{Name: f.Table, Family: nftables.TableFamilyINet})
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	f.applied = nil
+	return nil
+}
+
+func (f *Firewall) conn() (*nftables.Conn, error) {
+	if f.dial != nil {
+		return f.dial()
+	}
+	return nftables.New()
+}
+
+func (f *Firewall) logger() logrus.FieldLogger {
+	if f.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return f.Logger
+}
@@ -0,0 +1,109 @@
+package firewall
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// recordingFirewall returns a firewall counting the nftables messages it sends, by type.
+func recordingFirewall() (*Firewall, map[int]int) {
+	sent := map[int]int{}
+	return &Firewall{
+		Table: "wesher-test",
+		dial: func() (*nftables.Conn, error) {
+			return nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+				for _, msg := range req {
+					if msg.Header.Type>>8 == unix.NFNL_SUBSYS_NFTABLES {
+						sent[int(msg.Header.Type&0xff)]++
+					}
+				}
+				return req, nil
+			}))
+		},
+	}, sent
+}
+
+func Test_Firewall_Apply(t *testing.T) {
+	fw, sent := recordingFirewall()
+	ruleset := Ruleset{
+		Interface:     "wgoverlay",
+		WireguardPort: 51820,
+		ClusterPort:   7946,
+		Members:       []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+		JoinFrom:      []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+	}
+
+	require.NoError(t, fw.Apply(ruleset))
+	assert.Equal(t, 2, sent[unix.NFT_MSG_NEWTABLE])
+	assert.Equal(t, 1, sent[unix.NFT_MSG_DELTABLE], "the table should be replaced")
+	assert.Equal(t, 2, sent[unix.NFT_MSG_NEWSET])
+	assert.Equal(t, 1, sent[unix.NFT_MSG_NEWCHAIN])
+	// 3 ports, each accepted from 2 sets and the join network, and dropped otherwise
+	assert.Equal(t, 3*4, sent[unix.NFT_MSG_NEWRULE])
+
+	require.NoError(t, fw.Apply(ruleset))
+	assert.Equal(t, 2, sent[unix.NFT_MSG_NEWTABLE], "unchanged rulesets should not be re-applied")
+
+	ruleset.FilterOverlay = true
+	ruleset.ProbePort = 7947
+	ruleset.Allow = []Allow{{
+		Sources:  []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32"), netip.MustParsePrefix("10.0.0.2/32")},
+		Protocol: TCP,
+		Ports:    PortRange{From: 5432, To: 5432},
+	}}
+	for k := range sent {
+		delete(sent, k)
+	}
+	require.NoError(t, fw.Apply(ruleset))
+	assert.Equal(t, 2, sent[unix.NFT_MSG_NEWCHAIN])
+	// jump, established, 2x icmp, probes, 2 sources and the final drop
+	assert.Equal(t, 3*4+8, sent[unix.NFT_MSG_NEWRULE])
+
+	require.NoError(t, fw.Remove())
+	assert.Equal(t, 2, sent[unix.NFT_MSG_DELTABLE])
+	require.NoError(t, fw.Remove())
+	assert.Equal(t, 2, sent[unix.NFT_MSG_DELTABLE], "removing twice should be a no-op")
+}
+
+func Test_Firewall_Apply_invalidProtocol(t *testing.T) {
+	fw, _ := recordingFirewall()
+	err := fw.Apply(Ruleset{
+		FilterOverlay: true,
+		Allow:         []Allow{{Sources: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}, Protocol: "sctp"}},
+	})
+	assert.Error(t, err)
+	assert.NoError(t, fw.Remove(), "failed rulesets should not be considered applied")
+}
+
+func Test_MemberAddrs(t *testing.T) {
+	nodes := []common.Node{
+		{Name: "a", Addr: net.ParseIP("192.0.2.2")},
+		{Name: "b", Addr: net.ParseIP("192.0.2.1")},
+		{Name: "c", Addr: net.ParseIP("192.0.2.1")},
+		{Name: "nat", Addr: net.ParseIP("10.1.1.1")},
+		{Name: "forwarded", Addr: net.ParseIP("2001:db8::1")},
+	}
+	nodes[3].PublicEndpoint = netip.MustParseAddrPort("198.51.100.1:51820")
+	nodes[4].Endpoint = "203.0.113.1:1234"
+
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("10.1.1.1"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("198.51.100.1"),
+		netip.MustParseAddr("203.0.113.1"),
+		netip.MustParseAddr("2001:db8::1"),
+	}, MemberAddrs(nodes))
+
+	observed := []netip.AddrPort{netip.MustParseAddrPort("198.51.100.1:51820"), netip.MustParseAddrPort("198.51.100.9:4321")}
+	assert.Contains(t, MemberAddrs(nodes, observed...), netip.MustParseAddr("198.51.100.9"), "observed endpoints should be allowed")
+	assert.Len(t, MemberAddrs(nodes, observed...), 7)
+}
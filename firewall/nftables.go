@@ -0,0 +1,201 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// build queues the commands replacing the table with the provided ruleset and sends them in a single batch, so the
+// ruleset is applied atomically.
+func build(conn *nftables.Conn, name string, r Ruleset) error {
+	table := &nftables.Table{Name: name, Family: nftables.TableFamilyINet}
+	// adding is a no-op for existing tables, so the table can always be deleted and recreated empty
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+
+	members4 := &nftables.Set{Table: table, Name: "members4", KeyType: nftables.TypeIPAddr}
+	members6 := &nftables.Set{Table: table, Name: "members6", KeyType: nftables.TypeIP6Addr}
+	elems4, elems6 := []nftables.SetElement{}, []nftables.SetElement{}
+	for _, addr := range r.Members {
+		if addr.Is4() {
+			elems4 = append(elems4, nftables.SetElement{Key: addr.AsSlice()})
+		} else {
+			elems6 = append(elems6, nftables.SetElement{Key: addr.AsSlice()})
+		}
+	}
+	if err := conn.AddSet(members4, elems4); err != nil {
+		return fmt.Errorf("adding members set: %w", err)
+	}
+	if err := conn.AddSet(members6, elems6); err != nil {
+		return fmt.Errorf("adding members set: %w", err)
+	}
+
+	policy := nftables.ChainPolicyAccept
+	input := conn.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	rule := func(chain *nftables.Chain, exprs ...[]expr.Any) {
+		all := []expr.Any{}
+		for _, e := range exprs {
+			all = append(all, e...)
+		}
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: all})
+	}
+
+	// the wireguard and cluster ports are only open to members and the networks allowed to join
+	ports := []struct {
+		proto byte
+		port  int
+	}{
+		{unix.IPPROTO_UDP, r.WireguardPort},
+		{unix.IPPROTO_TCP, r.ClusterPort},
+		{unix.IPPROTO_UDP, r.ClusterPort},
+	}
+	for _, p := range ports {
+		dport := matchPorts(p.proto, PortRange{From: uint16(p.port), To: uint16(p.port)})
+		rule(input, matchSaddrSet(members4, false), dport, verdict(expr.VerdictAccept))
+		rule(input, matchSaddrSet(members6, true), dport, verdict(expr.VerdictAccept))
+		// nodes joining behind NAT handshake from a public address nobody has observed yet
+		for _, prefix := range r.JoinFrom {
+			rule(input, matchSaddrPrefix(prefix), dport, verdict(expr.VerdictAccept))
+		}
+		rule(input, dport, verdict(expr.VerdictDrop))
+	}
+
+	if !r.FilterOverlay {
+		return conn.Flush()
+	}
+
+	// traffic received over the overlay is only accepted if explicitly allowed
+	overlay := conn.AddChain(&nftables.Chain{Name: "overlay", Table: table})
+	rule(input, matchIface(r.Interface), []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: overlay.Name}})
+	rule(overlay, matchEstablished(), verdict(expr.VerdictAccept))
+	rule(overlay, matchL4Proto(unix.IPPROTO_ICMP), verdict(expr.VerdictAccept))
+	rule(overlay, matchL4Proto(unix.IPPROTO_ICMPV6), verdict(expr.VerdictAccept))
+	if r.ProbePort != 0 {
+		rule(overlay, matchPorts(unix.IPPROTO_UDP, PortRange{From: uint16(r.ProbePort), To: uint16(r.ProbePort)}), verdict(expr.VerdictAccept))
+	}
+	for _, allow := range r.Allow {
+		if allow.Protocol == Any {
+			for _, source := range allow.Sources {
+				rule(overlay, matchSaddrPrefix(source), verdict(expr.VerdictAccept))
+			}
+			continue
+		}
+		proto, err := allow.Protocol.number()
+		if err != nil {
+			return err
+		}
+		for _, source := range allow.Sources {
+			rule(overlay, matchSaddrPrefix(source), matchPorts(proto, allow.Ports), verdict(expr.VerdictAccept))
+		}
+	}
+	rule(overlay, verdict(expr.VerdictDrop))
+
+	return conn.Flush()
+}
+
+func (p Protocol) number() (byte, error) {
+	switch p {
+	case TCP:
+		return unix.IPPROTO_TCP, nil
+	case UDP:
+		return unix.IPPROTO_UDP, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol %q", p)
+	}
+}
+
+func verdict(kind expr.VerdictKind) []expr.Any {
+	return []expr.Any{&expr.Verdict{Kind: kind}}
+}
+
+func matchIface(name string) []expr.Any {
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, name)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname},
+	}
+}
+
+func matchEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func matchL4Proto(proto byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+func matchPorts(proto byte, ports PortRange) []expr.Any {
+	exprs := append(matchL4Proto(proto),
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+	)
+	if ports.From == ports.To {
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(ports.From)})
+	}
+	return append(exprs, &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		FromData: binaryutil.BigEndian.PutUint16(ports.From),
+		ToData:   binaryutil.BigEndian.PutUint16(ports.To),
+	})
+}
+
+// loadSaddr loads the source address of packets of the given IP version into the first register.
+func loadSaddr(v6 bool) []expr.Any {
+	family, offset, length := byte(unix.NFPROTO_IPV4), uint32(12), uint32(4)
+	if v6 {
+		family, offset, length = unix.NFPROTO_IPV6, 8, 16
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+	}
+}
+
+func matchSaddrSet(set *nftables.Set, v6 bool) []expr.Any {
+	return append(loadSaddr(v6), &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID})
+}
+
+func matchSaddrPrefix(prefix netip.Prefix) []expr.Any {
+	prefix = prefix.Masked()
+	addr := prefix.Addr().AsSlice()
+	mask := net.CIDRMask(prefix.Bits(), len(addr)*8)
+	return append(loadSaddr(prefix.Addr().Is6()),
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(addr)),
+			Mask:           mask,
+			Xor:            make([]byte, len(addr)),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+	)
+}
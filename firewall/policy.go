@@ -0,0 +1,200 @@
+package firewall
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/wg"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is a set of rules allowing traffic between nodes over the overlay network.
+// Nodes targeted by any rule only accept the overlay traffic allowed by the rules, besides replies, ICMP and health
+// probes; nodes not targeted by any rule are not filtered.
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule allows traffic from any of the From targets to any of the To targets.
+type PolicyRule struct {
+	From []Target `yaml:"from"`
+	To   []Target `yaml:"to"`
+	// Protocol is the allowed protocol; defaults to TCP.
+	Protocol Protocol `yaml:"protocol"`
+	// Ports are the allowed ports; all ports are allowed if empty. Must be empty for the "any" protocol.
+	Ports []PortRange `yaml:"ports"`
+}
+
+// Target selects nodes either by label, name glob or overlay address prefix.
+type Target struct {
+	selector wg.Selector
+	prefix   netip.Prefix
+}
+
+var _ encoding.TextUnmarshaler = (*Target)(nil)
+
+// UnmarshalText parses a target in the "key=value" label, name glob or CIDR/IP address format.
+func (t *Target) UnmarshalText(in []byte) error {
+	text := strings.TrimSpace(string(in))
+	if prefix, err := netip.ParsePrefix(text); err == nil {
+		*t = Target{prefix: prefix.Masked()}
+		return nil
+	}
+	if addr, err := netip.ParseAddr(text); err == nil {
+		*t = Target{prefix: netip.PrefixFrom(addr, addr.BitLen())}
+		return nil
+	}
+	*t = Target{}
+	return t.selector.UnmarshalText([]byte(text))
+}
+
+// Matches returns whether the given node is selected, either directly or by its overlay address.
+func (t Target) Matches(node *common.Node) bool {
+	if t.prefix.IsValid() {
+		return node.OverlayAddr.IsValid() && t.prefix.Contains(node.OverlayAddr)
+	}
+	return t.selector.Matches(node)
+}
+
+func (t Target) String() string {
+	if t.prefix.IsValid() {
+		return t.prefix.String()
+	}
+	return t.selector.String()
+}
+
+var _ encoding.TextUnmarshaler = (*PortRange)(nil)
+
+// UnmarshalText parses a port range in the format accepted by ParsePortRange.
+func (p *PortRange) UnmarshalText(in []byte) error {
+	var err error
+	*p, err = ParsePortRange(string(in))
+	return err
+}
+
+// LoadPolicy reads and validates the policy file at the provided path.
+func LoadPolicy(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy file: %w", err)
+	}
+	policy, err := ParsePolicy(content)
+	if err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// ParsePolicy parses and validates a policy in YAML format; unknown settings are rejected, to catch typos.
+func ParsePolicy(content []byte) (*Policy, error) {
+	policy := &Policy{}
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	if err := dec.Decode(policy); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing policy: %w", err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks the rules are complete and consistent, setting the default protocol where needed.
+func (p *Policy) Validate() error {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.From) == 0 || len(rule.To) == 0 {
+			return fmt.Errorf("rule %d: both from and to must be set", i+1)
+		}
+		if rule.Protocol == "" {
+			rule.Protocol = TCP
+		}
+		rule.Protocol = Protocol(strings.ToLower(string(rule.Protocol)))
+		switch rule.Protocol {
+		case TCP, UDP:
+		case Any:
+			if len(rule.Ports) > 0 {
+				return fmt.Errorf("rule %d: ports cannot be set for protocol %s", i+1, Any)
+			}
+		default:
+			return fmt.Errorf("rule %d: unsupported protocol %q", i+1, rule.Protocol)
+		}
+	}
+	return nil
+}
+
+// Compile returns the rules accepting the overlay traffic the policy allows to the local node, and whether the local
+// node is targeted by any rule at all, in which case all other overlay traffic should be dropped.
+func (p *Policy) Compile(local *common.Node, nodes []common.Node) ([]Allow, bool) {
+	allows := make([]Allow, 0)
+	targeted := false
+	for _, rule := range p.Rules {
+		if !matchesAny(rule.To, local) {
+			continue
+		}
+		targeted = true
+
+		sources := make([]netip.Prefix, 0)
+		for _, from := range rule.From {
+			if from.prefix.IsValid() {
+				sources = append(sources, from.prefix)
+			}
+		}
+		for i := range nodes {
+			if nodes[i].Name == local.Name || !nodes[i].OverlayAddr.IsValid() || !matchesAny(rule.From, &nodes[i]) {
+				continue
+			}
+			addr := nodes[i].OverlayAddr
+			sources = append(sources, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+		sources = dedupPrefixes(sources)
+
+		ports := rule.Ports
+		if len(ports) == 0 {
+			ports = []PortRange{{From: 1, To: 65535}}
+		}
+		if rule.Protocol == Any {
+			ports = []PortRange{{}}
+		}
+		for _, portRange := range ports {
+			allows = append(allows, Allow{Sources: sources, Protocol: rule.Protocol, Ports: portRange})
+		}
+	}
+	return allows, targeted
+}
+
+func matchesAny(targets []Target, node *common.Node) bool {
+	for _, t := range targets {
+		if t.Matches(node) {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupPrefixes sorts the provided prefixes and removes duplicates, so compiled rules are stable.
+func dedupPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sort.Slice(prefixes, func(i, j int) bool {
+		a, b := prefixes[i], prefixes[j]
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+	deduped := prefixes[:0]
+	for _, prefix := range prefixes {
+		if len(deduped) > 0 && prefix == deduped[len(deduped)-1] {
+			continue
+		}
+		deduped = append(deduped, prefix)
+	}
+	return deduped
+}
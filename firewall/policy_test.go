@@ -0,0 +1,104 @@
+package firewall
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `
+rules:
+  - from: [role=web, 10.1.0.0/16]
+    to: [role=db]
+    ports: [5432, 8000-8080]
+  - from: [monitoring]
+    to: [10.0.0.0/24]
+    protocol: any
+  - from: [role=web]
+    to: [dns-*]
+    protocol: UDP
+`
+
+func Test_ParsePolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+	require.Len(t, policy.Rules, 3)
+	assert.Equal(t, TCP, policy.Rules[0].Protocol, "protocol should default to TCP")
+	assert.Equal(t, []PortRange{{From: 5432, To: 5432}, {From: 8000, To: 8080}}, policy.Rules[0].Ports)
+	assert.Equal(t, "10.1.0.0/16", policy.Rules[0].From[1].String())
+	assert.Equal(t, UDP, policy.Rules[2].Protocol)
+
+	empty, err := ParsePolicy([]byte{})
+	require.NoError(t, err)
+	assert.Empty(t, empty.Rules)
+}
+
+func Test_ParsePolicy_invalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown setting":   "rules:\n  - from: [a]\n    to: [b]\n    port: [80]\n",
+		"missing to":        "rules:\n  - from: [a]\n",
+		"invalid port":      "rules:\n  - from: [a]\n    to: [b]\n    ports: [http]\n",
+		"invalid protocol":  "rules:\n  - from: [a]\n    to: [b]\n    protocol: sctp\n",
+		"ports for any":     "rules:\n  - from: [a]\n    to: [b]\n    protocol: any\n    ports: [80]\n",
+		"invalid selector":  "rules:\n  - from: ['[']\n    to: [b]\n",
+		"invalid structure": "rules: yes\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParsePolicy([]byte(content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_LoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testPolicy), 0o600))
+	policy, err := LoadPolicy(path)
+	require.NoError(t, err)
+	assert.Len(t, policy.Rules, 3)
+
+	_, err = LoadPolicy(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func Test_Policy_Compile(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+	node := func(name, role, overlay string) common.Node {
+		n := common.Node{Name: name}
+		n.Labels = map[string]string{"role": role}
+		n.OverlayAddr = netip.MustParseAddr(overlay)
+		return n
+	}
+	nodes := []common.Node{
+		node("db", "db", "10.0.0.1"),
+		node("web", "web", "10.0.1.1"),
+		node("monitoring", "ops", "10.0.2.1"),
+		node("dns-1", "dns", "10.0.3.1"),
+	}
+
+	allows, targeted := policy.Compile(&nodes[0], nodes)
+	assert.True(t, targeted)
+	webSources := []netip.Prefix{netip.MustParsePrefix("10.0.1.1/32"), netip.MustParsePrefix("10.1.0.0/16")}
+	assert.Equal(t, []Allow{
+		{Sources: webSources, Protocol: TCP, Ports: PortRange{From: 5432, To: 5432}},
+		{Sources: webSources, Protocol: TCP, Ports: PortRange{From: 8000, To: 8080}},
+		{Sources: []netip.Prefix{netip.MustParsePrefix("10.0.2.1/32")}, Protocol: Any},
+	}, allows, "db should be reachable from web and - by its overlay address - from monitoring")
+
+	allows, targeted = policy.Compile(&nodes[3], nodes)
+	assert.True(t, targeted)
+	assert.Equal(t, []Allow{
+		{Sources: []netip.Prefix{netip.MustParsePrefix("10.0.1.1/32")}, Protocol: UDP, Ports: PortRange{From: 1, To: 65535}},
+	}, allows, "rules without ports should allow all ports")
+
+	allows, targeted = policy.Compile(&nodes[1], nodes)
+	assert.False(t, targeted)
+	assert.Empty(t, allows)
+}
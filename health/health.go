@@ -0,0 +1,242 @@
+// Package health checks whether the wireguard tunnels to peers actually work, as opposed to the peers merely being
+// alive on the underlay network.
+package health
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/costela/wesher/wg"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultInterval is the default interval between probes.
+const DefaultInterval = 10 * time.Second
+
+// DefaultTimeout is the default time to wait for a probe reply.
+const DefaultTimeout = 2 * time.Second
+
+// maxConcurrentProbes limits how many peers are probed at the same time.
+const maxConcurrentProbes = 16
+
+// Status is the health of a tunnel to a peer.
+type Status string
+
+const (
+	// StatusUnknown means there is not enough information to decide, e.g. for idle peers without probes.
+	StatusUnknown Status = "unknown"
+	// StatusUp means the tunnel recently carried traffic.
+	StatusUp Status = "up"
+	// StatusDown means the tunnel failed to carry traffic.
+	StatusDown Status = "down"
+)
+
+// Prober actively checks whether a peer can be reached over its overlay address.
+type Prober interface {
+	Probe(ctx context.Context, addr netip.Addr) (time.Duration, error)
+}
+
+// PeerHealth is the health of the tunnel to a single peer.
+type PeerHealth struct {
+	Node     string `json:"node"`
+	Overlay  string `json:"overlay"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Status   Status `json:"status"`
+	// Since is when the status last changed.
+	Since         time.Time `json:"since"`
+	LastHandshake time.Time `json:"last_handshake"`
+	// RTT is the round-trip time of the last successful probe.
+	RTT     time.Duration `json:"rtt,omitempty"`
+	RxBytes int64         `json:"rx_bytes"`
+	TxBytes int64         `json:"tx_bytes"`
+	Relayed bool          `json:"relayed,omitempty"`
+	// PresharedKey is whether a preshared key is configured for the peer.
+	PresharedKey bool `json:"preshared_key,omitempty"`
+}
+
+// Checker keeps track of the health of the tunnels to all peers.
+// Without a Prober, the health is derived from wireguard handshakes only, which cannot tell idle peers apart from
+// unreachable ones, unless they are kept alive.
+type Checker struct {
+	// Prober is used to actively probe peers; if nil, only handshakes are considered.
+	Prober Prober
+	// Interval is the time between probes; defaults to DefaultInterval.
+	Interval time.Duration
+	// Timeout is the time to wait for a probe reply; defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Logger is used to log status changes; defaults to the standard logrus logger.
+	Logger logrus.FieldLogger
+
+	mu    sync.Mutex
+	peers map[string]*peer
+}
+
+type peer struct {
+	stats     wg.PeerStats
+	status    Status
+	since     time.Time
+	probed    bool
+	probeErr  error
+	probeRTT  time.Duration
+	probeAddr netip.Addr
+}
+
+// Update records the current wireguard stats of the peers, forgetting peers no longer present.
+func (c *Checker) Update(stats []wg.PeerStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := make(map[string]*peer, len(stats))
+	for _, s := range stats {
+		p, ok := c.peers[s.Node.Name]
+		if !ok || p.probeAddr != s.Node.OverlayAddr {
+			p = &peer{status: StatusUnknown, since: time.Now(), probeAddr: s.Node.OverlayAddr}
+		}
+		p.stats = s
+		current[s.Node.Name] = p
+		c.updateStatus(s.Node.Name, p)
+	}
+	c.peers = current
+}
+
+// Run periodically probes all peers until the context is cancelled.
+// It returns immediately if no Prober is set.
+func (c *Checker) Run(ctx context.Context) {
+	if c.Prober == nil {
+		return
+	}
+	interval := c.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.probeAll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Checker) probeAll(ctx context.Context) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	c.mu.Lock()
+	targets := make(map[string]netip.Addr, len(c.peers))
+	for name, p := range c.peers {
+		targets[name] = p.probeAddr
+	}
+	c.mu.Unlock()
+
+	sem := make(chan struct{}, maxConcurrentProbes)
+	running := sync.WaitGroup{}
+	for name, addr := range targets {
+		running.Add(1)
+		sem <- struct{}{}
+		go func(name string, addr netip.Addr) {
+			defer func() { <-sem; running.Done() }()
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			rtt, err := c.Prober.Probe(probeCtx, addr)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			p, ok := c.peers[name]
+			if !ok || p.probeAddr != addr {
+				return // peer changed while probing
+			}
+			p.probed, p.probeErr, p.probeRTT = true, err, rtt
+			c.updateStatus(name, p)
+		}(name, addr)
+	}
+	running.Wait()
+}
+
+// updateStatus derives the status of a peer from the latest probe or - without probes - its handshakes.
+func (c *Checker) updateStatus(name string, p *peer) {
+	status := StatusUnknown
+	switch {
+	case p.probed && p.probeErr == nil:
+		status = StatusUp
+	case p.probed:
+		status = StatusDown
+	case c.Prober != nil:
+		// wait for the first probe
+	case p.stats.RecentHandshake:
+		status = StatusUp
+	case p.stats.Failed:
+		status = StatusDown
+	}
+	if status == p.status {
+		return
+	}
+
+	log := c.logger().WithFields(p.stats.Node.LogFields()).WithField("previous", p.status)
+	if p.probeErr != nil {
+		log = log.WithError(p.probeErr)
+	}
+	if status == StatusDown {
+		log.Warn("tunnel to peer down")
+	} else {
+		log.Infof("tunnel to peer %s", status)
+	}
+	p.status = status
+	p.since = time.Now()
+}
+
+// Peers returns the health of all peers, sorted by name.
+func (c *Checker) Peers() []PeerHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peers := make([]PeerHealth, 0, len(c.peers))
+	for name, p := range c.peers {
+		h := PeerHealth{
+			Node:          name,
+			Overlay:       p.probeAddr.String(),
+			Status:        p.status,
+			Since:         p.since,
+			LastHandshake: p.stats.LastHandshake,
+			RxBytes:       p.stats.RxBytes,
+			TxBytes:       p.stats.TxBytes,
+			Relayed:       p.stats.Relayed,
+			PresharedKey:  p.stats.PresharedKey,
+		}
+		if p.stats.Endpoint.IsValid() {
+			h.Endpoint = p.stats.Endpoint.String()
+		}
+		if p.probed && p.probeErr == nil {
+			h.RTT = p.probeRTT
+		}
+		peers = append(peers, h)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Node < peers[j].Node })
+	return peers
+}
+
+// DownFor returns how long the tunnel to the provided peer has been down, or zero if it is not known to be down.
+func (c *Checker) DownFor(name string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.peers[name]
+	if !ok || p.status != StatusDown {
+		return 0
+	}
+	return time.Since(p.since)
+}
+
+func (c *Checker) logger() logrus.FieldLogger {
+	if c.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return c.Logger
+}
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/wg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStats(name string, overlay string) wg.PeerStats {
+	node := common.Node{Name: name}
+	node.OverlayAddr = netip.MustParseAddr(overlay)
+	return wg.PeerStats{Node: node}
+}
+
+type fakeProber struct {
+	mu   sync.Mutex
+	down map[netip.Addr]bool
+}
+
+func (p *fakeProber) Probe(ctx context.Context, addr netip.Addr) (time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down[addr] {
+		return 0, errors.New("timeout")
+	}
+	return time.Millisecond, nil
+}
+
+func Test_Checker_handshakes(t *testing.T) {
+	c := &Checker{}
+	up := testStats("up", "10.0.0.1")
+	up.RecentHandshake = true
+	down := testStats("down", "10.0.0.2")
+	down.Failed = true
+	idle := testStats("idle", "10.0.0.3")
+
+	c.Update([]wg.PeerStats{up, down, idle})
+
+	statuses := make(map[string]Status)
+	for _, p := range c.Peers() {
+		statuses[p.Node] = p.Status
+	}
+	assert.Equal(t, map[string]Status{"up": StatusUp, "down": StatusDown, "idle": StatusUnknown}, statuses)
+	assert.NotZero(t, c.DownFor("down"))
+	assert.Zero(t, c.DownFor("up"))
+
+	c.Update([]wg.PeerStats{up})
+	assert.Len(t, c.Peers(), 1, "gone peers should be forgotten")
+}
+
+func Test_Checker_probes(t *testing.T) {
+	prober := &fakeProber{down: map[netip.Addr]bool{netip.MustParseAddr("10.0.0.2"): true}}
+	c := &Checker{Prober: prober}
+	// handshakes should be ignored in favor of probes
+	up := testStats("up", "10.0.0.1")
+	down := testStats("down", "10.0.0.2")
+	down.RecentHandshake = true
+
+	c.Update([]wg.PeerStats{up, down})
+	for _, p := range c.Peers() {
+		assert.Equal(t, StatusUnknown, p.Status, "status should be unknown until probed")
+	}
+
+	c.probeAll(context.Background())
+
+	peers := c.Peers()
+	require.Len(t, peers, 2)
+	assert.Equal(t, StatusDown, peers[0].Status)
+	assert.Equal(t, StatusUp, peers[1].Status)
+	assert.Equal(t, time.Millisecond, peers[1].RTT)
+}
+
+func Test_UDPProber(t *testing.T) {
+	addr := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), freeUDPPort(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ServeUDP(ctx, addr) // nolint: errcheck
+
+	prober := UDPProber{Port: int(addr.Port())}
+	require.Eventually(t, func() bool {
+		probeCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		_, err := prober.Probe(probeCtx, addr.Addr())
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	probeCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err := UDPProber{Port: int(freeUDPPort(t))}.Probe(probeCtx, addr.Addr())
+	assert.Error(t, err, "probes without responder should fail")
+}
+
+func freeUDPPort(t *testing.T) uint16 {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
@@ -0,0 +1,156 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DefaultProbePort is the default UDP port used by UDP probes.
+const DefaultProbePort = 7947
+
+// probeSize is the size of probe payloads; larger packets are ignored by the responder.
+const probeSize = 16
+
+// UDPProber probes peers by sending a random payload to their UDP responder, expecting it to be echoed back.
+type UDPProber struct {
+	Port int
+}
+
+// Probe implements the Prober interface.
+func (p UDPProber) Probe(ctx context.Context, addr netip.Addr) (time.Duration, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", netip.AddrPortFrom(addr, uint16(p.Port)).String())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline) // nolint: errcheck // only fails on closed connections
+	}
+
+	payload := make([]byte, probeSize)
+	if _, err := rand.Read(payload); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := conn.Write(payload); err != nil {
+		return 0, fmt.Errorf("sending probe: %w", err)
+	}
+	buf := make([]byte, probeSize+1)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, fmt.Errorf("waiting for probe reply: %w", err)
+		}
+		if bytes.Equal(buf[:n], payload) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// ServeUDP echoes UDP probes received on the provided address until the context is cancelled.
+// Listening on the overlay address ensures only probes coming through the tunnel are answered.
+func ServeUDP(ctx context.Context, addr netip.AddrPort) error {
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close() // nolint: errcheck
+	}()
+
+	buf := make([]byte, probeSize+1)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if n != probeSize {
+			continue
+		}
+		conn.WriteToUDPAddrPort(buf[:n], from) // nolint: errcheck // the prober will time out
+	}
+}
+
+// ICMPProber probes peers with ICMP echo requests.
+// Unprivileged ICMP sockets are used if allowed by net.ipv4.ping_group_range, otherwise raw sockets, which require
+// CAP_NET_RAW.
+type ICMPProber struct{}
+
+// Probe implements the Prober interface.
+func (ICMPProber) Probe(ctx context.Context, addr netip.Addr) (time.Duration, error) {
+	conn, dst, proto, err := listenICMP(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline) // nolint: errcheck // only fails on closed connections
+	}
+
+	payload := make([]byte, probeSize)
+	if _, err := rand.Read(payload); err != nil {
+		return 0, err
+	}
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if addr.Is6() {
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: 1, Data: payload},
+	}
+	wire, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(wire, dst); err != nil {
+		return 0, fmt.Errorf("sending probe: %w", err)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, fmt.Errorf("waiting for probe reply: %w", err)
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		// the ID may be rewritten by unprivileged sockets, so replies are matched by payload
+		if echo, ok := reply.Body.(*icmp.Echo); ok && bytes.Equal(echo.Data, payload) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+func listenICMP(addr netip.Addr) (*icmp.PacketConn, net.Addr, int, error) {
+	network, rawNetwork, listenAddr, proto := "udp4", "ip4:icmp", "0.0.0.0", 1
+	if addr.Is6() {
+		network, rawNetwork, listenAddr, proto = "udp6", "ip6:ipv6-icmp", "::", 58
+	}
+	conn, err := icmp.ListenPacket(network, listenAddr)
+	if err == nil {
+		return conn, &net.UDPAddr{IP: addr.AsSlice()}, proto, nil
+	}
+	conn, rawErr := icmp.ListenPacket(rawNetwork, listenAddr)
+	if rawErr != nil {
+		return nil, nil, 0, fmt.Errorf("opening ICMP socket: %s; falling back to raw socket: %w", err, rawErr)
+	}
+	return conn, &net.IPAddr{IP: addr.AsSlice()}, proto, nil
+}
@@ -0,0 +1,249 @@
+// Package hooks runs user-provided executables on cluster membership changes.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is the default time after which a running hook is killed.
+const DefaultTimeout = 30 * time.Second
+
+// queueSize is the number of events buffered while hooks are running; further events are dropped.
+const queueSize = 100
+
+// maxOutput limits how much of a hook's output is logged.
+const maxOutput = 4096
+
+// outputGrace is how long the output of a hook is still read after it exited, e.g. from children it started in the
+// background and which keep its output open.
+const outputGrace = time.Second
+
+// defaultPath is the PATH passed to hooks if wesher itself has none.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Config holds the settings used to create a Runner.
+type Config struct {
+	// OnJoin, OnLeave and OnUpdate are the paths of the executables to run for the respective event types; events
+	// without a configured hook are ignored.
+	OnJoin   string
+	OnLeave  string
+	OnUpdate string
+	// Timeout is the time after which a running hook is killed; defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Logger is used to log hook results; defaults to the standard logrus logger.
+	Logger logrus.FieldLogger
+}
+
+// Runner runs the configured hooks for each event, one at a time and in the order the events happened.
+// Hooks are passed the event as JSON on stdin, as well as in WESHER_* environment variables. They do not inherit the
+// environment of wesher - which may hold secrets like the cluster key - besides PATH.
+type Runner struct {
+	config Config
+	queue  chan common.Event
+}
+
+// New returns a Runner for the provided hooks, or nil if no hook is configured.
+func New(config Config) *Runner {
+	if config.OnJoin == "" && config.OnLeave == "" && config.OnUpdate == "" {
+		return nil
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.Logger == nil {
+		config.Logger = logrus.StandardLogger()
+	}
+	return &Runner{
+		config: config,
+		queue:  make(chan common.Event, queueSize),
+	}
+}
+
+// Notify queues the hooks for the provided events, without waiting for them to run.
+// It is safe to call on a nil Runner.
+func (r *Runner) Notify(events ...common.Event) {
+	if r == nil {
+		return
+	}
+	for _, e := range events {
+		if r.hook(e.Type) == "" {
+			continue
+		}
+		select {
+		case r.queue <- e:
+		default:
+			r.config.Logger.WithFields(eventFields(e)).Warn("too many pending hooks; dropping event")
+		}
+	}
+}
+
+// Run processes queued events until the context is cancelled.
+// It is safe to call on a nil Runner.
+func (r *Runner) Run(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	for {
+		select {
+		case e := <-r.queue:
+			r.run(ctx, e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Runner) hook(t common.EventType) string {
+	switch t {
+	case common.EventJoin:
+		return r.config.OnJoin
+	case common.EventLeave:
+		return r.config.OnLeave
+	case common.EventUpdate:
+		return r.config.OnUpdate
+	}
+	return ""
+}
+
+// run executes the hook for a single event and logs its result.
+func (r *Runner) run(ctx context.Context, e common.Event) {
+	hook := r.hook(e.Type)
+	log := r.config.Logger.WithFields(eventFields(e)).WithField("hook", hook)
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.WithError(err).Error("could not encode event")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+	start := time.Now()
+	out, err := execute(ctx, hook, payload, env(e))
+	log = log.WithField("duration", time.Since(start))
+	if len(out) > 0 {
+		log = log.WithField("output", string(out))
+	}
+
+	exitErr := &exec.ExitError{}
+	switch {
+	case err == nil:
+		log.Info("hook succeeded")
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Warnf("hook timed out after %s", r.config.Timeout)
+	case errors.As(err, &exitErr):
+		log.WithField("exit_status", exitErr.ExitCode()).Warn("hook failed")
+	default:
+		log.WithError(err).Error("could not run hook")
+	}
+}
+
+// execute runs the hook with the provided stdin and environment, returning its combined output.
+// The hook runs in its own process group, which is killed when the context is done. Its output is read through a pipe
+// which is closed shortly after the hook exits, so children left running in the background cannot block the runner.
+func execute(ctx context.Context, hook string, stdin []byte, env []string) ([]byte, error) {
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating output pipe: %w", err)
+	}
+	defer outR.Close()
+
+	cmd := exec.Command(hook)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = outW
+	cmd.Stderr = outW
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	outW.Close() // only the hook keeps it open
+	if err != nil {
+		return nil, err
+	}
+
+	output := make(chan []byte, 1)
+	go func() {
+		out, _ := io.ReadAll(io.LimitReader(outR, maxOutput)) // nolint: errcheck // partial output is fine
+		io.Copy(io.Discard, outR)                             // nolint: errcheck // drain, so the hook does not block
+		output <- out
+	}()
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) // nolint: errcheck // may have exited already
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	select {
+	case out := <-output:
+		return out, err
+	case <-time.After(outputGrace):
+		outR.Close() // unblocks the reader
+		return <-output, err
+	}
+}
+
+// env returns the event as environment variables, along with PATH.
+// Labels are provided as WESHER_NODE_LABEL_<KEY>, with the key upper-cased and non-alphanumeric characters replaced
+// by underscores.
+func env(e common.Event) []string {
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = defaultPath
+	}
+	vars := []string{
+		"PATH=" + path,
+		"WESHER_EVENT=" + string(e.Type),
+		"WESHER_NETWORK=" + e.Network,
+		"WESHER_NODE=" + e.Node,
+		"WESHER_NODE_ADDR=" + e.Addr,
+		"WESHER_NODE_OVERLAY=" + e.Overlay,
+		"WESHER_NODE_PUBKEY=" + e.PubKey,
+	}
+	labels := make([]string, 0, len(e.Labels))
+	for k, v := range e.Labels {
+		labels = append(labels, fmt.Sprintf("WESHER_NODE_LABEL_%s=%s", envName(k), v))
+	}
+	sort.Strings(labels)
+	return append(vars, labels...)
+}
+
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func eventFields(e common.Event) logrus.Fields {
+	return logrus.Fields{
+		"event": e.Type,
+		"node":  e.Node,
+		"addr":  e.Addr,
+	}
+}
@@ -0,0 +1,149 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeScript(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+content), 0o755))
+	return path
+}
+
+func Test_New_noHooks(t *testing.T) {
+	r := New(Config{})
+	assert.Nil(t, r)
+	// nil runners must be usable
+	r.Notify(common.Event{Type: common.EventJoin})
+	r.Run(context.Background())
+}
+
+func Test_Runner_run(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	hook := writeScript(t, `cat > `+out+`.json; env | grep ^WESHER_ | sort > `+out+`.env`)
+	logger, logs := test.NewNullLogger()
+	r := New(Config{OnJoin: hook, Logger: logger})
+
+	event := common.Event{
+		Type:    common.EventJoin,
+		Network: "wgoverlay",
+		Node:    "node1",
+		NodeInfo: common.NodeInfo{
+			Addr:    "192.0.2.1",
+			Overlay: "10.0.0.1",
+			PubKey:  "pubkey",
+			Labels:  map[string]string{"zone": "a", "node-role": "db"},
+		},
+	}
+	r.run(context.Background(), event)
+
+	payload, err := os.ReadFile(out + ".json")
+	require.NoError(t, err)
+	received := common.Event{}
+	require.NoError(t, json.Unmarshal(payload, &received))
+	assert.Equal(t, event, received)
+
+	env, err := os.ReadFile(out + ".env")
+	require.NoError(t, err)
+	assert.Equal(t, `WESHER_EVENT=join
+WESHER_NETWORK=wgoverlay
+WESHER_NODE=node1
+WESHER_NODE_ADDR=192.0.2.1
+WESHER_NODE_LABEL_NODE_ROLE=db
+WESHER_NODE_LABEL_ZONE=a
+WESHER_NODE_OVERLAY=10.0.0.1
+WESHER_NODE_PUBKEY=pubkey
+`, string(env))
+
+	assert.Equal(t, logrus.InfoLevel, logs.LastEntry().Level)
+}
+
+func Test_Runner_run_failure(t *testing.T) {
+	logger, logs := test.NewNullLogger()
+	r := New(Config{OnLeave: writeScript(t, "echo oops; exit 3"), Logger: logger})
+
+	r.run(context.Background(), common.Event{Type: common.EventLeave})
+
+	entry := logs.LastEntry()
+	assert.Equal(t, logrus.WarnLevel, entry.Level)
+	assert.Equal(t, 3, entry.Data["exit_status"])
+	assert.Equal(t, "oops\n", entry.Data["output"])
+}
+
+func Test_Runner_run_timeout(t *testing.T) {
+	logger, logs := test.NewNullLogger()
+	r := New(Config{OnUpdate: writeScript(t, "exec sleep 10"), Timeout: 100 * time.Millisecond, Logger: logger})
+
+	start := time.Now()
+	r.run(context.Background(), common.Event{Type: common.EventUpdate})
+
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Contains(t, logs.LastEntry().Message, "timed out")
+}
+
+func Test_Runner_serialized(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	hook := writeScript(t, `echo "start $WESHER_NODE" >> `+out+`; sleep 0.05; echo "end $WESHER_NODE" >> `+out)
+	logger, _ := test.NewNullLogger()
+	r := New(Config{OnJoin: hook, OnLeave: hook, Logger: logger})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	r.Notify(
+		common.Event{Type: common.EventJoin, Node: "a"},
+		common.Event{Type: common.EventUpdate, Node: "ignored"},
+		common.Event{Type: common.EventLeave, Node: "b"},
+	)
+
+	expected := "start a\nend a\nstart b\nend b\n"
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(out)
+		return string(content) == expected
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_Runner_run_background(t *testing.T) {
+	logger, logs := test.NewNullLogger()
+	r := New(Config{OnJoin: writeScript(t, "echo started; sleep 10 &"), Timeout: 5 * time.Second, Logger: logger})
+
+	start := time.Now()
+	r.run(context.Background(), common.Event{Type: common.EventJoin})
+
+	assert.Less(t, time.Since(start), 4*time.Second, "children keeping the output open should not block the runner")
+	entry := logs.LastEntry()
+	assert.Equal(t, logrus.InfoLevel, entry.Level)
+	assert.Equal(t, "started\n", entry.Data["output"])
+}
+
+func Test_Runner_run_environment(t *testing.T) {
+	t.Setenv("WESHER_CLUSTER_KEY", "secret")
+	out := filepath.Join(t.TempDir(), "env")
+	logger, _ := test.NewNullLogger()
+	r := New(Config{OnJoin: writeScript(t, `env | grep -v -e ^PWD= -e ^SHLVL= -e ^_= | cut -d= -f1 | sort > `+out), Logger: logger})
+
+	r.run(context.Background(), common.Event{Type: common.EventJoin})
+
+	env, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, `PATH
+WESHER_EVENT
+WESHER_NETWORK
+WESHER_NODE
+WESHER_NODE_ADDR
+WESHER_NODE_OVERLAY
+WESHER_NODE_PUBKEY
+`, string(env), "hooks should only receive PATH and the event")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/costela/wesher/control"
+)
+
+type HostsCmd struct{}
+
+func (h *HostsCmd) Run(cli *cli) error {
+	resp, err := control.Client(cli.ControlSocket).Get("http://wesher/hosts")
+	if err != nil {
+		return fmt.Errorf("could not contact agent: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from agent: %s", resp.Status)
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
@@ -0,0 +1,148 @@
+// Package kube integrates wesher with Kubernetes, when running as a DaemonSet meshing the cluster's nodes.
+package kube
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// AnnotationPrefix prefixes the annotations published on the Kubernetes nodes.
+const AnnotationPrefix = "wesher.io/"
+
+// ClusterKeyEntry is the entry of the Secret holding the base64 encoded cluster key.
+const ClusterKeyEntry = "cluster-key"
+
+// DefaultSelector is the default label selector of the wesher pods.
+const DefaultSelector = "app=wesher"
+
+// Client talks to the Kubernetes API on behalf of the wesher pod running on a single node.
+type Client struct {
+	Clientset kubernetes.Interface
+	// Namespace is the namespace of the wesher pods and of the Secret holding the cluster key.
+	Namespace string
+	// NodeName is the name of the Kubernetes node the local pod runs on.
+	NodeName string
+	// Selector is the label selector matching the wesher pods; defaults to DefaultSelector.
+	Selector string
+}
+
+// NewInCluster creates a client using the service account of the pod it runs in.
+func NewInCluster(namespace, nodeName, selector string) (*Client, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading in-cluster config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating kubernetes client: %w", err)
+	}
+	return &Client{
+		Clientset: clientset,
+		Namespace: namespace,
+		NodeName:  nodeName,
+		Selector:  selector,
+	}, nil
+}
+
+// ClusterKey reads the cluster key from the named Secret.
+func (c *Client) ClusterKey(ctx context.Context, secretName string) ([]byte, error) {
+	secret, err := c.Clientset.CoreV1().Secrets(c.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting secret %s/%s: %w", c.Namespace, secretName, err)
+	}
+	encoded, ok := secret.Data[ClusterKeyEntry]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no %s entry", c.Namespace, secretName, ClusterKeyEntry)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding cluster key from secret %s/%s: %w", c.Namespace, secretName, err)
+	}
+	return key, nil
+}
+
+// Addrs implements the discovery.Provider interface, returning the host IPs of the wesher pods running on other nodes.
+func (c *Client) Addrs(ctx context.Context) ([]string, error) {
+	selector := c.Selector
+	if selector == "" {
+		selector = DefaultSelector
+	}
+	pods, err := c.Clientset.CoreV1().Pods(c.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods in %s: %w", c.Namespace, err)
+	}
+
+	addrs := make([]string, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == c.NodeName || pod.Status.Phase != corev1.PodRunning || pod.Status.HostIP == "" {
+			continue
+		}
+		addrs = append(addrs, pod.Status.HostIP)
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// Annotate publishes the overlay address and wireguard public key of the provided network on the local Kubernetes
+// node.
+func (c *Client) Annotate(ctx context.Context, network string, overlayAddr netip.Addr, pubKey string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				OverlayAddrAnnotation(network): overlayAddr.String(),
+				PublicKeyAnnotation(network):   pubKey,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("encoding annotations: %w", err)
+	}
+	if _, err := c.Clientset.CoreV1().Nodes().Patch(ctx, c.NodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("annotating node %s: %w", c.NodeName, err)
+	}
+	return nil
+}
+
+// PodCIDRs returns the pod CIDRs assigned to the local Kubernetes node.
+func (c *Client) PodCIDRs(ctx context.Context) ([]netip.Prefix, error) {
+	node, err := c.Clientset.CoreV1().Nodes().Get(ctx, c.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting node %s: %w", c.NodeName, err)
+	}
+	cidrs := node.Spec.PodCIDRs
+	if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+		cidrs = []string{node.Spec.PodCIDR}
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("node %s has no pod CIDR assigned", c.NodeName)
+	}
+	prefixes := make([]netip.Prefix, len(cidrs))
+	for i, cidr := range cidrs {
+		prefixes[i], err = netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing pod CIDR of node %s: %w", c.NodeName, err)
+		}
+	}
+	return prefixes, nil
+}
+
+// OverlayAddrAnnotation returns the node annotation holding the overlay address of the provided network.
+func OverlayAddrAnnotation(network string) string {
+	return AnnotationPrefix + network + ".overlay-addr"
+}
+
+// PublicKeyAnnotation returns the node annotation holding the wireguard public key of the provided network.
+func PublicKeyAnnotation(network string) string {
+	return AnnotationPrefix + network + ".public-key"
+}
@@ -0,0 +1,121 @@
+package kube
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/costela/wesher/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var _ discovery.Provider = (*Client)(nil)
+
+func pod(name, node, hostIP string, phase corev1.PodPhase, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "wesher", Labels: labels},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: phase, HostIP: hostIP},
+	}
+}
+
+func Test_Client_ClusterKey(t *testing.T) {
+	c := &Client{
+		Clientset: fake.NewSimpleClientset(
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "wesher", Namespace: "wesher"},
+				Data:       map[string][]byte{ClusterKeyEntry: []byte("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=\n")},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "wesher"},
+				Data:       map[string][]byte{"key": []byte("AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=")},
+			},
+		),
+		Namespace: "wesher",
+	}
+
+	key, err := c.ClusterKey(context.Background(), "wesher")
+	require.NoError(t, err)
+	assert.Len(t, key, 32)
+	assert.Equal(t, byte(31), key[31])
+
+	_, err = c.ClusterKey(context.Background(), "other")
+	assert.ErrorContains(t, err, "no cluster-key entry")
+
+	_, err = c.ClusterKey(context.Background(), "missing")
+	assert.Error(t, err)
+}
+
+func Test_Client_Addrs(t *testing.T) {
+	labels := map[string]string{"app": "wesher"}
+	c := &Client{
+		Clientset: fake.NewSimpleClientset(
+			pod("local", "node-a", "192.0.2.1", corev1.PodRunning, labels),
+			pod("b", "node-b", "192.0.2.2", corev1.PodRunning, labels),
+			pod("c", "node-c", "192.0.2.3", corev1.PodRunning, labels),
+			pod("pending", "node-d", "", corev1.PodPending, labels),
+			pod("failed", "node-e", "192.0.2.5", corev1.PodFailed, labels),
+			pod("other-app", "node-f", "192.0.2.6", corev1.PodRunning, map[string]string{"app": "other"}),
+		),
+		Namespace: "wesher",
+		NodeName:  "node-a",
+	}
+
+	addrs, err := c.Addrs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.2", "192.0.2.3"}, addrs)
+}
+
+func Test_Client_Annotate(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a", Annotations: map[string]string{"unrelated": "kept"}},
+	})
+	c := &Client{Clientset: clientset, NodeName: "node-a"}
+
+	require.NoError(t, c.Annotate(context.Background(), "wgoverlay", netip.MustParseAddr("10.1.2.3"), "pubkey"))
+
+	node, err := clientset.CoreV1().Nodes().Get(context.Background(), "node-a", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"unrelated":                        "kept",
+		"wesher.io/wgoverlay.overlay-addr": "10.1.2.3",
+		"wesher.io/wgoverlay.public-key":   "pubkey",
+	}, node.Annotations)
+
+	c.NodeName = "missing"
+	assert.Error(t, c.Annotate(context.Background(), "wgoverlay", netip.MustParseAddr("10.1.2.3"), "pubkey"))
+}
+
+func Test_Client_PodCIDRs(t *testing.T) {
+	c := &Client{
+		Clientset: fake.NewSimpleClientset(
+			&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "dual-stack"},
+				Spec:       corev1.NodeSpec{PodCIDR: "10.244.1.0/24", PodCIDRs: []string{"10.244.1.0/24", "fd00:10:244:1::/64"}},
+			},
+			&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "legacy"},
+				Spec:       corev1.NodeSpec{PodCIDR: "10.244.2.0/24"},
+			},
+			&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "unassigned"}},
+		),
+	}
+
+	c.NodeName = "dual-stack"
+	cidrs, err := c.PodCIDRs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.244.1.0/24"), netip.MustParsePrefix("fd00:10:244:1::/64")}, cidrs)
+
+	c.NodeName = "legacy"
+	cidrs, err = c.PodCIDRs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.244.2.0/24")}, cidrs)
+
+	c.NodeName = "unassigned"
+	_, err = c.PodCIDRs(context.Background())
+	assert.ErrorContains(t, err, "no pod CIDR")
+}
@@ -5,16 +5,28 @@ import (
 	"os"
 
 	"github.com/alecthomas/kong"
+	"github.com/costela/wesher/control"
 	"github.com/sirupsen/logrus"
 )
 
 var version = "dev"
 
 type cli struct {
-	LogLevel LogLevelFlag `env:"WESHER_LOG_LEVEL" help:"set the verbosity (debug/info/warn/error)" default:"warn"`
-	Version  VersionFlag  `help:"display current version and exit"`
+	LogLevel  LogLevelFlag      `env:"WESHER_LOG_LEVEL" help:"set the verbosity (debug/info/warn/error)" default:"warn"`
+	LogLevels map[string]string `env:"WESHER_LOG_LEVELS" help:"semicolon separated list of subsystem=level pairs overriding the verbosity of individual subsystems (cluster/memberlist/wireguard/etchosts/health/firewall/hooks/webhooks/control)"`
+	LogFormat LogFormatFlag     `env:"WESHER_LOG_FORMAT" enum:"text,json" help:"set the log output format (text/json)" default:"text"`
+	Version   VersionFlag       `help:"display current version and exit"`
 
-	Agent AgentCmd `cmd:"" default:"withargs" help:"start the wesher agent (default when no command specified)"`
+	ControlSocket string `env:"WESHER_CONTROL_SOCKET" help:"path of the unix socket used to control the agent" default:"${control_socket}" type:"path"`
+
+	Agent  AgentCmd  `cmd:"" default:"withargs" help:"start the wesher agent (default when no command specified)"`
+	Events EventsCmd `cmd:"" help:"print recent cluster events of a running agent as newline-delimited JSON"`
+	Status StatusCmd `cmd:"" help:"print the status of the networks and peer tunnels of a running agent"`
+	Hosts  HostsCmd  `cmd:"" help:"print the current hosts entries of a running agent in hosts(5) format"`
+	Policy PolicyCmd `cmd:"" help:"work with overlay policy files"`
+	Ban    BanCmd    `cmd:"" help:"ban nodes by name, wireguard public key or cluster address from the cluster"`
+	Unban  UnbanCmd  `cmd:"" help:"lift the bans of nodes"`
+	BanKey BanKeyCmd `cmd:"" help:"generate a private key for signing bans and print its public key"`
 }
 
 func main() {
@@ -23,12 +35,56 @@ func main() {
 		kong.Name("wesher"),
 		kong.Description("mesh overlay network manager"),
 		kong.UsageOnError(),
+		kong.Vars{"control_socket": control.DefaultSocket},
 	)
 
 	err := ktx.Run(cli)
 	ktx.FatalIfErrorf(err)
 }
 
+// logSubsystems are the subsystems whose verbosity can be set individually.
+var logSubsystems = []string{"cluster", "memberlist", "wireguard", "etchosts", "health", "firewall", "hooks", "webhooks", "control"}
+
+func (c *cli) Validate() error {
+	for subsystem, level := range c.LogLevels {
+		if !contains(logSubsystems, subsystem) {
+			return fmt.Errorf("unknown log subsystem %q; must be one of %v", subsystem, logSubsystems)
+		}
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return fmt.Errorf("log level of subsystem %s: %w", subsystem, err)
+		}
+	}
+	return nil
+}
+
+// logger returns a logger for the provided subsystem, sharing the output and format of the standard logger, but using
+// the subsystem's own log level, if set.
+func (c *cli) logger(subsystem string) *logrus.Entry {
+	std := logrus.StandardLogger()
+	level := std.GetLevel()
+	if l, ok := c.LogLevels[subsystem]; ok {
+		level, _ = logrus.ParseLevel(l) // already validated
+	}
+	logger := &logrus.Logger{
+		Out:          std.Out,
+		Formatter:    std.Formatter,
+		Hooks:        std.Hooks,
+		ReportCaller: std.ReportCaller,
+		ExitFunc:     std.ExitFunc,
+		Level:        level,
+	}
+	return logger.WithField("subsystem", subsystem)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 type VersionFlag bool
 
 func (v *VersionFlag) BeforeApply() error {
@@ -48,3 +104,13 @@ func (l LogLevelFlag) AfterApply() error {
 
 	return nil
 }
+
+type LogFormatFlag string
+
+func (l LogFormatFlag) AfterApply() error {
+	if l == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+
+	return nil
+}
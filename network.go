@@ -0,0 +1,735 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/costela/wesher/cluster"
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+	"github.com/costela/wesher/discovery"
+	"github.com/costela/wesher/etchosts"
+	"github.com/costela/wesher/firewall"
+	"github.com/costela/wesher/health"
+	"github.com/costela/wesher/hooks"
+	"github.com/costela/wesher/kube"
+	"github.com/costela/wesher/webhooks"
+	"github.com/costela/wesher/wg"
+	"github.com/hashicorp/go-sockaddr"
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+// peerCheckInterval is how often the reachability of peers is re-evaluated.
+const peerCheckInterval = 30 * time.Second
+
+// networkConfig holds the settings for a single mesh network.
+// They can be set either via command-line flags or - for running multiple networks - via the networks file, in which
+// case the flags act as defaults.
+type networkConfig struct {
+	// Name identifies the network in logs; defaults to the interface name.
+	Name              string            `kong:"-" yaml:"name"`
+	ClusterKey        key               `env:"WESHER_CLUSTER_KEY" help:"shared key for cluster membership; must be 32 bytes base64 encoded; will be generated if not provided" yaml:"cluster-key"`
+	Join              []string          `env:"WESHER_JOIN" help:"comma separated list of hostnames or IP addresses to existing cluster members, or seed providers (dns+srv://, dns+a://, file://, http(s)://, exec://) queried on every join attempt; if not provided, will attempt resuming any known state or otherwise wait for further members." yaml:"join"`
+	Init              bool              `env:"WESHER_INIT" help:"whether to explicitly (re)initialize the cluster; any known state from previous runs will be forgotten" yaml:"init"`
+	BindAddr          string            `env:"WESHER_BIND_ADDR" help:"IP address to bind to for cluster membership traffic (cannot be used with --bind-iface)" yaml:"bind-addr"`
+	BindIface         string            `env:"WESHER_BIND_IFACE" help:"Interface to bind to for cluster membership traffic (cannot be used with --bind-addr)" yaml:"bind-iface"`
+	ClusterPort       int               `env:"WESHER_CLUSTER_PORT" help:"port used for membership gossip traffic (both TCP and UDP); nodes using a different port must be joined using HOST:PORT" default:"7946" yaml:"cluster-port"`
+	AdvertiseAddr     string            `env:"WESHER_ADVERTISE_ADDR" help:"IP address announced to other nodes for cluster membership traffic, if different from the bind address (e.g. behind port-forwarding)" yaml:"advertise-addr"`
+	AdvertisePort     int               `env:"WESHER_ADVERTISE_PORT" help:"port announced to other nodes for cluster membership traffic, if different from the cluster port (e.g. behind port-forwarding)" yaml:"advertise-port"`
+	WireguardPort     int               `env:"WESHER_WIREGUARD_PORT" help:"port used for wireguard traffic (UDP)" default:"51820" yaml:"wireguard-port"`
+	AdvertiseEndpoint string            `env:"WESHER_ADVERTISE_ENDPOINT" help:"HOST:PORT under which other nodes should reach this node's wireguard interface, if different from the cluster address and wireguard port (e.g. behind port-forwarding)" yaml:"advertise-endpoint"`
+	OverlayNet        netip.Prefix      `env:"WESHER_OVERLAY_NET" help:"the network in which to allocate addresses for the overlay mesh network (CIDR format); smaller networks increase the chance of IP collision" default:"10.0.0.0/8" yaml:"overlay-net"`
+	Interface         string            `env:"WESHER_INTERFACE" help:"name of the wireguard interface to create and manage" default:"wgoverlay" yaml:"interface"`
+	NoEtcHosts        bool              `env:"WESHER_NO_ETC_HOSTS" help:"disable writing of entries to /etc/hosts" yaml:"no-etc-hosts"`
+	HostsFile         string            `env:"WESHER_HOSTS_FILE" help:"path to the hosts file to write entries to; its directory must be writable" default:"/etc/hosts" yaml:"hosts-file"`
+	HostsDir          string            `env:"WESHER_HOSTS_DIR" help:"directory of hosts files - e.g. bind-mounted into containers - to keep the entries updated in; a hosts file is created in it, if missing" type:"path" yaml:"hosts-dir"`
+	OnJoin            string            `env:"WESHER_ON_JOIN" help:"executable to run when a node joins; see README for the provided environment and input" yaml:"on-join"`
+	OnLeave           string            `env:"WESHER_ON_LEAVE" help:"executable to run when a node leaves or fails" yaml:"on-leave"`
+	OnUpdate          string            `env:"WESHER_ON_UPDATE" help:"executable to run when a node changes its address or metadata" yaml:"on-update"`
+	HookTimeout       time.Duration     `env:"WESHER_HOOK_TIMEOUT" help:"time after which a running hook is killed" default:"30s" yaml:"hook-timeout"`
+	Webhooks          []string          `name:"webhook" env:"WESHER_WEBHOOKS" help:"comma separated list of URLs to POST cluster events to" yaml:"webhook"`
+	WebhookSecret     string            `env:"WESHER_WEBHOOK_SECRET" help:"secret used to sign webhook payloads; required when using webhooks" yaml:"webhook-secret"`
+	StateDir          string            `env:"WESHER_STATE_DIR,STATE_DIRECTORY" help:"directory in which to persist the cluster state; defaults to the systemd state directory, if set" default:"/var/lib/wesher" yaml:"state-dir"`
+	Labels            map[string]string `env:"WESHER_LABELS" help:"semicolon separated list of key=value labels for this node; used for selecting nodes in peering topologies" yaml:"labels"`
+	CompactMeta       bool              `env:"WESHER_COMPACT_META" help:"gossip node metadata in a compact encoding, leaving more room for labels; only enable once all nodes run a version supporting it, since older ones cannot decode it" yaml:"compact-meta"`
+	Topology          string            `env:"WESHER_TOPOLOGY" enum:"full-mesh,hub-and-spoke,rules" help:"which nodes to peer with (full-mesh/hub-and-spoke/rules); must be the same across cluster" default:"full-mesh" yaml:"topology"`
+	Hubs              []wg.Selector     `env:"WESHER_HUBS" help:"comma separated list of label (key=value) or name glob selectors for hub nodes, when using the hub-and-spoke topology" yaml:"hubs"`
+	PeerRules         []wg.PeerRule     `name:"peer-rule" env:"WESHER_PEER_RULES" help:"comma separated list of SELECTOR:SELECTOR rules allowing nodes to peer, when using the rules topology" yaml:"peer-rule"`
+	Relay             bool              `env:"WESHER_RELAY" help:"designate this node as a relay, forwarding traffic between peers unable to reach each other directly" yaml:"relay"`
+	BehindNAT         bool              `name:"behind-nat" env:"WESHER_BEHIND_NAT" help:"whether this node is behind NAT, requiring peers to keep connections alive; will be auto-detected if peers report a different public address" yaml:"behind-nat"`
+	HealInterval      time.Duration     `env:"WESHER_HEAL_INTERVAL" help:"interval between attempts to re-join known nodes which are not currently members, e.g. after a partition; 0 disables healing" default:"1m" yaml:"heal-interval"`
+	HealTimeout       time.Duration     `env:"WESHER_HEAL_TIMEOUT" help:"time after which failed nodes which could not be re-joined are forgotten" default:"24h" yaml:"heal-timeout"`
+	StateMaxAge       time.Duration     `env:"WESHER_STATE_MAX_AGE" help:"time after which nodes no longer seen are removed from the persisted state; 0 keeps them indefinitely" default:"168h" yaml:"state-max-age"`
+	HandshakeTimeout  time.Duration     `env:"WESHER_HANDSHAKE_TIMEOUT" help:"time without a successful handshake after which a peer is routed through a relay node, if any is available" default:"3m" yaml:"handshake-timeout"`
+	HealthProbe       string            `env:"WESHER_HEALTH_PROBE" enum:"none,icmp,udp" help:"how to actively probe the tunnels to peers (none/icmp/udp); without probes, tunnel health is derived from wireguard handshakes" default:"none" yaml:"health-probe"`
+	ProbePort         int               `env:"WESHER_PROBE_PORT" help:"port used for UDP health probes over the overlay network; must be the same across cluster" default:"7947" yaml:"probe-port"`
+	ProbeInterval     time.Duration     `env:"WESHER_PROBE_INTERVAL" help:"interval between health probes of each peer" default:"10s" yaml:"probe-interval"`
+	HostsRemoveAfter  time.Duration     `env:"WESHER_HOSTS_REMOVE_AFTER" help:"time after which hosts entries of peers with a tunnel down are removed, until it recovers; 0 keeps them" default:"0" yaml:"hosts-remove-after"`
+	Kubernetes        bool              `env:"WESHER_KUBERNETES" help:"run as a Kubernetes DaemonSet: name the node after the Kubernetes node, join the wesher pods on other nodes and annotate the Kubernetes node with the overlay address and public key" yaml:"kubernetes"`
+	KubeNamespace     string            `name:"kube-namespace" env:"WESHER_KUBE_NAMESPACE,POD_NAMESPACE" help:"namespace of the wesher pods and of the cluster key secret, when running in Kubernetes" yaml:"kube-namespace"`
+	KubeNodeName      string            `name:"kube-node-name" env:"WESHER_KUBE_NODE_NAME,NODE_NAME" help:"name of the Kubernetes node this pod runs on, when running in Kubernetes" yaml:"kube-node-name"`
+	KubeSelector      string            `name:"kube-selector" env:"WESHER_KUBE_SELECTOR" help:"label selector of the wesher pods to join, when running in Kubernetes" default:"app=wesher" yaml:"kube-selector"`
+	KubeSecret        string            `name:"kube-secret" env:"WESHER_KUBE_SECRET" help:"name of the secret holding the cluster key in its cluster-key entry, when running in Kubernetes" yaml:"kube-secret"`
+	PodRouting        bool              `env:"WESHER_POD_ROUTING" help:"advertise the pod CIDRs of this node and route the pod CIDRs of other nodes through the wireguard interface" yaml:"pod-routing"`
+	PodCIDRs          []netip.Prefix    `name:"pod-cidr" env:"WESHER_POD_CIDRS" help:"comma separated list of pod CIDRs of this node, when using pod routing; read from the Kubernetes node if not set" yaml:"pod-cidr"`
+	PresharedKeys     bool              `env:"WESHER_PRESHARED_KEYS" help:"configure per-pair wireguard preshared keys derived from the cluster key with peers also enabling them, as an additional symmetric layer of encryption" yaml:"preshared-keys"`
+	Firewall          bool              `env:"WESHER_FIREWALL" help:"manage nftables rules opening the wireguard and cluster ports only to cluster members, and filtering overlay traffic according to ACLs" yaml:"firewall"`
+	FirewallJoinFrom  []netip.Prefix    `name:"firewall-join-from" env:"WESHER_FIREWALL_JOIN_FROM" help:"comma separated list of networks new nodes may join through this node from, when using the firewall" yaml:"firewall-join-from"`
+	ACLs              []firewall.ACL    `name:"acl" env:"WESHER_ACLS" help:"comma separated list of FROM:TO:PORT[-PORT][/PROTO] rules allowing nodes matching the FROM selector to reach nodes matching the TO selector over the overlay network; nodes targeted by any rule drop other overlay traffic; requires --firewall" yaml:"acl"`
+	BanKeys           []cluster.BanKey  `name:"ban-keys" env:"WESHER_BAN_KEYS" help:"comma separated list of public ban keys (see the ban-key command) trusted to sign bans; bans are ignored without" yaml:"ban-keys"`
+	Policy            string            `env:"WESHER_POLICY" help:"path to a policy file allowing traffic between nodes over the overlay network, in addition to ACLs; see README; requires --firewall" type:"path" yaml:"policy"`
+
+	// for easier local testing; will break etchosts entry
+	UseIPAsName bool `name:"ip-as-name" default:"false" hidden:"" yaml:"ip-as-name"`
+
+	seeds  discovery.Provider
+	policy *firewall.Policy
+}
+
+// validate checks the network settings and computes the bind address, if not explicitly set.
+func (n *networkConfig) validate() error {
+	seeds, err := discovery.Parse(n.Join)
+	if err != nil {
+		return err
+	}
+	n.seeds = seeds
+
+	for _, hook := range []string{n.OnJoin, n.OnLeave, n.OnUpdate} {
+		if hook == "" {
+			continue
+		}
+		info, err := os.Stat(hook)
+		if err != nil {
+			return fmt.Errorf("invalid hook: %w", err)
+		}
+		if info.IsDir() || info.Mode()&0o111 == 0 {
+			return fmt.Errorf("invalid hook %s: not an executable file", hook)
+		}
+	}
+
+	if len(n.Webhooks) > 0 && n.WebhookSecret == "" {
+		return fmt.Errorf("webhooks require a webhook secret")
+	}
+
+	// systemd may provide multiple state directories, separated by colons
+	n.StateDir = strings.SplitN(n.StateDir, ":", 2)[0]
+
+	if len(n.ClusterKey.bytes) != 0 && len(n.ClusterKey.bytes) != cluster.KeyLen {
+		return fmt.Errorf("unsupported cluster key length; expected %d, got %d", cluster.KeyLen, len(n.ClusterKey.bytes))
+	}
+
+	if n.OverlayNet.Bits()%8 != 0 {
+		return fmt.Errorf("unsupported overlay network size; net mask must be multiple of 8, got %d", n.OverlayNet.Bits())
+	}
+
+	if n.AdvertiseEndpoint != "" {
+		if _, _, err := net.SplitHostPort(n.AdvertiseEndpoint); err != nil {
+			return fmt.Errorf("invalid advertise endpoint: %w", err)
+		}
+	}
+
+	if n.AdvertiseAddr != "" && net.ParseIP(n.AdvertiseAddr) == nil {
+		return fmt.Errorf("invalid advertise address %q", n.AdvertiseAddr)
+	}
+
+	if n.Kubernetes {
+		if n.KubeNamespace == "" || n.KubeNodeName == "" {
+			return fmt.Errorf("kubernetes mode requires the pod namespace and node name")
+		}
+		if n.KubeSecret != "" && len(n.ClusterKey.bytes) != 0 {
+			return fmt.Errorf("setting both cluster key and kubernetes secret is not supported")
+		}
+	}
+
+	if n.PodRouting && len(n.PodCIDRs) == 0 && !n.Kubernetes {
+		return fmt.Errorf("pod routing requires pod CIDRs, unless running in Kubernetes")
+	}
+	for _, cidr := range n.PodCIDRs {
+		if cidr.Overlaps(n.OverlayNet) {
+			return fmt.Errorf("pod CIDR %s overlaps the overlay network", cidr)
+		}
+	}
+
+	if (len(n.ACLs) > 0 || n.Policy != "") && !n.Firewall {
+		return fmt.Errorf("ACLs and policies require the firewall to be enabled")
+	}
+	n.policy = &firewall.Policy{}
+	for _, acl := range n.ACLs {
+		n.policy.Rules = append(n.policy.Rules, acl.Rule())
+	}
+	if n.Policy != "" {
+		policy, err := firewall.LoadPolicy(n.Policy)
+		if err != nil {
+			return err
+		}
+		n.policy.Rules = append(n.policy.Rules, policy.Rules...)
+	}
+
+	if n.Topology == "hub-and-spoke" && len(n.Hubs) == 0 {
+		return fmt.Errorf("hub-and-spoke topology requires at least one hub selector")
+	}
+	if n.Topology == "rules" && len(n.PeerRules) == 0 {
+		return fmt.Errorf("rules topology requires at least one peer rule")
+	}
+
+	if n.BindAddr != "" && n.BindIface != "" {
+		return fmt.Errorf("setting both bind address and bind interface is not supported")
+	} else if n.BindIface != "" {
+		// Compute the actual bind address based on the provided interface
+		iface, err := net.InterfaceByName(n.BindIface)
+		if err != nil {
+			return fmt.Errorf("getting interface by name %s: %w", n.BindIface, err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return fmt.Errorf("getting addresses for interface %s: %w", n.BindIface, err)
+		}
+		if len(addrs) > 0 {
+			if addr, ok := addrs[0].(*net.IPNet); ok {
+				n.BindAddr = addr.IP.String()
+			}
+		}
+	} else if n.BindAddr == "" && n.BindIface == "" {
+		// FIXME: this is a workaround for memberlist refusing to listen on public IPs if BindAddr==0.0.0.0
+		detectedBindAddr, err := sockaddr.GetPublicIP()
+		if err != nil {
+			return err
+		}
+		// if we cannot find a public IP, let memberlist do its thing
+		if detectedBindAddr != "" {
+			n.BindAddr = detectedBindAddr
+		} else {
+			n.BindAddr = "0.0.0.0"
+		}
+	}
+
+	return nil
+}
+
+func (n *networkConfig) prober() health.Prober {
+	switch n.HealthProbe {
+	case "icmp":
+		return health.ICMPProber{}
+	case "udp":
+		return health.UDPProber{Port: n.ProbePort}
+	default:
+		return nil
+	}
+}
+
+func (n *networkConfig) topology() wg.Topology {
+	switch n.Topology {
+	case "hub-and-spoke":
+		return wg.HubAndSpoke{Hubs: n.Hubs}
+	case "rules":
+		return wg.PeerRules(n.PeerRules)
+	default:
+		return wg.FullMesh{}
+	}
+}
+
+// run sets up the network and keeps it configured according to cluster changes, until the context is cancelled.
+func (n *networkConfig) run(ctx context.Context, shared *facilities) error {
+	logger := shared.logger
+	// the main loop logs through the subsystem concerned, so the subsystem log levels apply
+	log := logger("cluster").WithField("network", n.Name)
+	wgLog := logger("wireguard").WithField("network", n.Name)
+	hostsLog := logger("etchosts").WithField("network", n.Name)
+	healthLog := logger("health").WithField("network", n.Name)
+	fwLog := logger("firewall").WithField("network", n.Name)
+
+	// Prepare the hooks and webhooks, run in the background so they don't hold up the main loop
+	hookRunner := hooks.New(hooks.Config{
+		OnJoin:   n.OnJoin,
+		OnLeave:  n.OnLeave,
+		OnUpdate: n.OnUpdate,
+		Timeout:  n.HookTimeout,
+		Logger:   logger("hooks").WithField("network", n.Name),
+	})
+	go hookRunner.Run(ctx)
+	webhookEmitter := webhooks.New(webhooks.Config{
+		URLs:   n.Webhooks,
+		Secret: []byte(n.WebhookSecret),
+		Logger: logger("webhooks").WithField("network", n.Name),
+	})
+	go webhookEmitter.Run(ctx)
+	notify := func(events ...common.Event) {
+		hookRunner.Notify(events...)
+		webhookEmitter.Notify(events...)
+		shared.events.Publish(events...)
+	}
+
+	// In Kubernetes, the node name, cluster key and seeds are provided by the API
+	clusterKey, seeds, nodeName, podCIDRs := n.ClusterKey.bytes, n.seeds, "", n.PodCIDRs
+	var kubeClient *kube.Client
+	if n.Kubernetes {
+		var err error
+		kubeClient, err = kube.NewInCluster(n.KubeNamespace, n.KubeNodeName, n.KubeSelector)
+		if err != nil {
+			return err
+		}
+		if n.KubeSecret != "" {
+			clusterKey, err = kubeClient.ClusterKey(ctx, n.KubeSecret)
+			if err != nil {
+				return err
+			}
+			if len(clusterKey) != cluster.KeyLen {
+				return fmt.Errorf("unsupported cluster key length in secret %s; expected %d, got %d", n.KubeSecret, cluster.KeyLen, len(clusterKey))
+			}
+		}
+		if len(n.Join) == 0 {
+			seeds = kubeClient
+		} else {
+			seeds = discovery.Providers{n.seeds, kubeClient}
+		}
+		nodeName = n.KubeNodeName
+		if n.PodRouting && len(podCIDRs) == 0 {
+			podCIDRs, err = kubeClient.PodCIDRs(ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Create the wireguard and cluster configuration
+	banned := make(chan cluster.Revocation, 1)
+	cluster, err := cluster.New(cluster.Config{
+		Name:          n.Interface,
+		StateDir:      n.StateDir,
+		Init:          n.Init,
+		ClusterKey:    clusterKey,
+		BindAddr:      n.BindAddr,
+		BindPort:      n.ClusterPort,
+		AdvertiseAddr: n.AdvertiseAddr,
+		AdvertisePort: n.AdvertisePort,
+		HealInterval:  n.HealInterval,
+		HealTimeout:   n.HealTimeout,
+		StateMaxAge:   n.StateMaxAge,
+		NodeName:      nodeName,
+		UseIPAsName:   n.UseIPAsName,
+		OnReject: func(node common.Node, reason error) {
+			event := common.NewEvent(common.EventAdmissionRejected, n.Name, node)
+			event.Reason = reason.Error()
+			notify(event)
+		},
+		CompactMeta: n.CompactMeta,
+		BanKeys:     n.BanKeys,
+		OnBanned: func(rev cluster.Revocation) {
+			select {
+			case banned <- rev:
+			default: // already leaving
+			}
+		},
+
+		Logger:           logger("cluster").WithField("network", n.Name),
+		MemberlistLogger: logger("memberlist").WithField("network", n.Name),
+	})
+	if err != nil {
+		return fmt.Errorf("could not create cluster: %w", err)
+	}
+	wgstate, localNode, err := wg.New(n.Interface, n.WireguardPort, n.OverlayNet, cluster.LocalName, cluster.WireguardKey())
+	if err != nil {
+		return fmt.Errorf("could not instantiate wireguard controller: %w", err)
+	}
+	cluster.SetWireguardKey(wgstate.PrivKey.String())
+	wgstate.Logger = wgLog
+	wgstate.Logger.Debugf("assigned overlay address: %s", localNode.OverlayAddr)
+	localNode.Labels = n.Labels
+	localNode.Relay = n.Relay
+	localNode.BehindNAT = n.BehindNAT
+	localNode.Endpoint = n.AdvertiseEndpoint
+	if n.PodRouting {
+		localNode.Routes = podCIDRs
+	}
+	localNode.PresharedKeys = n.PresharedKeys
+	// peers refuse nodes without metadata, so fail early instead of silently dropping out of the cluster
+	if err := localNode.ValidateMeta(memberlist.MetaMaxSize, n.CompactMeta); err != nil {
+		if !n.CompactMeta {
+			return fmt.Errorf("node metadata too large, use fewer or shorter labels, or --compact-meta once all nodes are upgraded: %w", err)
+		}
+		return fmt.Errorf("node metadata too large, use fewer or shorter labels: %w", err)
+	}
+	// bans are persisted, so a banned node stays out of the cluster until it is re-initialized
+	if rev, ok := cluster.Banned(localNode); ok {
+		log.WithField("issuer", rev.Issuer.String()).Error("banned from cluster; not joining until run with --init")
+		cluster.Leave()
+		return nil
+	}
+	if n.PresharedKeys {
+		wgstate.PresharedKeySecret = cluster.ClusterKey()
+	}
+	wgstate.Topology = n.topology()
+	wgstate.Relay = n.Relay
+	wgstate.PeerRoutes = n.PodRouting
+	wgstate.HandshakeTimeout = n.HandshakeTimeout
+	wgstate.OnHandshakeFailed = func(node common.Node) {
+		notify(common.NewEvent(common.EventHandshakeFailed, n.Name, node))
+	}
+
+	// Prepare the hosts entries writers
+	hostsBanner := "# ! managed automatically by wesher interface " + n.Interface
+	hostsSinks := make([]hostsSink, 0, 2)
+	if !n.NoEtcHosts {
+		hostsSinks = append(hostsSinks, &etchosts.EtcHosts{
+			Banner: hostsBanner,
+			Path:   n.HostsFile,
+			Logger: hostsLog,
+		})
+	}
+	if n.HostsDir != "" {
+		hostsSinks = append(hostsSinks, &etchosts.Dir{
+			Banner: hostsBanner,
+			Path:   n.HostsDir,
+			Logger: hostsLog,
+		})
+	}
+
+	// Prepare the tunnel health checker, probing in the background
+	checker := &health.Checker{
+		Prober:   n.prober(),
+		Interval: n.ProbeInterval,
+		Logger:   healthLog,
+	}
+	go checker.Run(ctx)
+	probeResponder := func() {} // started once the interface is up, since it binds the overlay address
+	if n.HealthProbe == "udp" {
+		probeResponder = func() {
+			go func() {
+				if err := health.ServeUDP(ctx, netip.AddrPortFrom(localNode.OverlayAddr, uint16(n.ProbePort))); err != nil {
+					healthLog.WithError(err).Error("could not answer health probes")
+				}
+			}()
+			probeResponder = func() {}
+		}
+	}
+
+	// Prepare the firewall, restricting the cluster ports to the current members and the nodes which may rejoin
+	var fw *firewall.Firewall
+	if n.Firewall {
+		fw = &firewall.Firewall{
+			Table:  "wesher-" + n.Interface,
+			Logger: fwLog,
+		}
+	}
+	applyFirewall := func(nodes []common.Node) {
+		if fw == nil {
+			return
+		}
+		allows, filterOverlay := n.policy.Compile(localNode, nodes)
+		ruleset := firewall.Ruleset{
+			Interface:     n.Interface,
+			WireguardPort: n.WireguardPort,
+			ClusterPort:   n.ClusterPort,
+			Members:       firewallMembers(nodes, cluster.KnownNodes(), wgstate.ObservedEndpoints(nodes)),
+			JoinFrom:      n.FirewallJoinFrom,
+			FilterOverlay: filterOverlay,
+			Allow:         allows,
+		}
+		if n.HealthProbe == "udp" {
+			ruleset.ProbePort = n.ProbePort
+		}
+		if err := fw.Apply(ruleset); err != nil {
+			fwLog.WithError(err).Error("could not apply firewall rules")
+		}
+	}
+
+	// Report the network's status, including how far it is set up
+	progress := &setupProgress{}
+	shared.register(n.Name, func() control.NetworkStatus {
+		status := control.NetworkStatus{
+			Name:        n.Name,
+			Interface:   n.Interface,
+			Node:        localNode.Name,
+			Overlay:     localNode.OverlayAddr.String(),
+			Members:     cluster.NumMembers(),
+			Partitioned: cluster.Partitioned(),
+			BehindNAT:   cluster.BehindNAT(),
+			Peers:       checker.Peers(),
+		}
+		progress.apply(&status)
+		return status
+	})
+
+	// Banned nodes are dropped from the cluster members, which updates the peers and hosts entries
+	shared.registerBan(n.Name, cluster.Revoke)
+
+	// Apply the cluster members to the interface and hosts entries
+	peers := &peerConfigurer{
+		iface:    wgstate,
+		checker:  checker,
+		sinks:    hostsSinks,
+		entries:  n.hostsEntries,
+		progress: progress,
+		onUp:     func() { probeResponder() },
+		wgLog:    wgLog,
+		hostsLog: hostsLog,
+	}
+
+	// Pre-configure peers known from the last run, so traffic can resume before the cluster is joined
+	nodes := decodeNodes(log, cluster.KnownNodes())
+	if len(nodes) > 0 {
+		log.Infof("configuring %d peers from known state", len(nodes))
+		applyFirewall(nodes)
+		wgstate.BehindNAT = localNode.BehindNAT
+		if err := wgstate.SetUpInterface(nodes); err != nil {
+			wgLog.WithError(err).Error("could not up interface from known state")
+		} else {
+			probeResponder()
+		}
+	}
+
+	// Publish the local node on the Kubernetes node; retried with the peer checks until it succeeds
+	annotated := kubeClient == nil
+	annotate := func() {
+		if annotated {
+			return
+		}
+		if err := kubeClient.Annotate(ctx, n.Name, localNode.OverlayAddr, localNode.PubKey); err != nil {
+			log.WithError(err).Warn("could not annotate kubernetes node")
+			return
+		}
+		annotated = true
+	}
+	annotate()
+
+	// Join the cluster
+	cluster.Update(localNode)
+
+	nodec := cluster.Members()
+	if err := backoff.RetryNotify(
+		func() error { return cluster.Join(seeds) },
+		backoff.WithContext(backoff.NewExponentialBackOff(), ctx),
+		func(err error, dur time.Duration) {
+			log.WithError(err).Errorf("could not join cluster, retrying in %s", dur)
+		},
+	); err != nil {
+		cluster.Leave()
+		if ctx.Err() != nil {
+			return nil // terminated while joining
+		}
+		return fmt.Errorf("could not join cluster: %w", err)
+	}
+	progress.set(func(p *setupProgress) { p.joined = true })
+
+	// Set up the interface and hosts entries right away: the first node of a cluster - or one whose peers are all down -
+	// may not see any membership event for a long time, and would otherwise never become ready
+	applyFirewall(nodes)
+	wgstate.BehindNAT = cluster.BehindNAT()
+	peers.apply(nodes)
+
+	// peers are periodically re-checked for reachability, to route them through relays if necessary
+	peerCheck := time.NewTicker(peerCheckInterval)
+	defer peerCheck.Stop()
+
+	// teardown leaves the cluster and removes everything set up for it
+	teardown := func() {
+		cluster.Leave()
+		for _, sink := range hostsSinks {
+			if err := sink.WriteEntries(map[string][]string{}); err != nil {
+				hostsLog.WithError(err).Error("could not remove stale hosts entries")
+			}
+		}
+		if err := wgstate.DownInterface(); err != nil {
+			wgLog.WithError(err).Error("could not down interface")
+		}
+		if fw != nil {
+			if err := fw.Remove(); err != nil {
+				fwLog.WithError(err).Error("could not remove firewall rules")
+			}
+		}
+	}
+
+	// Main loop
+	log.Debug("waiting for cluster events")
+	for {
+		select {
+		case rawNodes := <-nodec:
+			newNodes := decodeNodes(log, rawNodes)
+			notify(common.DiffNodes(n.Name, nodes, newNodes)...)
+			nodes = newNodes
+			applyFirewall(nodes)
+			wgstate.BehindNAT = cluster.BehindNAT()
+			peers.apply(nodes)
+		case <-peerCheck.C:
+			annotate()
+			wgstate.BehindNAT = cluster.BehindNAT()
+			if !peers.refresh(nodes) {
+				continue
+			}
+			for name, endpoint := range wgstate.ObservedEndpoints(nodes) {
+				if err := cluster.ReportEndpoint(name, endpoint); err != nil {
+					log.WithError(err).WithField("node", name).Debug("could not report observed endpoint")
+				}
+			}
+			applyFirewall(nodes) // let newly observed endpoints through
+			peers.updateHosts(nodes, true)
+		case rev := <-banned:
+			log.WithField("issuer", rev.Issuer.String()).Error("banned from cluster; leaving")
+			teardown()
+			return nil
+		case <-ctx.Done():
+			log.Info("terminating...")
+			teardown()
+			return nil
+		}
+	}
+}
+
+// peerInterface configures the wireguard interface with the peers among the cluster members.
+type peerInterface interface {
+	SetUpInterface(nodes []common.Node) error
+	DownInterface() error
+	Peers(nodes []common.Node) []common.Node
+	PeerStats(nodes []common.Node) []wg.PeerStats
+}
+
+// peerConfigurer applies the cluster members to the wireguard interface and hosts entries, recording the progress.
+type peerConfigurer struct {
+	iface   peerInterface
+	checker *health.Checker
+	sinks   []hostsSink
+	// entries returns the hosts entries of the provided peers
+	entries  func(peers []common.Node, checker *health.Checker) map[string][]string
+	progress *setupProgress
+	// onUp is called every time the interface is configured successfully
+	onUp     func()
+	wgLog    logrus.FieldLogger
+	hostsLog logrus.FieldLogger
+
+	// written are the hosts entries last written, or nil if writing failed
+	written map[string][]string
+}
+
+// apply configures the interface with the provided peers - possibly none - and writes their hosts entries.
+// The interface is brought down if it cannot be configured.
+func (c *peerConfigurer) apply(nodes []common.Node) {
+	err := c.iface.SetUpInterface(nodes)
+	if err != nil {
+		c.wgLog.WithError(err).Error("could not up interface")
+		c.iface.DownInterface() // nolint: errcheck // opportunistic
+	} else {
+		c.onUp()
+	}
+	c.updateHosts(nodes, err == nil)
+}
+
+// refresh reconfigures the interface with the provided peers, e.g. to route them through relays, returning whether it
+// succeeded.
+func (c *peerConfigurer) refresh(nodes []common.Node) bool {
+	if err := c.iface.SetUpInterface(nodes); err != nil {
+		c.wgLog.WithError(err).Error("could not refresh interface")
+		c.progress.set(func(p *setupProgress) { p.interfaceUp = false })
+		return false
+	}
+	return true
+}
+
+// updateHosts updates the tunnel health and writes the hosts entries of the provided peers.
+func (c *peerConfigurer) updateHosts(nodes []common.Node, interfaceUp bool) {
+	c.checker.Update(c.iface.PeerStats(nodes))
+	entries := c.entries(c.iface.Peers(nodes), c.checker)
+	c.written = writeHosts(c.hostsLog, c.sinks, c.written, entries)
+	c.progress.set(func(p *setupProgress) {
+		p.interfaceUp = interfaceUp
+		p.hostsWritten = c.written != nil
+		p.hosts = entries
+	})
+}
+
+// setupProgress tracks how far a network is set up and its current hosts entries, for reporting.
+type setupProgress struct {
+	mu           sync.Mutex
+	joined       bool
+	interfaceUp  bool
+	hostsWritten bool
+	hosts        map[string][]string
+}
+
+func (p *setupProgress) set(update func(p *setupProgress)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	update(p)
+}
+
+func (p *setupProgress) apply(status *control.NetworkStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status.Joined = p.joined
+	status.InterfaceUp = p.interfaceUp
+	status.HostsWritten = p.hostsWritten
+	status.Hosts = p.hosts
+}
+
+// hostsSink receives the hosts entries of the peers.
+type hostsSink interface {
+	WriteEntries(ipsToNames map[string][]string) error
+}
+
+// hostsEntries returns the hosts entries for the provided peers.
+// Peers whose tunnel has been down for longer than HostsRemoveAfter are left out, so clients fail over to other hosts.
+func (n *networkConfig) hostsEntries(peers []common.Node, checker *health.Checker) map[string][]string {
+	hosts := make(map[string][]string, len(peers))
+	for _, node := range peers {
+		if n.HostsRemoveAfter > 0 && checker.DownFor(node.Name) > n.HostsRemoveAfter {
+			continue
+		}
+		hosts[node.OverlayAddr.String()] = []string{node.Name}
+	}
+	return hosts
+}
+
+// writeHosts writes the hosts entries to all sinks, if they changed since the last write, and returns the written
+// entries, or nil if writing failed.
+func writeHosts(log logrus.FieldLogger, sinks []hostsSink, written, hosts map[string][]string) map[string][]string {
+	if written != nil && reflect.DeepEqual(hosts, written) {
+		return written
+	}
+	for _, sink := range sinks {
+		if err := sink.WriteEntries(hosts); err != nil {
+			log.WithError(err).Error("could not write hosts entries")
+			return nil // retry on next change
+		}
+	}
+	return hosts
+}
+
+// decodeNodes decodes the metadata of the provided nodes, skipping nodes with invalid metadata.
+// firewallMembers returns the underlay addresses allowed through the firewall: besides the current members, those of
+// nodes known from the state - so failed or partitioned nodes can rejoin - and the endpoints peers were observed at,
+// which differ from their advertised ones behind NAT.
+func firewallMembers(members, known []common.Node, observed map[string]netip.AddrPort) []netip.Addr {
+	nodes := append([]common.Node(nil), members...)
+	for _, node := range known {
+		if err := node.DecodeMeta(); err != nil {
+			continue // already reported when loading the state
+		}
+		nodes = append(nodes, node)
+	}
+	endpoints := make([]netip.AddrPort, 0, len(observed))
+	for _, endpoint := range observed {
+		endpoints = append(endpoints, endpoint)
+	}
+	return firewall.MemberAddrs(nodes, endpoints...)
+}
+
+func decodeNodes(log logrus.FieldLogger, rawNodes []common.Node) []common.Node {
+	nodes := make([]common.Node, 0, len(rawNodes))
+	for _, node := range rawNodes {
+		if err := node.DecodeMeta(); err != nil {
+			log.WithError(err).WithFields(node.LogFields()).Warn("could not decode node metadata")
+			continue
+		}
+		log.WithFields(node.LogFields()).Info("cluster member")
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
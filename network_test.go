@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/costela/wesher/control"
+	"github.com/costela/wesher/health"
+	"github.com/costela/wesher/wg"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeInterface struct {
+	err  error
+	up   bool
+	down bool
+}
+
+func (f *fakeInterface) SetUpInterface(nodes []common.Node) error {
+	f.up = f.err == nil
+	return f.err
+}
+
+func (f *fakeInterface) DownInterface() error {
+	f.down = true
+	return nil
+}
+
+func (f *fakeInterface) Peers(nodes []common.Node) []common.Node { return nodes }
+
+func (f *fakeInterface) PeerStats(nodes []common.Node) []wg.PeerStats { return nil }
+
+type fakeHostsSink struct {
+	written map[string][]string
+}
+
+func (f *fakeHostsSink) WriteEntries(ipsToNames map[string][]string) error {
+	f.written = ipsToNames
+	return nil
+}
+
+func newTestPeerConfigurer(iface *fakeInterface, sink *fakeHostsSink) *peerConfigurer {
+	n := &networkConfig{}
+	return &peerConfigurer{
+		iface:    iface,
+		checker:  &health.Checker{},
+		sinks:    []hostsSink{sink},
+		entries:  n.hostsEntries,
+		progress: &setupProgress{joined: true},
+		onUp:     func() {},
+		wgLog:    logrus.StandardLogger(),
+		hostsLog: logrus.StandardLogger(),
+	}
+}
+
+func Test_peerConfigurer_apply_singleNode(t *testing.T) {
+	iface := &fakeInterface{}
+	sink := &fakeHostsSink{}
+	peers := newTestPeerConfigurer(iface, sink)
+
+	// the first node of a cluster has no peers, and may not see any membership event
+	peers.apply([]common.Node{})
+
+	status := control.NetworkStatus{}
+	peers.progress.apply(&status)
+	ready, reasons := status.Ready()
+	assert.True(t, ready, "a single node without peers should become ready: %v", reasons)
+	assert.True(t, iface.up)
+	assert.Equal(t, map[string][]string{}, sink.written, "empty hosts entries should be written")
+}
+
+func Test_peerConfigurer_apply_failure(t *testing.T) {
+	iface := &fakeInterface{err: fmt.Errorf("no wireguard")}
+	peers := newTestPeerConfigurer(iface, &fakeHostsSink{})
+
+	peers.apply([]common.Node{})
+	status := control.NetworkStatus{}
+	peers.progress.apply(&status)
+	ready, _ := status.Ready()
+	assert.False(t, ready)
+	assert.True(t, iface.down, "the interface should be brought down if it cannot be configured")
+
+	iface.err = nil
+	assert.True(t, peers.refresh([]common.Node{}))
+	peers.updateHosts([]common.Node{}, true)
+	peers.progress.apply(&status)
+	ready, _ = status.Ready()
+	assert.True(t, ready, "the network should become ready once the interface is refreshed")
+}
+
+func Test_firewallMembers(t *testing.T) {
+	member := common.Node{Name: "member", Addr: net.ParseIP("192.0.2.1")}
+	// failed or partitioned nodes are only known from the state, with their metadata still encoded
+	failed := common.Node{Name: "failed", Addr: net.ParseIP("192.0.2.2")}
+	failed.PublicEndpoint = netip.MustParseAddrPort("198.51.100.2:51820")
+	meta, err := failed.EncodeMeta(512)
+	require.NoError(t, err)
+	failed = common.Node{Name: failed.Name, Addr: failed.Addr, Meta: meta}
+
+	addrs := firewallMembers(
+		[]common.Node{member},
+		[]common.Node{member, failed},
+		map[string]netip.AddrPort{"nat": netip.MustParseAddrPort("203.0.113.1:4321")},
+	)
+
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("198.51.100.2"),
+		netip.MustParseAddr("203.0.113.1"),
+	}, addrs, "nodes known from the state and observed endpoints should be allowed in")
+}
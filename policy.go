@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/costela/wesher/firewall"
+)
+
+type PolicyCmd struct {
+	Check PolicyCheckCmd `cmd:"" help:"validate a policy file offline and print its rules"`
+}
+
+type PolicyCheckCmd struct {
+	File string `arg:"" type:"path" help:"path to the policy file"`
+}
+
+func (p *PolicyCheckCmd) Run() error {
+	policy, err := firewall.LoadPolicy(p.File)
+	if err != nil {
+		return err
+	}
+	return printPolicy(os.Stdout, policy)
+}
+
+func printPolicy(out io.Writer, policy *firewall.Policy) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%d rules\n", len(policy.Rules))
+	if len(policy.Rules) > 0 {
+		fmt.Fprintln(w, "FROM\tTO\tPROTOCOL\tPORTS")
+	}
+	for _, rule := range policy.Rules {
+		ports := make([]string, 0, len(rule.Ports))
+		for _, p := range rule.Ports {
+			ports = append(ports, p.String())
+		}
+		if len(ports) == 0 {
+			ports = append(ports, "all")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", joinTargets(rule.From), joinTargets(rule.To), rule.Protocol, strings.Join(ports, ","))
+	}
+	return w.Flush()
+}
+
+func joinTargets(targets []firewall.Target) string {
+	s := make([]string, 0, len(targets))
+	for _, t := range targets {
+		s = append(s, t.String())
+	}
+	return strings.Join(s, ",")
+}
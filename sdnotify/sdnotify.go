@@ -0,0 +1,46 @@
+// Package sdnotify implements the systemd service notification protocol, used by services of Type=notify to report
+// their readiness and status.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// Ready tells systemd the service finished starting up.
+	Ready = "READY=1"
+	// Stopping tells systemd the service is shutting down.
+	Stopping = "STOPPING=1"
+)
+
+// Status returns the notification setting the free-form status shown by systemctl.
+func Status(status string) string {
+	return "STATUS=" + strings.ReplaceAll(status, "\n", " ")
+}
+
+// Notify sends the provided notifications to systemd.
+// It returns false without error if the service was not started by systemd with notifications enabled.
+func Notify(states ...string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// abstract sockets are denoted by a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("connecting to notification socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, fmt.Errorf("sending notification: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/costela/wesher/control"
+)
+
+type StatusCmd struct {
+	JSON bool `help:"print the status as JSON"`
+}
+
+func (s *StatusCmd) Run(cli *cli) error {
+	resp, err := control.Client(cli.ControlSocket).Get("http://wesher/status")
+	if err != nil {
+		return fmt.Errorf("could not contact agent: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from agent: %s", resp.Status)
+	}
+
+	if s.JSON {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	networks := []control.NetworkStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&networks); err != nil {
+		return fmt.Errorf("could not decode agent status: %w", err)
+	}
+	return printStatus(os.Stdout, networks, time.Now())
+}
+
+func printStatus(out io.Writer, networks []control.NetworkStatus, now time.Time) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for i, n := range networks {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if n.Error != "" {
+			fmt.Fprintf(w, "network %s failed: %s\n", n.Name, n.Error)
+			continue
+		}
+		fmt.Fprintf(w, "network %s (interface %s, node %s, overlay %s)\n", n.Name, n.Interface, n.Node, n.Overlay)
+		fmt.Fprintf(w, "members: %d, partitioned: %t, behind NAT: %t\n", n.Members, n.Partitioned, n.BehindNAT)
+		if len(n.Peers) == 0 {
+			continue
+		}
+		fmt.Fprintln(w, "PEER\tOVERLAY\tENDPOINT\tSTATUS\tSINCE\tHANDSHAKE\tRTT\tRX\tTX")
+		for _, p := range n.Peers {
+			endpoint := p.Endpoint
+			if p.Relayed {
+				endpoint += " (relayed)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+				p.Node, p.Overlay, endpoint, p.Status, ago(now, p.Since), ago(now, p.LastHandshake), p.RTT, p.RxBytes, p.TxBytes)
+		}
+	}
+	return w.Flush()
+}
+
+// ago formats the time elapsed since t, or "never" for the zero time.
+func ago(now, t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Truncate(time.Second).String() + " ago"
+}
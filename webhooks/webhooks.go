@@ -0,0 +1,177 @@
+// Package webhooks posts cluster events to HTTP endpoints.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus"
+)
+
+// SignatureHeader is the HTTP header carrying the HMAC-SHA256 signature of the request body, in the form
+// "sha256=<hex>".
+const SignatureHeader = "X-Wesher-Signature"
+
+// EventHeader is the HTTP header carrying the event type.
+const EventHeader = "X-Wesher-Event"
+
+// DefaultQueueSize is the default number of events buffered per URL; further events are dropped.
+const DefaultQueueSize = 100
+
+// DefaultRetryTimeout is the default time after which delivering an event is given up.
+const DefaultRetryTimeout = 5 * time.Minute
+
+// requestTimeout limits how long a single delivery attempt may take.
+const requestTimeout = 10 * time.Second
+
+// Config holds the settings used to create an Emitter.
+type Config struct {
+	// URLs are the endpoints events are posted to.
+	URLs []string
+	// Secret is the key used to sign payloads.
+	Secret []byte
+	// QueueSize is the number of events buffered per URL; defaults to DefaultQueueSize.
+	QueueSize int
+	// RetryTimeout is the time after which delivering an event is given up; defaults to DefaultRetryTimeout.
+	RetryTimeout time.Duration
+	// Client is used to post events; defaults to a client with a short timeout.
+	Client *http.Client
+	// Logger is used to log delivery failures; defaults to the standard logrus logger.
+	Logger logrus.FieldLogger
+}
+
+// Emitter posts events to webhooks.
+// Each URL has its own bounded queue, so a slow or failing receiver delays neither the caller nor other receivers.
+type Emitter struct {
+	config  Config
+	senders []*sender
+}
+
+type sender struct {
+	url   string
+	queue chan common.Event
+}
+
+// New returns an Emitter for the provided config, or nil if no URL is configured.
+func New(config Config) *Emitter {
+	if len(config.URLs) == 0 {
+		return nil
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if config.RetryTimeout == 0 {
+		config.RetryTimeout = DefaultRetryTimeout
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: requestTimeout}
+	}
+	if config.Logger == nil {
+		config.Logger = logrus.StandardLogger()
+	}
+	e := &Emitter{config: config}
+	for _, url := range config.URLs {
+		e.senders = append(e.senders, &sender{url: url, queue: make(chan common.Event, config.QueueSize)})
+	}
+	return e
+}
+
+// Notify queues the provided events for delivery, without waiting for them to be delivered.
+// It is safe to call on a nil Emitter.
+func (e *Emitter) Notify(events ...common.Event) {
+	if e == nil {
+		return
+	}
+	for _, s := range e.senders {
+		for _, event := range events {
+			select {
+			case s.queue <- event:
+			default:
+				e.config.Logger.WithField("url", s.url).WithField("event", event.Type).Warn("webhook queue full; dropping event")
+			}
+		}
+	}
+}
+
+// Run delivers queued events until the context is cancelled.
+// It is safe to call on a nil Emitter.
+func (e *Emitter) Run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	done := make(chan struct{})
+	for _, s := range e.senders {
+		go func(s *sender) {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case event := <-s.queue:
+					if err := e.deliver(ctx, s.url, event); err != nil && ctx.Err() == nil {
+						e.config.Logger.WithError(err).WithField("url", s.url).WithField("event", event.Type).Warn("could not deliver webhook")
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(s)
+	}
+	for range e.senders {
+		<-done
+	}
+}
+
+// deliver posts a single event, retrying with exponential backoff.
+func (e *Emitter) deliver(ctx context.Context, url string, event common.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+	signature := Sign(e.config.Secret, payload)
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = e.config.RetryTimeout
+	return backoff.Retry(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(EventHeader, string(event.Type))
+		req.Header.Set(SignatureHeader, signature)
+
+		resp, err := e.config.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) // nolint: errcheck // allow connection reuse
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+			// retrying will not help
+			return backoff.Permanent(fmt.Errorf("unexpected status %s", resp.Status))
+		default:
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}, backoff.WithContext(b, ctx))
+}
+
+// Sign returns the signature of the provided payload, as sent in SignatureHeader.
+// Receivers should compute the same signature over the raw request body and compare them in constant time.
+func Sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
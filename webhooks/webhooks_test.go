@@ -0,0 +1,95 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_New_noURLs(t *testing.T) {
+	e := New(Config{})
+	assert.Nil(t, e)
+	// nil emitters must be usable
+	e.Notify(common.Event{Type: common.EventJoin})
+	e.Run(context.Background())
+}
+
+func Test_Emitter_deliver(t *testing.T) {
+	secret := []byte("secret")
+	received := make(chan common.Event, 1)
+	attempts := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, Sign(secret, body), r.Header.Get(SignatureHeader))
+		assert.Equal(t, "join", r.Header.Get(EventHeader))
+		event := common.Event{}
+		require.NoError(t, json.Unmarshal(body, &event))
+		received <- event
+	}))
+	defer server.Close()
+
+	e := New(Config{URLs: []string{server.URL}, Secret: secret})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx)
+
+	e.Notify(common.Event{Type: common.EventJoin, Node: "node1"})
+
+	select {
+	case event := <-received:
+		assert.Equal(t, "node1", event.Node)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&attempts), "failed delivery should be retried")
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}
+
+func Test_Emitter_deliver_permanentFailure(t *testing.T) {
+	attempts := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	e := New(Config{URLs: []string{server.URL}})
+	err := e.deliver(context.Background(), server.URL, common.Event{Type: common.EventLeave})
+
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&attempts), "client errors should not be retried")
+}
+
+func Test_Emitter_Notify_bounded(t *testing.T) {
+	logger, logs := test.NewNullLogger()
+	e := New(Config{URLs: []string{"http://192.0.2.1"}, QueueSize: 2, Logger: logger})
+
+	done := make(chan struct{})
+	go func() {
+		// not running the emitter, so nothing is consumed
+		e.Notify(common.Event{Node: "a"}, common.Event{Node: "b"}, common.Event{Node: "c"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Notify blocked on full queue")
+	}
+	assert.Len(t, e.senders[0].queue, 2)
+	assert.Len(t, logs.AllEntries(), 1)
+}
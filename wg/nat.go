@@ -0,0 +1,142 @@
+package wg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keepaliveInterval is the persistent keepalive interval used for peers which need it, e.g. nodes behind NAT.
+const keepaliveInterval = 25 * time.Second
+
+const (
+	// endpointCacheTTL is how long resolved advertised endpoints are reused before looking them up again, to follow DNS
+	// changes without a lookup on every peer update.
+	endpointCacheTTL = 10 * time.Minute
+	// endpointRetryInterval is how long failed lookups of advertised endpoints are cached.
+	endpointRetryInterval = time.Minute
+	// endpointLookupTimeout bounds lookups of advertised endpoints, which block peer updates.
+	endpointLookupTimeout = 5 * time.Second
+)
+
+// resolvedEndpoint caches the result of looking up an advertised endpoint.
+type resolvedEndpoint struct {
+	addr    *net.UDPAddr
+	err     error
+	expires time.Time
+}
+
+// ObservedEndpoints returns the endpoints under which we currently see the provided nodes, i.e.: the addresses our
+// last handshakes with them were completed over.
+// These may differ from the advertised addresses for nodes behind NAT.
+func (s *State) ObservedEndpoints(nodes []common.Node) map[string]netip.AddrPort {
+	observed := make(map[string]netip.AddrPort)
+	for _, node := range nodes {
+		pubKey, err := wgtypes.ParseKey(node.PubKey)
+		if err != nil {
+			continue
+		}
+		endpoint, ok := s.endpoints[pubKey]
+		if !ok || !endpoint.IsValid() || time.Since(s.handshakes[pubKey]) > s.handshakeTimeout() {
+			continue
+		}
+		observed[node.Name] = endpoint
+	}
+	return observed
+}
+
+// peerEndpoint returns the endpoint under which the provided node should be contacted.
+// Explicitly advertised endpoints take precedence. Nodes behind NAT are contacted under their public endpoint, as
+// observed by other nodes. If both sides are behind NAT, contacting each other's public endpoints with persistent
+// keepalives doubles as UDP hole punching.
+// Otherwise, nodes are contacted on their cluster address and their wireguard port, falling back to our own port for
+// nodes not advertising one (i.e.: older versions).
+func (s *State) peerEndpoint(node *common.Node) *net.UDPAddr {
+	if node.Endpoint != "" {
+		endpoint, err := s.resolveEndpoint(node.Endpoint)
+		if err == nil {
+			return endpoint
+		}
+		s.log().WithError(err).WithField("node", node.Name).Warn("could not resolve advertised endpoint; falling back to its address")
+	}
+	if node.BehindNAT && node.PublicEndpoint.IsValid() {
+		return net.UDPAddrFromAddrPort(node.PublicEndpoint)
+	}
+	port := node.WireguardPort
+	if port == 0 {
+		port = s.Port
+	}
+	return &net.UDPAddr{
+		IP:   node.Addr,
+		Port: port,
+	}
+}
+
+// resolveEndpoint resolves an advertised "host:port" endpoint, caching the result so peers are not looked up again on
+// every update.
+func (s *State) resolveEndpoint(endpoint string) (*net.UDPAddr, error) {
+	if addrPort, err := netip.ParseAddrPort(endpoint); err == nil {
+		return net.UDPAddrFromAddrPort(addrPort), nil
+	}
+	now := time.Now()
+	if cached, ok := s.resolved[endpoint]; ok && now.Before(cached.expires) {
+		return cached.addr, cached.err
+	}
+
+	addr, err := s.lookupEndpoint(endpoint)
+	if s.resolved == nil {
+		s.resolved = make(map[string]resolvedEndpoint)
+	}
+	for key, cached := range s.resolved {
+		if now.After(cached.expires) {
+			delete(s.resolved, key)
+		}
+	}
+	cached := resolvedEndpoint{addr: addr, err: err, expires: now.Add(endpointCacheTTL)}
+	if err != nil {
+		cached.expires = now.Add(endpointRetryInterval)
+	}
+	s.resolved[endpoint] = cached
+	return addr, err
+}
+
+func (s *State) lookupEndpoint(endpoint string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in endpoint %q", endpoint)
+	}
+	lookup := s.lookupHost
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIPAddr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), endpointLookupTimeout)
+	defer cancel()
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("looking up endpoint %q: %w", endpoint, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for endpoint %q", endpoint)
+	}
+	return &net.UDPAddr{IP: addrs[0].IP, Port: int(port), Zone: addrs[0].Zone}, nil
+}
+
+// peerKeepalive returns the persistent keepalive for the provided node, if any is needed.
+// Keepalives are needed to keep NAT mappings open, so they are used both if we or the peer are behind NAT.
+func (s *State) peerKeepalive(node *common.Node) *time.Duration {
+	if !s.BehindNAT && !node.BehindNAT {
+		return nil
+	}
+	keepalive := keepaliveInterval
+	return &keepalive
+}
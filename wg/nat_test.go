@@ -0,0 +1,121 @@
+package wg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func Test_State_nodesToPeerConfigs_nat(t *testing.T) {
+	nodes := testNodes(t, "public", "natted", "natted-unknown-endpoint")
+	nodes[1].BehindNAT = true
+	nodes[1].PublicEndpoint = netip.MustParseAddrPort("198.51.100.1:1234")
+	nodes[2].BehindNAT = true
+
+	s := &State{Port: 51820, localNode: &common.Node{Name: "local"}}
+
+	peerCfgs, err := s.nodesToPeerConfigs(nodes)
+	require.NoError(t, err)
+	require.Len(t, peerCfgs, 3)
+
+	assert.Equal(t, &net.UDPAddr{IP: nodes[0].Addr, Port: 51820}, peerCfgs[0].Endpoint)
+	assert.Nil(t, peerCfgs[0].PersistentKeepaliveInterval)
+
+	assert.Equal(t, "198.51.100.1:1234", peerCfgs[1].Endpoint.String())
+	require.NotNil(t, peerCfgs[1].PersistentKeepaliveInterval)
+	assert.Equal(t, keepaliveInterval, *peerCfgs[1].PersistentKeepaliveInterval)
+
+	assert.Equal(t, &net.UDPAddr{IP: nodes[2].Addr, Port: 51820}, peerCfgs[2].Endpoint)
+	assert.NotNil(t, peerCfgs[2].PersistentKeepaliveInterval)
+
+	// when we are behind NAT ourselves, all peers need keepalives
+	s.BehindNAT = true
+	peerCfgs, err = s.nodesToPeerConfigs(nodes)
+	require.NoError(t, err)
+	assert.NotNil(t, peerCfgs[0].PersistentKeepaliveInterval)
+}
+
+func Test_State_ObservedEndpoints(t *testing.T) {
+	nodes := testNodes(t, "recent", "stale", "unknown")
+	recent, stale := mustParseKey(t, nodes[0].PubKey), mustParseKey(t, nodes[1].PubKey)
+
+	s := &State{}
+	s.updatePeerStatus(&wgtypes.Device{Peers: []wgtypes.Peer{
+		{
+			PublicKey:         recent,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234},
+			LastHandshakeTime: time.Now(),
+		},
+		{
+			PublicKey:         stale,
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 1234},
+			LastHandshakeTime: time.Now().Add(-time.Hour),
+		},
+	}})
+
+	assert.Equal(t, map[string]netip.AddrPort{
+		"recent": netip.MustParseAddrPort("198.51.100.1:1234"),
+	}, s.ObservedEndpoints(nodes))
+}
+
+func Test_State_peerEndpoint(t *testing.T) {
+	s := &State{Port: 51820}
+
+	tests := []struct {
+		name string
+		node common.Node
+		want string
+	}{
+		{"default port", common.Node{Addr: net.ParseIP("192.0.2.1")}, "192.0.2.1:51820"},
+		{"own port", testNode(func(n *common.Node) { n.WireguardPort = 51821 }), "192.0.2.1:51821"},
+		{"advertised endpoint", testNode(func(n *common.Node) { n.Endpoint = "198.51.100.1:4000" }), "198.51.100.1:4000"},
+		{"invalid advertised endpoint", testNode(func(n *common.Node) { n.Endpoint = "invalid" }), "192.0.2.1:51820"},
+		{"advertised endpoint before public endpoint", testNode(func(n *common.Node) {
+			n.Endpoint = "198.51.100.1:4000"
+			n.BehindNAT = true
+			n.PublicEndpoint = netip.MustParseAddrPort("198.51.100.2:5000")
+		}), "198.51.100.1:4000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, s.peerEndpoint(&tt.node).String())
+		})
+	}
+}
+
+func testNode(modify func(*common.Node)) common.Node {
+	node := common.Node{Addr: net.ParseIP("192.0.2.1")}
+	modify(&node)
+	return node
+}
+
+func Test_State_peerEndpoint_Cached(t *testing.T) {
+	lookups := 0
+	s := &State{Port: 51820, lookupHost: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if host == "unknown.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []net.IPAddr{{IP: net.ParseIP("198.51.100.7")}}, nil
+	}}
+
+	resolved := testNode(func(n *common.Node) { n.Endpoint = "gw.example.com:4000" })
+	unknown := testNode(func(n *common.Node) { n.Endpoint = "unknown.example.com:4000" })
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "198.51.100.7:4000", s.peerEndpoint(&resolved).String())
+		assert.Equal(t, "192.0.2.1:51820", s.peerEndpoint(&unknown).String())
+	}
+	assert.Equal(t, 2, lookups, "endpoints should only be looked up once")
+
+	changed := testNode(func(n *common.Node) { n.Endpoint = "gw.example.com:4001" })
+	assert.Equal(t, "198.51.100.7:4001", s.peerEndpoint(&changed).String())
+	assert.Equal(t, 3, lookups, "changed endpoints should be looked up again")
+}
@@ -0,0 +1,59 @@
+package wg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/costela/wesher/common"
+	"golang.org/x/crypto/hkdf"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// presharedKeyInfo binds the derived keys to their use, so they cannot collide with other keys derived from the same
+// secret.
+const presharedKeyInfo = "wesher wireguard preshared key v1"
+
+// PresharedKey derives the preshared key of the pair of peers with the provided public keys from the shared secret.
+// The derivation does not depend on the order of the public keys, so both peers arrive at the same key.
+func PresharedKey(secret []byte, a, b wgtypes.Key) (wgtypes.Key, error) {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	info := make([]byte, 0, len(presharedKeyInfo)+2*wgtypes.KeyLen)
+	info = append(info, presharedKeyInfo...)
+	info = append(info, a[:]...)
+	info = append(info, b[:]...)
+
+	key := wgtypes.Key{}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key[:]); err != nil {
+		return wgtypes.Key{}, fmt.Errorf("deriving preshared key: %w", err)
+	}
+	return key, nil
+}
+
+// applyPresharedKeys sets the preshared keys of the peers: derived from PresharedKeySecret for peers also using
+// preshared keys, and cleared for all others, so preshared keys can be enabled and disabled one node at a time.
+func (s *State) applyPresharedKeys(nodes []common.Node, keys []wgtypes.Key, peerCfgs []wgtypes.PeerConfig) error {
+	current := make(map[wgtypes.Key]struct{}, len(nodes))
+	for i := range nodes {
+		psk := wgtypes.Key{} // the zero key removes any preshared key
+		if len(s.PresharedKeySecret) > 0 && nodes[i].PresharedKeys {
+			var err error
+			psk, err = PresharedKey(s.PresharedKeySecret, s.PubKey, keys[i])
+			if err != nil {
+				return err
+			}
+			current[keys[i]] = struct{}{}
+			if _, ok := s.presharedKeys[keys[i]]; !ok {
+				s.log().WithFields(nodes[i].LogFields()).Info("using preshared key with peer")
+			}
+		} else if _, ok := s.presharedKeys[keys[i]]; ok {
+			s.log().WithFields(nodes[i].LogFields()).Info("no longer using preshared key with peer")
+		}
+		peerCfgs[i].PresharedKey = &psk
+	}
+	s.presharedKeys = current
+	return nil
+}
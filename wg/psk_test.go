@@ -0,0 +1,65 @@
+package wg
+
+import (
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustGenerateKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return key.PublicKey()
+}
+
+func Test_PresharedKey(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	a, b, c := mustGenerateKey(t), mustGenerateKey(t), mustGenerateKey(t)
+
+	ab, err := PresharedKey(secret, a, b)
+	require.NoError(t, err)
+	ba, err := PresharedKey(secret, b, a)
+	require.NoError(t, err)
+	assert.Equal(t, ab, ba, "both peers should derive the same key")
+	assert.NotEqual(t, wgtypes.Key{}, ab)
+
+	ac, err := PresharedKey(secret, a, c)
+	require.NoError(t, err)
+	assert.NotEqual(t, ab, ac, "each pair should use a different key")
+
+	other, err := PresharedKey([]byte("fedcba9876543210fedcba9876543210"), a, b)
+	require.NoError(t, err)
+	assert.NotEqual(t, ab, other, "keys should depend on the secret")
+}
+
+func Test_State_applyPresharedKeys(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	local := mustGenerateKey(t)
+	keys := []wgtypes.Key{mustGenerateKey(t), mustGenerateKey(t)}
+	nodes := []common.Node{{Name: "enabled"}, {Name: "disabled"}}
+	nodes[0].PresharedKeys = true
+
+	s := &State{PubKey: local, PresharedKeySecret: secret}
+	peerCfgs := make([]wgtypes.PeerConfig, len(nodes))
+	require.NoError(t, s.applyPresharedKeys(nodes, keys, peerCfgs))
+
+	want, err := PresharedKey(secret, local, keys[0])
+	require.NoError(t, err)
+	if assert.NotNil(t, peerCfgs[0].PresharedKey) {
+		assert.Equal(t, want, *peerCfgs[0].PresharedKey)
+	}
+	if assert.NotNil(t, peerCfgs[1].PresharedKey, "peers without preshared keys should have them cleared") {
+		assert.Equal(t, wgtypes.Key{}, *peerCfgs[1].PresharedKey)
+	}
+	assert.Contains(t, s.presharedKeys, keys[0])
+	assert.NotContains(t, s.presharedKeys, keys[1])
+
+	// disabled locally, keys are cleared for all peers
+	s.PresharedKeySecret = nil
+	require.NoError(t, s.applyPresharedKeys(nodes, keys, peerCfgs))
+	assert.Equal(t, wgtypes.Key{}, *peerCfgs[0].PresharedKey)
+	assert.Empty(t, s.presharedKeys)
+}
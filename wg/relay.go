@@ -0,0 +1,189 @@
+package wg
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultHandshakeTimeout is the default time after which a peer without a successful handshake is considered
+// unreachable. It is slightly longer than wireguard's own REJECT_AFTER_TIME, after which a session with a peer that
+// cannot be re-keyed is dropped.
+const DefaultHandshakeTimeout = 3 * time.Minute
+
+// updatePeerStatus keeps track of when peers were first configured and their last handshake times, which are used to
+// decide whether a peer is reachable.
+func (s *State) updatePeerStatus(device *wgtypes.Device) {
+	now := time.Now()
+	handshakes := make(map[wgtypes.Key]time.Time, len(device.Peers))
+	peerSince := make(map[wgtypes.Key]time.Time, len(device.Peers))
+	endpoints := make(map[wgtypes.Key]netip.AddrPort, len(device.Peers))
+	transfer := make(map[wgtypes.Key][2]int64, len(device.Peers))
+	for _, peer := range device.Peers {
+		handshakes[peer.PublicKey] = peer.LastHandshakeTime
+		transfer[peer.PublicKey] = [2]int64{peer.ReceiveBytes, peer.TransmitBytes}
+		if peer.Endpoint != nil {
+			endpoint := peer.Endpoint.AddrPort()
+			endpoints[peer.PublicKey] = netip.AddrPortFrom(endpoint.Addr().Unmap(), endpoint.Port())
+		}
+		if since, ok := s.peerSince[peer.PublicKey]; ok {
+			peerSince[peer.PublicKey] = since
+		} else {
+			peerSince[peer.PublicKey] = now
+		}
+	}
+	s.handshakes = handshakes
+	s.peerSince = peerSince
+	s.endpoints = endpoints
+	s.transfer = transfer
+}
+
+// reachable returns whether we recently completed a handshake with the given peer.
+// Peers configured less than HandshakeTimeout ago are given the benefit of the doubt.
+func (s *State) reachable(pubKey wgtypes.Key) bool {
+	since, ok := s.peerSince[pubKey]
+	if !ok || time.Since(since) < s.handshakeTimeout() {
+		return true
+	}
+	return time.Since(s.handshakes[pubKey]) < s.handshakeTimeout()
+}
+
+func (s *State) handshakeTimeout() time.Duration {
+	if s.HandshakeTimeout == 0 {
+		return DefaultHandshakeTimeout
+	}
+	return s.HandshakeTimeout
+}
+
+func (s *State) log() logrus.FieldLogger {
+	if s.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return s.Logger
+}
+
+// chooseRelay returns the index of the first relay node - sorted by name, so different nodes tend to pick the same
+// one - we can reach, or -1 if none is available.
+func (s *State) chooseRelay(nodes []common.Node, keys []wgtypes.Key, exclude int) int {
+	candidates := make([]int, 0)
+	for i, node := range nodes {
+		if i != exclude && node.Relay && s.reachable(keys[i]) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return -1
+	}
+	sort.Slice(candidates, func(i, j int) bool { return nodes[candidates[i]].Name < nodes[candidates[j]].Name })
+	return candidates[0]
+}
+
+// applyRelays moves the allowed IPs of unreachable peers to a reachable relay node, so traffic to them is routed
+// through it.
+// Unreachable peers are kept configured with persistent keepalives, so a direct connection can be re-established.
+func (s *State) applyRelays(nodes []common.Node, keys []wgtypes.Key, peerCfgs []wgtypes.PeerConfig) {
+	relayed := make(map[wgtypes.Key]wgtypes.Key)
+	hasRelays := s.Relay
+	for _, node := range nodes {
+		hasRelays = hasRelays || node.Relay
+	}
+	if !hasRelays {
+		s.relayed = relayed
+		return
+	}
+
+	// ensure handshakes keep being attempted - and therefore timestamps kept up-to-date - even for idle peers
+	keepalive := keepaliveInterval
+	for i := range peerCfgs {
+		peerCfgs[i].PersistentKeepaliveInterval = &keepalive
+	}
+
+	for i, node := range nodes {
+		if s.reachable(keys[i]) {
+			continue
+		}
+		previous, wasRelayed := s.relayed[keys[i]]
+		relay := s.chooseRelay(nodes, keys, i)
+		if relay < 0 {
+			// keep track of the peer with an empty relay key, to avoid repeating the warning
+			if !wasRelayed || previous != (wgtypes.Key{}) {
+				s.log().WithFields(node.LogFields()).Warn("peer unreachable and no relay available")
+			}
+			relayed[keys[i]] = wgtypes.Key{}
+			continue
+		}
+		if previous != keys[relay] {
+			s.log().WithFields(node.LogFields()).WithField("relay", nodes[relay].Name).Info("peer unreachable, relaying")
+		}
+		relayed[keys[i]] = keys[relay]
+		peerCfgs[relay].AllowedIPs = append(peerCfgs[relay].AllowedIPs, peerCfgs[i].AllowedIPs...)
+		peerCfgs[i].AllowedIPs = nil
+	}
+	for key := range s.relayed {
+		if _, ok := relayed[key]; !ok {
+			s.log().WithField("pubkey", key.String()).Info("peer reachable again, no longer relaying")
+		}
+	}
+	s.relayed = relayed
+}
+
+// checkHandshakes reports peers which became unreachable.
+// Only peers with persistent keepalives are considered, since idle peers do not attempt handshakes.
+func (s *State) checkHandshakes(nodes []common.Node, keys []wgtypes.Key, peerCfgs []wgtypes.PeerConfig) {
+	failed := make(map[wgtypes.Key]struct{})
+	for i, node := range nodes {
+		if peerCfgs[i].PersistentKeepaliveInterval == nil || s.reachable(keys[i]) {
+			continue
+		}
+		failed[keys[i]] = struct{}{}
+		if _, ok := s.failed[keys[i]]; ok {
+			continue
+		}
+		s.log().WithFields(node.LogFields()).Warn("handshake with peer failed")
+		if s.OnHandshakeFailed != nil {
+			s.OnHandshakeFailed(node)
+		}
+	}
+	s.failed = failed
+}
+
+// enableForwarding allows the interface to forward packets between peers, which is needed by relay nodes.
+// ICMP redirects are disabled, since the peers cannot reach each other directly anyway.
+func enableForwarding(iface string) error {
+	settings := map[string]string{
+		filepath.Join("/proc/sys/net/ipv4/conf", iface, "forwarding"):     "1",
+		filepath.Join("/proc/sys/net/ipv4/conf", iface, "send_redirects"): "0",
+		filepath.Join("/proc/sys/net/ipv6/conf", iface, "forwarding"):     "1",
+	}
+	for path, value := range settings {
+		if err := os.WriteFile(path, []byte(value), 0o644); err != nil {
+			if os.IsNotExist(err) {
+				continue // e.g.: IPv6 disabled
+			}
+			return fmt.Errorf("writing %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// removedPeers returns configs removing all device peers which are not part of the desired configs.
+func removedPeers(device *wgtypes.Device, peerCfgs []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	desired := make(map[wgtypes.Key]struct{}, len(peerCfgs))
+	for _, cfg := range peerCfgs {
+		desired[cfg.PublicKey] = struct{}{}
+	}
+	removed := make([]wgtypes.PeerConfig, 0)
+	for _, peer := range device.Peers {
+		if _, ok := desired[peer.PublicKey]; !ok {
+			removed = append(removed, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		}
+	}
+	return removed
+}
@@ -0,0 +1,134 @@
+package wg
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testNodes(t *testing.T, names ...string) []common.Node {
+	t.Helper()
+	nodes := make([]common.Node, len(names))
+	for i, name := range names {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		nodes[i].Name = name
+		nodes[i].Addr = net.IPv4(192, 0, 2, byte(i+1))
+		nodes[i].OverlayAddr = netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)})
+		nodes[i].PubKey = key.PublicKey().String()
+	}
+	return nodes
+}
+
+func Test_State_nodesToPeerConfigs_relay(t *testing.T) {
+	nodes := testNodes(t, "relay", "direct", "unreachable")
+	nodes[0].Relay = true
+
+	keys := make([]wgtypes.Key, len(nodes))
+	for i, node := range nodes {
+		keys[i] = mustParseKey(t, node.PubKey)
+	}
+
+	longAgo := time.Now().Add(-time.Hour)
+	s := &State{
+		Port:      51820,
+		localNode: &common.Node{Name: "local"},
+		peerSince: map[wgtypes.Key]time.Time{keys[0]: longAgo, keys[1]: longAgo, keys[2]: longAgo},
+		handshakes: map[wgtypes.Key]time.Time{
+			keys[0]: time.Now(),
+			keys[1]: time.Now(),
+		},
+	}
+
+	peerCfgs, err := s.nodesToPeerConfigs(nodes)
+	require.NoError(t, err)
+	require.Len(t, peerCfgs, 3)
+
+	assert.Equal(t, []net.IPNet{*addrToIPNet(nodes[0].OverlayAddr), *addrToIPNet(nodes[2].OverlayAddr)}, peerCfgs[0].AllowedIPs)
+	assert.Equal(t, []net.IPNet{*addrToIPNet(nodes[1].OverlayAddr)}, peerCfgs[1].AllowedIPs)
+	assert.Empty(t, peerCfgs[2].AllowedIPs)
+	for _, cfg := range peerCfgs {
+		require.NotNil(t, cfg.PersistentKeepaliveInterval)
+	}
+
+	// once the handshake succeeds, the peer should be routed directly again
+	s.handshakes[keys[2]] = time.Now()
+	peerCfgs, err = s.nodesToPeerConfigs(nodes)
+	require.NoError(t, err)
+	assert.Equal(t, []net.IPNet{*addrToIPNet(nodes[2].OverlayAddr)}, peerCfgs[2].AllowedIPs)
+	assert.Empty(t, s.relayed)
+}
+
+func Test_State_nodesToPeerConfigs_no_relays(t *testing.T) {
+	nodes := testNodes(t, "unreachable")
+	key := mustParseKey(t, nodes[0].PubKey)
+
+	s := &State{
+		Port:      51820,
+		localNode: &common.Node{Name: "local"},
+		peerSince: map[wgtypes.Key]time.Time{key: time.Now().Add(-time.Hour)},
+	}
+
+	peerCfgs, err := s.nodesToPeerConfigs(nodes)
+	require.NoError(t, err)
+	require.Len(t, peerCfgs, 1)
+	assert.Equal(t, []net.IPNet{*addrToIPNet(nodes[0].OverlayAddr)}, peerCfgs[0].AllowedIPs)
+	assert.Nil(t, peerCfgs[0].PersistentKeepaliveInterval)
+}
+
+func Test_State_checkHandshakes(t *testing.T) {
+	nodes := testNodes(t, "reachable", "unreachable", "idle")
+	keys := make([]wgtypes.Key, len(nodes))
+	for i, node := range nodes {
+		keys[i] = mustParseKey(t, node.PubKey)
+	}
+	keepalive := keepaliveInterval
+	peerCfgs := []wgtypes.PeerConfig{
+		{PersistentKeepaliveInterval: &keepalive},
+		{PersistentKeepaliveInterval: &keepalive},
+		{},
+	}
+
+	longAgo := time.Now().Add(-time.Hour)
+	failed := make([]string, 0)
+	s := &State{
+		peerSince:         map[wgtypes.Key]time.Time{keys[0]: longAgo, keys[1]: longAgo, keys[2]: longAgo},
+		handshakes:        map[wgtypes.Key]time.Time{keys[0]: time.Now()},
+		OnHandshakeFailed: func(node common.Node) { failed = append(failed, node.Name) },
+	}
+
+	s.checkHandshakes(nodes, keys, peerCfgs)
+	assert.Equal(t, []string{"unreachable"}, failed, "idle peers without keepalive should not be reported")
+
+	s.checkHandshakes(nodes, keys, peerCfgs)
+	assert.Equal(t, []string{"unreachable"}, failed, "failures should only be reported once")
+
+	s.handshakes[keys[1]] = time.Now()
+	s.checkHandshakes(nodes, keys, peerCfgs)
+	s.handshakes[keys[1]] = longAgo
+	s.checkHandshakes(nodes, keys, peerCfgs)
+	assert.Equal(t, []string{"unreachable", "unreachable"}, failed, "renewed failures should be reported again")
+}
+
+func Test_removedPeers(t *testing.T) {
+	nodes := testNodes(t, "kept", "removed")
+	kept, removed := mustParseKey(t, nodes[0].PubKey), mustParseKey(t, nodes[1].PubKey)
+
+	device := &wgtypes.Device{Peers: []wgtypes.Peer{{PublicKey: kept}, {PublicKey: removed}}}
+
+	got := removedPeers(device, []wgtypes.PeerConfig{{PublicKey: kept}})
+	assert.Equal(t, []wgtypes.PeerConfig{{PublicKey: removed, Remove: true}}, got)
+}
+
+func mustParseKey(t *testing.T, s string) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.ParseKey(s)
+	require.NoError(t, err)
+	return key
+}
@@ -0,0 +1,99 @@
+package wg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"syscall"
+
+	"github.com/costela/wesher/common"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// applyRoutes adds the networks advertised by peers to their allowed IPs, so traffic to them is routed through the
+// peers.
+// Networks overlapping the overlay network, the local node's own networks or the networks of another peer - taking
+// peers in order of names, so all nodes agree - are ignored.
+func (s *State) applyRoutes(nodes []common.Node, peerCfgs []wgtypes.PeerConfig) {
+	s.routes = nil
+	if !s.PeerRoutes {
+		return
+	}
+
+	order := make([]int, len(nodes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return nodes[order[i]].Name < nodes[order[j]].Name })
+
+	claimed := make([]netip.Prefix, 0)
+	if s.localNode != nil {
+		claimed = append(claimed, s.localNode.Routes...)
+	}
+	ignored := make(map[string]struct{})
+	for _, i := range order {
+		for _, route := range nodes[i].Routes {
+			route = route.Masked()
+			if !route.IsValid() || route.Overlaps(s.overlayNet) || overlapsAny(claimed, route) {
+				id := nodes[i].Name + " " + route.String()
+				ignored[id] = struct{}{}
+				if _, ok := s.ignoredRoutes[id]; !ok {
+					s.log().WithFields(nodes[i].LogFields()).WithField("route", route.String()).Warn("ignoring conflicting route advertised by peer")
+				}
+				continue
+			}
+			claimed = append(claimed, route)
+			s.routes = append(s.routes, route)
+			peerCfgs[i].AllowedIPs = append(peerCfgs[i].AllowedIPs, *prefixToIPNet(route))
+		}
+	}
+	s.ignoredRoutes = ignored
+}
+
+func overlapsAny(prefixes []netip.Prefix, prefix netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Overlaps(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncRoutes routes the networks advertised by peers through the interface, removing routes no longer advertised.
+func (s *State) syncRoutes(link netlink.Link) error {
+	installed := make(map[netip.Prefix]struct{}, len(s.routes))
+	for _, route := range s.routes {
+		if err := netlink.RouteReplace(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       prefixToIPNet(route),
+			Scope:     netlink.SCOPE_LINK,
+		}); err != nil {
+			return fmt.Errorf("adding route %s to %s: %w", route, s.iface, err)
+		}
+		installed[route] = struct{}{}
+	}
+	for route := range s.installedRoutes {
+		if _, ok := installed[route]; ok {
+			continue
+		}
+		if err := netlink.RouteDel(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       prefixToIPNet(route),
+			Scope:     netlink.SCOPE_LINK,
+		}); err != nil && !errors.Is(err, syscall.ESRCH) {
+			s.log().WithError(err).WithField("route", route.String()).Warn("could not remove route no longer advertised")
+		}
+	}
+	s.installedRoutes = installed
+	return nil
+}
+
+func prefixToIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
@@ -0,0 +1,49 @@
+package wg
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_State_nodesToPeerConfigs_routes(t *testing.T) {
+	nodes := testNodes(t, "b", "a", "c", "d")
+	nodes[0].Routes = []netip.Prefix{netip.MustParsePrefix("10.244.1.0/24")}
+	nodes[1].Routes = []netip.Prefix{netip.MustParsePrefix("10.244.1.128/25"), netip.MustParsePrefix("10.244.2.0/24")}
+	nodes[2].Routes = []netip.Prefix{netip.MustParsePrefix("10.244.0.0/24")}
+	nodes[3].Routes = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	local := &common.Node{Name: "local"}
+	local.Routes = []netip.Prefix{netip.MustParsePrefix("10.244.0.0/24")}
+	s := &State{
+		localNode:  local,
+		overlayNet: netip.MustParsePrefix("10.0.0.0/16"),
+		PeerRoutes: true,
+	}
+
+	peerCfgs, err := s.nodesToPeerConfigs(nodes)
+	require.NoError(t, err)
+
+	allowed := func(overlay netip.Addr, routes ...string) []net.IPNet {
+		ipNets := []net.IPNet{*addrToIPNet(overlay)}
+		for _, r := range routes {
+			ipNets = append(ipNets, *prefixToIPNet(netip.MustParsePrefix(r)))
+		}
+		return ipNets
+	}
+	assert.Equal(t, allowed(nodes[0].OverlayAddr), peerCfgs[0].AllowedIPs, "route overlapping a route of a peer sorted earlier should be ignored")
+	assert.Equal(t, allowed(nodes[1].OverlayAddr, "10.244.1.128/25", "10.244.2.0/24"), peerCfgs[1].AllowedIPs)
+	assert.Equal(t, allowed(nodes[2].OverlayAddr), peerCfgs[2].AllowedIPs, "route overlapping a local route should be ignored")
+	assert.Equal(t, allowed(nodes[3].OverlayAddr), peerCfgs[3].AllowedIPs, "route overlapping the overlay network should be ignored")
+	assert.ElementsMatch(t, []netip.Prefix{netip.MustParsePrefix("10.244.1.128/25"), netip.MustParsePrefix("10.244.2.0/24")}, s.routes)
+
+	s.PeerRoutes = false
+	peerCfgs, err = s.nodesToPeerConfigs(nodes)
+	require.NoError(t, err)
+	assert.Equal(t, allowed(nodes[1].OverlayAddr), peerCfgs[1].AllowedIPs, "routes should only be applied if enabled")
+	assert.Empty(t, s.routes)
+}
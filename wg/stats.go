@@ -0,0 +1,53 @@
+package wg
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/costela/wesher/common"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PeerStats holds the wireguard view of a peer, as of the last interface setup.
+type PeerStats struct {
+	Node          common.Node
+	Endpoint      netip.AddrPort
+	LastHandshake time.Time
+	RxBytes       int64
+	TxBytes       int64
+	// RecentHandshake is set if a handshake completed within the handshake timeout.
+	RecentHandshake bool
+	// Failed is set if no handshake completed within the handshake timeout, despite persistent keepalives.
+	Failed bool
+	// Relayed is set if traffic to the peer is currently routed through a relay.
+	Relayed bool
+	// PresharedKey is set if a preshared key is configured for the peer.
+	PresharedKey bool
+}
+
+// PeerStats returns the stats of the peers among the provided nodes.
+func (s *State) PeerStats(nodes []common.Node) []PeerStats {
+	peers := s.Peers(nodes)
+	stats := make([]PeerStats, 0, len(peers))
+	for _, node := range peers {
+		pubKey, err := wgtypes.ParseKey(node.PubKey)
+		if err != nil {
+			continue
+		}
+		_, failed := s.failed[pubKey]
+		relay, relayed := s.relayed[pubKey]
+		_, psk := s.presharedKeys[pubKey]
+		stats = append(stats, PeerStats{
+			Node:            node,
+			Endpoint:        s.endpoints[pubKey],
+			LastHandshake:   s.handshakes[pubKey],
+			RxBytes:         s.transfer[pubKey][0],
+			TxBytes:         s.transfer[pubKey][1],
+			RecentHandshake: time.Since(s.handshakes[pubKey]) < s.handshakeTimeout(),
+			Failed:          failed,
+			Relayed:         relayed && relay != (wgtypes.Key{}),
+			PresharedKey:    psk,
+		})
+	}
+	return stats
+}
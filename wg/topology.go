@@ -0,0 +1,129 @@
+package wg
+
+import (
+	"encoding"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/costela/wesher/common"
+)
+
+// Topology decides which pairs of cluster nodes are peered with each other.
+// Implementations must be symmetric: if a is peered with b, b must also be peered with a, otherwise the wireguard
+// handshake between both can never complete.
+// The topology should therefore be the same across the cluster.
+type Topology interface {
+	Peered(a, b *common.Node) bool
+}
+
+// FullMesh peers every node with every other node.
+type FullMesh struct{}
+
+// Peered implements the Topology interface.
+func (FullMesh) Peered(a, b *common.Node) bool { return true }
+
+// HubAndSpoke peers hub nodes with every other node, while spoke nodes are only peered with hubs.
+type HubAndSpoke struct {
+	Hubs []Selector
+}
+
+// Peered implements the Topology interface.
+func (t HubAndSpoke) Peered(a, b *common.Node) bool {
+	return matchAny(t.Hubs, a) || matchAny(t.Hubs, b)
+}
+
+// PeerRules only peers nodes matching at least one of its rules.
+type PeerRules []PeerRule
+
+// Peered implements the Topology interface.
+func (t PeerRules) Peered(a, b *common.Node) bool {
+	for _, rule := range t {
+		if rule.matches(a, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerRule allows peering between nodes matching one selector with nodes matching the other.
+// Rules are symmetric; the order of the selectors is irrelevant.
+type PeerRule struct {
+	A, B Selector
+}
+
+var _ encoding.TextUnmarshaler = (*PeerRule)(nil)
+
+// UnmarshalText parses a rule in the "SELECTOR:SELECTOR" format.
+func (r *PeerRule) UnmarshalText(in []byte) error {
+	a, b, ok := strings.Cut(string(in), ":")
+	if !ok {
+		return fmt.Errorf("invalid peer rule %q: expected SELECTOR:SELECTOR", in)
+	}
+	if err := r.A.UnmarshalText([]byte(a)); err != nil {
+		return err
+	}
+	return r.B.UnmarshalText([]byte(b))
+}
+
+func (r PeerRule) matches(a, b *common.Node) bool {
+	return (r.A.Matches(a) && r.B.Matches(b)) || (r.A.Matches(b) && r.B.Matches(a))
+}
+
+func (r PeerRule) String() string {
+	return r.A.String() + ":" + r.B.String()
+}
+
+// Selector matches nodes either by label ("key=value") or by a name glob ("edge-*").
+type Selector struct {
+	label, value string
+	glob         string
+}
+
+var _ encoding.TextUnmarshaler = (*Selector)(nil)
+
+// UnmarshalText parses a selector in either the "key=value" or the name glob format.
+func (s *Selector) UnmarshalText(in []byte) error {
+	text := strings.TrimSpace(string(in))
+	if text == "" {
+		return fmt.Errorf("empty node selector")
+	}
+	if label, value, ok := strings.Cut(text, "="); ok {
+		if label == "" {
+			return fmt.Errorf("invalid node selector %q: empty label", text)
+		}
+		*s = Selector{label: label, value: value}
+		return nil
+	}
+	if _, err := path.Match(text, ""); err != nil {
+		return fmt.Errorf("invalid node selector %q: %w", text, err)
+	}
+	*s = Selector{glob: text}
+	return nil
+}
+
+// Matches returns whether the given node is selected.
+func (s Selector) Matches(node *common.Node) bool {
+	if s.label != "" {
+		value, ok := node.Labels[s.label]
+		return ok && value == s.value
+	}
+	matched, _ := path.Match(s.glob, node.Name) // nolint: errcheck // pattern validated on parsing
+	return matched
+}
+
+func (s Selector) String() string {
+	if s.label != "" {
+		return s.label + "=" + s.value
+	}
+	return s.glob
+}
+
+func matchAny(selectors []Selector, node *common.Node) bool {
+	for _, s := range selectors {
+		if s.Matches(node) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package wg
+
+import (
+	"testing"
+
+	"github.com/costela/wesher/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustSelector(t *testing.T, s string) Selector {
+	t.Helper()
+	sel := Selector{}
+	require.NoError(t, sel.UnmarshalText([]byte(s)))
+	return sel
+}
+
+func mustPeerRule(t *testing.T, s string) PeerRule {
+	t.Helper()
+	rule := PeerRule{}
+	require.NoError(t, rule.UnmarshalText([]byte(s)))
+	return rule
+}
+
+func labeledNode(name string, labels map[string]string) *common.Node {
+	node := &common.Node{Name: name}
+	node.Labels = labels
+	return node
+}
+
+func Test_Selector_Matches(t *testing.T) {
+	node := labeledNode("edge-1", map[string]string{"role": "edge"})
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"role=edge", true},
+		{"role=gateway", false},
+		{"zone=edge", false},
+		{"edge-*", true},
+		{"gw-*", false},
+		{"edge-1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			assert.Equal(t, tt.want, mustSelector(t, tt.selector).Matches(node))
+		})
+	}
+}
+
+func Test_Selector_UnmarshalText_invalid(t *testing.T) {
+	for _, in := range []string{"", "=value", "edge-["} {
+		sel := Selector{}
+		assert.Errorf(t, sel.UnmarshalText([]byte(in)), "expected error for %q", in)
+	}
+}
+
+func Test_Topology_Peered(t *testing.T) {
+	edge1 := labeledNode("edge-1", map[string]string{"role": "edge"})
+	edge2 := labeledNode("edge-2", map[string]string{"role": "edge"})
+	gw := labeledNode("gw-1", map[string]string{"role": "gateway"})
+	db := labeledNode("db-1", map[string]string{"role": "db"})
+
+	tests := []struct {
+		name     string
+		topology Topology
+		a, b     *common.Node
+		want     bool
+	}{
+		{"full mesh", FullMesh{}, edge1, edge2, true},
+		{"hub to spoke", HubAndSpoke{Hubs: []Selector{mustSelector(t, "role=gateway")}}, gw, edge1, true},
+		{"spoke to hub", HubAndSpoke{Hubs: []Selector{mustSelector(t, "role=gateway")}}, edge1, gw, true},
+		{"spoke to spoke", HubAndSpoke{Hubs: []Selector{mustSelector(t, "role=gateway")}}, edge1, edge2, false},
+		{"rule match", PeerRules{mustPeerRule(t, "role=edge:role=gateway")}, edge1, gw, true},
+		{"rule match is symmetric", PeerRules{mustPeerRule(t, "role=edge:role=gateway")}, gw, edge1, true},
+		{"rule mismatch", PeerRules{mustPeerRule(t, "role=edge:role=gateway")}, edge1, edge2, false},
+		{"second rule match", PeerRules{mustPeerRule(t, "role=edge:role=gateway"), mustPeerRule(t, "gw-*:db-*")}, db, gw, true},
+		{"no rules", PeerRules{}, edge1, gw, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.topology.Peered(tt.a, tt.b))
+		})
+	}
+}
+
+func Test_State_nodesToPeerConfigs_topology(t *testing.T) {
+	nodes := testNodes(t, "edge-1", "gateway", "edge-2")
+	for i, role := range []string{"edge", "gateway", "edge"} {
+		nodes[i].Labels = map[string]string{"role": role}
+	}
+
+	s := &State{
+		Port:      51820,
+		Topology:  PeerRules{mustPeerRule(t, "role=edge:role=gateway")},
+		localNode: labeledNode("local", map[string]string{"role": "edge"}),
+	}
+
+	peerCfgs, err := s.nodesToPeerConfigs(nodes)
+	require.NoError(t, err)
+	require.Len(t, peerCfgs, 1)
+	assert.Equal(t, nodes[1].PubKey, peerCfgs[0].PublicKey.String())
+}
@@ -1,12 +1,14 @@
 package wg
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"net"
 	"net/netip"
 	"os"
+	"time"
 
 	"github.com/costela/wesher/common"
 	"github.com/sirupsen/logrus"
@@ -23,37 +25,84 @@ type State struct {
 	Port        int
 	PrivKey     wgtypes.Key
 	PubKey      wgtypes.Key
+	// Topology decides which nodes are peered with the local node; defaults to FullMesh.
+	Topology Topology
+	// Relay enables forwarding, to allow routing traffic between peers unable to reach each other directly.
+	Relay bool
+	// HandshakeTimeout is the time after which peers are considered unreachable and routed through a relay, if
+	// available; defaults to DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// BehindNAT enables persistent keepalives to all peers, to keep NAT mappings open.
+	BehindNAT bool
+	// PeerRoutes enables routing the networks advertised by peers (see common.Node.Routes) through the interface.
+	PeerRoutes bool
+	// PresharedKeySecret enables per-pair preshared keys - derived from the secret - with peers also using them (see
+	// common.Node.PresharedKeys).
+	PresharedKeySecret []byte
+	// Logger is used for logging peer changes; defaults to the standard logrus logger.
+	Logger logrus.FieldLogger
+	// OnHandshakeFailed is called when a peer becomes unreachable, i.e.: no handshake completed within
+	// HandshakeTimeout, despite keepalives.
+	OnHandshakeFailed func(node common.Node)
+	failed            map[wgtypes.Key]struct{}
+	localNode         *common.Node
+	endpoints         map[wgtypes.Key]netip.AddrPort
+	peerSince         map[wgtypes.Key]time.Time
+	handshakes        map[wgtypes.Key]time.Time
+	relayed           map[wgtypes.Key]wgtypes.Key
+	transfer          map[wgtypes.Key][2]int64
+	overlayNet        netip.Prefix
+	routes            []netip.Prefix
+	installedRoutes   map[netip.Prefix]struct{}
+	ignoredRoutes     map[string]struct{}
+	presharedKeys     map[wgtypes.Key]struct{}
+	resolved          map[string]resolvedEndpoint
+	// lookupHost resolves advertised endpoints; overridden in tests
+	lookupHost func(ctx context.Context, host string) ([]net.IPAddr, error)
 }
 
 // New creates a new Wesher Wireguard state.
-// The Wireguard keys are generated for every new interface.
+// The Wireguard keys are generated for every new interface, unless a previously used private key is provided.
 // The interface must later be setup using SetUpInterface.
-func New(iface string, port int, prefix netip.Prefix, name string) (*State, *common.Node, error) {
+func New(iface string, port int, prefix netip.Prefix, name string, privKeyStr string) (*State, *common.Node, error) {
 	client, err := wgctrl.New()
 	if err != nil {
 		return nil, nil, fmt.Errorf("instantiating wireguard client: %w", err)
 	}
 
-	privKey, err := wgtypes.GeneratePrivateKey()
-	if err != nil {
-		return nil, nil, fmt.Errorf("generating private key: %w", err)
+	var privKey wgtypes.Key
+	if privKeyStr != "" {
+		privKey, err = wgtypes.ParseKey(privKeyStr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing private key: %w", err)
+		}
+	} else {
+		privKey, err = wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return nil, nil, fmt.Errorf("generating private key: %w", err)
+		}
 	}
 	pubKey := privKey.PublicKey()
 
 	state := State{
-		iface:   iface,
-		client:  client,
-		Port:    port,
-		PrivKey: privKey,
-		PubKey:  pubKey,
+		iface:    iface,
+		client:   client,
+		Port:     port,
+		PrivKey:  privKey,
+		PubKey:   pubKey,
+		Topology: FullMesh{},
+
+		overlayNet: prefix.Masked(),
 	}
 	if err := state.assignOverlayAddr(prefix, name); err != nil {
 		return nil, nil, fmt.Errorf("assigning overlay address: %w", err)
 	}
 
-	node := &common.Node{}
+	node := &common.Node{Name: name}
 	node.OverlayAddr = state.OverlayAddr
 	node.PubKey = state.PubKey.String()
+	node.WireguardPort = port
+	state.localNode = node
 
 	return &state, node, nil
 }
@@ -79,8 +128,6 @@ func (s *State) assignOverlayAddr(prefix netip.Prefix, name string) error {
 		return fmt.Errorf("could not create IP from %q", ip)
 	}
 
-	logrus.Debugf("assigned overlay address: %s", addr)
-
 	s.OverlayAddr = addr
 
 	return nil
@@ -107,15 +154,21 @@ func (s *State) SetUpInterface(nodes []common.Node) error {
 		return fmt.Errorf("creating link %s: %w", s.iface, err)
 	}
 
+	device, err := s.client.Device(s.iface)
+	if err != nil {
+		return fmt.Errorf("getting device %s: %w", s.iface, err)
+	}
+	s.updatePeerStatus(device)
+
 	peerCfgs, err := s.nodesToPeerConfigs(nodes)
 	if err != nil {
 		return fmt.Errorf("converting received node information to wireguard format: %w", err)
 	}
+	// peers are updated in place instead of replaced, to avoid needlessly dropping sessions
 	if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
-		PrivateKey:   &s.PrivKey,
-		ListenPort:   &s.Port,
-		ReplacePeers: true,
-		Peers:        peerCfgs,
+		PrivateKey: &s.PrivKey,
+		ListenPort: &s.Port,
+		Peers:      append(peerCfgs, removedPeers(device, peerCfgs)...),
 	}); err != nil {
 		return fmt.Errorf("setting wireguard configuration for %s: %w", s.iface, err)
 	}
@@ -136,7 +189,13 @@ func (s *State) SetUpInterface(nodes []common.Node) error {
 	if err := netlink.LinkSetUp(link); err != nil {
 		return fmt.Errorf("enabling interface %s: %w", s.iface, err)
 	}
-	for _, node := range nodes {
+	// relays forward between peers, routed networks between peers and local networks
+	if s.Relay || s.PeerRoutes {
+		if err := enableForwarding(s.iface); err != nil {
+			return fmt.Errorf("enabling forwarding on %s: %w", s.iface, err)
+		}
+	}
+	for _, node := range s.Peers(nodes) {
 		if err := netlink.RouteAdd(&netlink.Route{
 			LinkIndex: link.Attrs().Index,
 			Dst:       addrToIPNet(node.OverlayAddr),
@@ -145,6 +204,9 @@ func (s *State) SetUpInterface(nodes []common.Node) error {
 			return fmt.Errorf("adding route %s to %s: %w", node.OverlayAddr, s.iface, err)
 		}
 	}
+	if err := s.syncRoutes(link); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -156,24 +218,46 @@ func addrToIPNet(addr netip.Addr) *net.IPNet {
 	}
 }
 
+// Peers filters the provided nodes down to the ones the local node is peered with, according to the configured
+// Topology.
+func (s *State) Peers(nodes []common.Node) []common.Node {
+	if s.Topology == nil {
+		return nodes
+	}
+	peers := make([]common.Node, 0, len(nodes))
+	for i := range nodes {
+		if s.Topology.Peered(s.localNode, &nodes[i]) {
+			peers = append(peers, nodes[i])
+		}
+	}
+	return peers
+}
+
 func (s *State) nodesToPeerConfigs(nodes []common.Node) ([]wgtypes.PeerConfig, error) {
+	nodes = s.Peers(nodes)
 	peerCfgs := make([]wgtypes.PeerConfig, len(nodes))
+	keys := make([]wgtypes.Key, len(nodes))
 	for i, node := range nodes {
 		pubKey, err := wgtypes.ParseKey(node.PubKey)
 		if err != nil {
 			return nil, fmt.Errorf("parsing wireguard key: %w", err)
 		}
+		keys[i] = pubKey
 		peerCfgs[i] = wgtypes.PeerConfig{
-			PublicKey:         pubKey,
-			ReplaceAllowedIPs: true,
-			Endpoint: &net.UDPAddr{
-				IP:   node.Addr,
-				Port: s.Port,
-			},
+			PublicKey:                   pubKey,
+			ReplaceAllowedIPs:           true,
+			Endpoint:                    s.peerEndpoint(&nodes[i]),
+			PersistentKeepaliveInterval: s.peerKeepalive(&nodes[i]),
 			AllowedIPs: []net.IPNet{
 				*addrToIPNet(node.OverlayAddr),
 			},
 		}
 	}
+	if err := s.applyPresharedKeys(nodes, keys, peerCfgs); err != nil {
+		return nil, err
+	}
+	s.applyRoutes(nodes, peerCfgs)
+	s.applyRelays(nodes, keys, peerCfgs)
+	s.checkHandshakes(nodes, keys, peerCfgs)
 	return peerCfgs, nil
 }